@@ -12,6 +12,8 @@ const (
 	DataClonePhaseCreatingPVC = "CreatingPVC"
 	// DataClonePhasePodInitializing is the phase when the pod is being initialized.
 	DataClonePhasePodInitializing = "PodInitializing"
+	// DataClonePhaseRestoring is the phase when a logical dump is being restored.
+	DataClonePhaseRestoring = "Restoring"
 	// DataClonePhaseMasking is the phase when the data is being masked.
 	DataClonePhaseMasking = "MaskingInProgress"
 	// DataClonePhaseReady is the phase when the clone is ready.
@@ -30,7 +32,8 @@ type DataCloneSpec struct {
 	// SourceProfile is the name of the DataProfile to clone from.
 	SourceProfile string `json:"sourceProfile"`
 
-	// SnapshotName is the name of the specific snapshot to use.
+	// SnapshotName is the name of the specific snapshot to use, or of the
+	// dump for profiles that take logical dumps.
 	// If not specified, the latest snapshot will be used.
 	// +optional
 	SnapshotName string `json:"snapshotName,omitempty"`
@@ -50,7 +53,8 @@ type DataCloneSpec struct {
 
 // DatabaseSpec defines the database configuration for a clone.
 type DatabaseSpec struct {
-	// Image is the PostgreSQL image to use for the clone.
+	// Image is the database image to use for the clone. Defaults to an image
+	// of the engine of the source profile.
 	// +optional
 	Image string `json:"image,omitempty"`
 	// User is the database user to create.
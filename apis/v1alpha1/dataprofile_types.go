@@ -1,6 +1,8 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -34,6 +36,145 @@ type DataProfileSpec struct {
 	// Masking defines the data masking rules.
 	// +optional
 	Masking MaskingSpec `json:"masking,omitempty"`
+
+	// Subset restricts the rows copied from the source database to a
+	// referentially complete subset. All rows are copied when unset.
+	// +optional
+	Subset *SubsetSpec `json:"subset,omitempty"`
+
+	// Tables selects the schemas and tables copied from the source database.
+	// All tables are copied when unset.
+	// +optional
+	Tables *TableSelection `json:"tables,omitempty"`
+
+	// Dump takes snapshots as logical dumps of the target database, masked as
+	// they are read, instead of VolumeSnapshots of its volume. It suits
+	// databases whose storage cannot be snapshotted, such as managed
+	// databases. Clones are restored from the latest dump.
+	// +optional
+	Dump *DumpSpec `json:"dump,omitempty"`
+
+	// MaskedSnapshot masks every VolumeSnapshot once, when it is taken: the
+	// snapshot is restored to a scratch volume, masked there and snapshotted
+	// again. Clones are created from the masked snapshot and are not masked
+	// again, so unmasked data never reaches their volumes.
+	// +optional
+	MaskedSnapshot *MaskedSnapshotSpec `json:"maskedSnapshot,omitempty"`
+}
+
+// MaskedSnapshotSpec configures the masking of the snapshots of a
+// DataProfile.
+type MaskedSnapshotSpec struct {
+	// Image is the database image masking runs against, which must run the
+	// version of the target database. Defaults to the image clones of the
+	// engine run.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// StorageClassName is the storage class of the scratch volume. The
+	// storage class of the target volume is used when unset.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// VolumeSnapshotClassName is the class of the masked snapshots. The
+	// default class is used when unset.
+	// +optional
+	VolumeSnapshotClassName *string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// DumpSpec configures the logical dumps of a DataProfile. The dumps are
+// written to a PersistentVolumeClaim named "<profile>-dumps", which the
+// controller creates, and RetentionPolicy bounds how many are kept.
+type DumpSpec struct {
+	// StorageClassName is the storage class of the claim holding the dumps
+	// and of the volumes of the clones restored from them. The default
+	// storage class is used when unset.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// Size of the claim holding the dumps and of the volumes of the clones
+	// restored from them. Defaults to 10Gi.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// AccessModes of the claim holding the dumps. Defaults to ReadWriteOnce,
+	// which requires the dump and restore jobs to run on the same node;
+	// ReadWriteMany lets them run anywhere.
+	// +optional
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+}
+
+// TableSelection selects schemas and tables by name. Patterns use shell glob
+// syntax: * matches any sequence of characters and ? any single character.
+// Table patterns match table names or, when they contain a dot,
+// schema-qualified names such as "audit.*".
+type TableSelection struct {
+	// IncludeSchemas are the schemas to copy tables from. All schemas are
+	// copied when empty.
+	// +optional
+	IncludeSchemas []string `json:"includeSchemas,omitempty"`
+
+	// ExcludeSchemas are schemas whose tables are not copied.
+	// +optional
+	ExcludeSchemas []string `json:"excludeSchemas,omitempty"`
+
+	// Include are the tables to copy. All tables are copied when empty.
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Exclude are tables that are not copied.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+
+	// StructureOnly are copied tables whose definition is copied but whose
+	// rows are not, such as audit logs and event stores.
+	// +optional
+	StructureOnly []string `json:"structureOnly,omitempty"`
+}
+
+// SubsetSpec defines the subset of rows copied from the source database. Rows
+// are selected in the listed tables, then every row they reference through
+// foreign keys is added, recursively, so the subset has no dangling foreign
+// keys. Tables that are not listed only contain the rows reached this way.
+type SubsetSpec struct {
+	// Tables lists the tables to start from and the rows to select in each.
+	// +kubebuilder:validation:MinItems=1
+	Tables []TableSubset `json:"tables"`
+
+	// FollowReferencing also adds the rows referencing the selected rows, such
+	// as the orders of selected customers, recursively. Rows added only because
+	// they are referenced do not pull in the rows referencing them.
+	// +optional
+	FollowReferencing bool `json:"followReferencing,omitempty"`
+
+	// StorageClassName is the storage class of the volumes of the clones the
+	// subset is copied into. The default storage class is used when unset.
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// Size of the volumes of the clones the subset is copied into. Defaults
+	// to 10Gi.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+}
+
+// TableSubset selects the rows of a table to start a subset from.
+type TableSubset struct {
+	// Table to select rows from.
+	Table string `json:"table"`
+
+	// Where is an SQL condition the selected rows satisfy, e.g.
+	// "created_at > now() - interval '30 days'". All rows are selected when
+	// empty.
+	// +optional
+	Where string `json:"where,omitempty"`
+
+	// Percent is the percentage of the rows satisfying Where to select,
+	// sampled at random. Defaults to 100.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	Percent int32 `json:"percent,omitempty"`
 }
 
 // DatabaseTarget defines the database connection information.
@@ -41,9 +182,49 @@ type DatabaseTarget struct {
 	// SecretName is the name of the secret containing the database credentials.
 	SecretName string `json:"secretName"`
 	// PVCName is the name of the PersistentVolumeClaim to be snapshotted.
-	PVCName string `json:"pvcName"`
+	// Required unless the profile takes logical dumps.
+	// +optional
+	PVCName string `json:"pvcName,omitempty"`
+	// Engine is the database engine of the target, "postgres" for PostgreSQL
+	// or "mysql" for MySQL and MariaDB. Clones run the same engine.
+	// +kubebuilder:validation:Enum=postgres;mysql
+	// +kubebuilder:default=postgres
+	// +optional
+	Engine string `json:"engine,omitempty"`
+	// TLS configures encrypted connections to the target. Connections are
+	// not encrypted when unset.
+	// +optional
+	TLS *DatabaseTLS `json:"tls,omitempty"`
+}
+
+// DatabaseTLS configures encrypted connections to a database.
+type DatabaseTLS struct {
+	// Mode is the sslmode of the connections: "require" encrypts them,
+	// "verify-ca" also verifies the server certificate against the CA and
+	// "verify-full" also verifies that it matches the host.
+	// +kubebuilder:validation:Enum=disable;require;verify-ca;verify-full
+	// +kubebuilder:default=verify-full
+	// +optional
+	Mode string `json:"mode,omitempty"`
+	// CASecretName is the name of a secret whose key ca.crt holds the PEM
+	// certificates the server certificate is verified with. The system roots
+	// are used when unset.
+	// +optional
+	CASecretName string `json:"caSecretName,omitempty"`
+	// ClientCertSecretName is the name of a kubernetes.io/tls secret holding
+	// the client certificate and key presented to the server, for databases
+	// that authenticate clients by certificate.
+	// +optional
+	ClientCertSecretName string `json:"clientCertSecretName,omitempty"`
 }
 
+const (
+	// DatabaseEnginePostgres is the PostgreSQL database engine.
+	DatabaseEnginePostgres = "postgres"
+	// DatabaseEngineMySQL is the MySQL and MariaDB database engine.
+	DatabaseEngineMySQL = "mysql"
+)
+
 // RetentionPolicy defines the policy for retaining snapshots.
 type RetentionPolicy struct {
 	// Number of snapshots to keep.
@@ -51,11 +232,35 @@ type RetentionPolicy struct {
 	Count int32 `json:"count,omitempty"`
 }
 
+const (
+	// MaskingDefaultActionPassthrough copies columns without a masking rule
+	// unchanged.
+	MaskingDefaultActionPassthrough = "passthrough"
+	// MaskingDefaultActionAllowlist refuses to produce a clone while any column
+	// has no masking rule. Columns are kept unchanged with the "passthrough"
+	// transformation.
+	MaskingDefaultActionAllowlist = "allowlist"
+)
+
 // MaskingSpec defines the data masking configuration.
 type MaskingSpec struct {
 	// Rules is a list of masking rules to apply.
 	// +optional
 	Rules []MaskingRule `json:"rules,omitempty"`
+
+	// DefaultAction is what happens to columns no rule covers. With
+	// "passthrough" they are copied unchanged; with "allowlist" masking fails
+	// until every column has a rule, so new columns cannot leak into clones.
+	// +kubebuilder:validation:Enum=passthrough;allowlist
+	// +kubebuilder:default=passthrough
+	// +optional
+	DefaultAction string `json:"defaultAction,omitempty"`
+
+	// KeySecretRef is a reference to the secret key used for deterministic masking.
+	// When set, fake values are derived from an HMAC of the original value, so
+	// identical values are masked identically across tables, clones and runs.
+	// +optional
+	KeySecretRef *corev1.SecretKeySelector `json:"keySecretRef,omitempty"`
 }
 
 // MaskingRule defines a single data masking rule.
@@ -65,7 +270,48 @@ type MaskingRule struct {
 	// Column to apply the rule to.
 	Column string `json:"column"`
 	// Transformation to apply.
+	// +kubebuilder:validation:Enum=hash;redact;synthesize;creditCard;name;address;dateTime;dateShift;truncate;null;fpe;passthrough
 	Transformation string `json:"transformation"`
+	// Params are the parameters of the transformation.
+	// +optional
+	Params *TransformationParams `json:"params,omitempty"`
+}
+
+// TransformationParams defines the parameters of a transformation. Each
+// transformation only accepts the parameters documented for it.
+type TransformationParams struct {
+	// Salt is mixed into the input of the "hash" transformation.
+	// +optional
+	Salt string `json:"salt,omitempty"`
+	// KeepFirst is the number of leading characters "redact" leaves unmasked.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepFirst int32 `json:"keepFirst,omitempty"`
+	// KeepLast is the number of trailing characters "redact" leaves unmasked.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	KeepLast int32 `json:"keepLast,omitempty"`
+	// MaskChar is the character "redact" masks characters with. Defaults to "*".
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=1
+	// +optional
+	MaskChar string `json:"maskChar,omitempty"`
+	// ShiftDays is the largest number of days "dateShift" moves a date by, in
+	// either direction. Required for "dateShift".
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ShiftDays int32 `json:"shiftDays,omitempty"`
+	// UseStatistics makes "synthesize" draw values from the statistics the
+	// source database collected for the column, such as the range of a numeric
+	// or date column. Statistics of text columns are not used, as they hold
+	// values of the source.
+	// +optional
+	UseStatistics bool `json:"useStatistics,omitempty"`
+	// MaxLength is the number of characters the output of any transformation is
+	// truncated to. Required for "truncate".
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxLength int32 `json:"maxLength,omitempty"`
 }
 
 // DataProfileStatus defines the observed state of DataProfile
@@ -81,9 +327,49 @@ type DataProfileStatus struct {
 	// +optional
 	LastSnapshotTime *metav1.Time `json:"lastSnapshotTime,omitempty"`
 
+	// LatestDump is the name of the latest complete dump of a profile that
+	// takes logical dumps.
+	// +optional
+	LatestDump string `json:"latestDump,omitempty"`
+
+	// LatestMaskedSnapshot is the name of the latest masked VolumeSnapshot of
+	// a profile that masks its snapshots. Clones use it unless they name
+	// another snapshot.
+	// +optional
+	LatestMaskedSnapshot string `json:"latestMaskedSnapshot,omitempty"`
+
 	// Conditions represent the latest available observations of the DataProfile's state.
 	// +optional
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// LastScanTime is the time the target database was last scanned for
+	// sensitive data.
+	// +optional
+	LastScanTime *metav1.Time `json:"lastScanTime,omitempty"`
+
+	// UnmaskedColumns are the columns of the target database that appear to
+	// hold sensitive data but are not masked by any rule, including the ones
+	// marked "passthrough".
+	// +optional
+	UnmaskedColumns []SensitiveColumn `json:"unmaskedColumns,omitempty"`
+
+	// SchemaFingerprint is a digest of the schema of the target database when
+	// it was last scanned, as "sha256:<hex>".
+	// +optional
+	SchemaFingerprint string `json:"schemaFingerprint,omitempty"`
+}
+
+// SensitiveColumn is a column found to hold sensitive data.
+type SensitiveColumn struct {
+	// Table the column belongs to.
+	Table string `json:"table"`
+	// Column name.
+	Column string `json:"column"`
+	// Category of sensitive data the column holds, e.g. "email" or "phone".
+	Category string `json:"category"`
+	// SuggestedRule is a masking rule that would cover the column.
+	// +optional
+	SuggestedRule *MaskingRule `json:"suggestedRule,omitempty"`
 }
 
 //+kubebuilder:object:root=true
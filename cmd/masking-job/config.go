@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/masking"
+	"github.com/Oridak771/Vandal/pkg/client"
+	"github.com/Oridak771/Vandal/pkg/target"
+	"github.com/Oridak771/Vandal/storage"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// connConfig holds the connection settings of a database.
+type connConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	DBName   string
+
+	// SSLMode is the TLS mode of the connections, one of the storage.TLSMode
+	// constants, and SSLRootCert, SSLCert and SSLKey name the PEM files of the
+	// CA, client certificate and client key, as with libpq.
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+}
+
+// connKeys are the keys of a connection secret, as written by the DataClone
+// controller or read from the credentials secret of a DataProfile. The
+// matching environment variables are the upper-cased keys with a SOURCE_ or
+// TARGET_ prefix. A dsn is parsed as described by target.ParseDSN, and the
+// other keys override its settings.
+var connKeys = []string{"host", "port", "user", "password", "dbname", "dsn"}
+
+// loadConnConfig reads the connection settings with the given prefix. Settings
+// are read from the secret mounted at <PREFIX>_SECRET_DIR, if any, and
+// <PREFIX>_<KEY> environment variables take precedence over it. TLS is
+// configured by <PREFIX>_SSLMODE, <PREFIX>_SSLROOTCERT, <PREFIX>_SSLCERT and
+// <PREFIX>_SSLKEY.
+func loadConnConfig(prefix string) (connConfig, error) {
+	values := make(map[string]string)
+
+	if dir := os.Getenv(prefix + "_SECRET_DIR"); dir != "" {
+		for _, key := range connKeys {
+			data, err := os.ReadFile(filepath.Join(dir, key))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return connConfig{}, err
+			}
+			values[key] = strings.TrimSpace(string(data))
+		}
+	}
+	for _, key := range connKeys {
+		if v, ok := os.LookupEnv(prefix + "_" + strings.ToUpper(key)); ok {
+			values[key] = v
+		}
+	}
+
+	if len(values) == 0 {
+		return connConfig{}, nil
+	}
+	var cfg connConfig
+	if dsn := values["dsn"]; dsn != "" {
+		conn, err := target.ParseDSN(os.Getenv("DATABASE_ENGINE"), dsn)
+		if err != nil {
+			return connConfig{}, fmt.Errorf("parsing %s dsn: %w", strings.ToLower(prefix), err)
+		}
+		cfg = connConfig{Host: conn.Host, Port: conn.Port, User: conn.User, Password: conn.Password, DBName: conn.DBName}
+		if conn.TLS != nil {
+			cfg.SSLMode = conn.TLS.Mode
+		}
+	}
+	for key, field := range map[string]*string{
+		"host":     &cfg.Host,
+		"port":     &cfg.Port,
+		"user":     &cfg.User,
+		"password": &cfg.Password,
+		"dbname":   &cfg.DBName,
+	} {
+		if v := values[key]; v != "" {
+			*field = v
+		}
+	}
+	if v := os.Getenv(prefix + "_SSLMODE"); v != "" {
+		cfg.SSLMode = v
+	}
+	cfg.SSLRootCert = os.Getenv(prefix + "_SSLROOTCERT")
+	cfg.SSLCert = os.Getenv(prefix + "_SSLCERT")
+	cfg.SSLKey = os.Getenv(prefix + "_SSLKEY")
+	if cfg.Port == "" {
+		cfg.Port = storage.DefaultPort(os.Getenv("DATABASE_ENGINE"))
+	}
+	if cfg.Host == "" || cfg.User == "" || cfg.DBName == "" {
+		return connConfig{}, fmt.Errorf("%s connection settings must include host, user and dbname", strings.ToLower(prefix))
+	}
+	return cfg, nil
+}
+
+// tls returns the TLS settings of the connection, reading the files they
+// name, or nil if TLS is not configured.
+func (c connConfig) tls() (*storage.TLS, error) {
+	if c.SSLMode == "" || c.SSLMode == storage.TLSModeDisable {
+		return nil, nil
+	}
+	t := &storage.TLS{Mode: c.SSLMode}
+	for _, f := range []struct {
+		path string
+		data *[]byte
+	}{
+		{c.SSLRootCert, &t.CA},
+		{c.SSLCert, &t.Cert},
+		{c.SSLKey, &t.Key},
+	} {
+		if f.path == "" {
+			continue
+		}
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		*f.data = data
+	}
+	return t, nil
+}
+
+// String returns the address of the database, without credentials.
+func (c connConfig) String() string {
+	return fmt.Sprintf("%s:%s/%s", c.Host, c.Port, c.DBName)
+}
+
+// isZero reports whether no connection settings were given.
+func (c connConfig) isZero() bool {
+	return c == connConfig{}
+}
+
+// defaultConnectRetries is the number of times the job retries to reach a
+// database that is not ready yet, such as a clone that is still starting.
+const defaultConnectRetries = 5
+
+// loadStorageOptions reads the connection options of the databases from
+// DATABASE_CONNECT_TIMEOUT and DATABASE_RETRY_INTERVAL (durations such as
+// "30s"), DATABASE_CONNECT_RETRIES and DATABASE_MAX_CONNECTIONS. The pool must
+// hold at least masking.MinConns connections.
+func loadStorageOptions() (storage.Options, error) {
+	opts := storage.Options{ConnectRetries: defaultConnectRetries}
+	for _, d := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"DATABASE_CONNECT_TIMEOUT", &opts.ConnectTimeout},
+		{"DATABASE_RETRY_INTERVAL", &opts.RetryInterval},
+	} {
+		if v := os.Getenv(d.env); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil {
+				return opts, fmt.Errorf("parsing %s: %w", d.env, err)
+			}
+			*d.value = parsed
+		}
+	}
+	for _, n := range []struct {
+		env   string
+		value *int
+	}{
+		{"DATABASE_CONNECT_RETRIES", &opts.ConnectRetries},
+		{"DATABASE_MAX_CONNECTIONS", &opts.MaxConns},
+	} {
+		if v := os.Getenv(n.env); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil {
+				return opts, fmt.Errorf("parsing %s: %w", n.env, err)
+			}
+			*n.value = parsed
+		}
+	}
+	if opts.MaxConns != 0 && opts.MaxConns < masking.MinConns {
+		return opts, fmt.Errorf("DATABASE_MAX_CONNECTIONS must be at least %d, got %d", masking.MinConns, opts.MaxConns)
+	}
+	return opts, nil
+}
+
+// loadMaskingKey reads the key for deterministic masking from MASKING_KEY or
+// from the file named by MASKING_KEY_FILE. It returns nil if neither is set.
+func loadMaskingKey() ([]byte, error) {
+	if v := os.Getenv("MASKING_KEY"); v != "" {
+		return []byte(v), nil
+	}
+	if path := os.Getenv("MASKING_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, nil
+}
+
+// loadMaskingSpec reads the masking rules from MASKING_RULES (JSON), from the
+// file named by MASKING_RULES_FILE (JSON or YAML), or from the DataProfile
+// named by DATAPROFILE_NAME, in that order. The
+// default action is taken from the DataProfile, and MASKING_DEFAULT_ACTION
+// overrides it.
+func loadMaskingSpec(ctx context.Context) (vandalv1alpha1.MaskingSpec, error) {
+	spec, err := loadRules(ctx)
+	if err != nil {
+		return spec, err
+	}
+
+	if v := os.Getenv("MASKING_DEFAULT_ACTION"); v != "" {
+		spec.DefaultAction = v
+	}
+	switch spec.DefaultAction {
+	case "", vandalv1alpha1.MaskingDefaultActionPassthrough, vandalv1alpha1.MaskingDefaultActionAllowlist:
+	default:
+		return spec, fmt.Errorf("unknown default action %q, expected %q or %q", spec.DefaultAction,
+			vandalv1alpha1.MaskingDefaultActionPassthrough, vandalv1alpha1.MaskingDefaultActionAllowlist)
+	}
+	return spec, nil
+}
+
+// loadRules reads the masking configuration from the sources described by
+// loadMaskingSpec.
+func loadRules(ctx context.Context) (vandalv1alpha1.MaskingSpec, error) {
+	var spec vandalv1alpha1.MaskingSpec
+
+	if v := os.Getenv("MASKING_RULES"); v != "" {
+		if err := json.Unmarshal([]byte(v), &spec.Rules); err != nil {
+			return spec, fmt.Errorf("parsing MASKING_RULES: %w", err)
+		}
+		return spec, nil
+	}
+
+	if path := os.Getenv("MASKING_RULES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return spec, err
+		}
+		if err := yaml.Unmarshal(data, &spec.Rules); err != nil {
+			return spec, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return spec, nil
+	}
+
+	if dp, err := loadDataProfile(ctx); err != nil || dp != nil {
+		if err != nil {
+			return spec, err
+		}
+		return dp.Spec.Masking, nil
+	}
+
+	return spec, fmt.Errorf("no masking rules given, set MASKING_RULES, MASKING_RULES_FILE or DATAPROFILE_NAME")
+}
+
+// loadSelection reads the subset of rows to copy from SUBSET (JSON) and the
+// tables to copy from TABLES (JSON). Either falls back to the DataProfile named
+// by DATAPROFILE_NAME. Nil values select every row and every table.
+func loadSelection(ctx context.Context) (*vandalv1alpha1.SubsetSpec, *vandalv1alpha1.TableSelection, error) {
+	var subset *vandalv1alpha1.SubsetSpec
+	var tables *vandalv1alpha1.TableSelection
+	if v := os.Getenv("SUBSET"); v != "" {
+		if err := json.Unmarshal([]byte(v), &subset); err != nil {
+			return nil, nil, fmt.Errorf("parsing SUBSET: %w", err)
+		}
+	}
+	if v := os.Getenv("TABLES"); v != "" {
+		if err := json.Unmarshal([]byte(v), &tables); err != nil {
+			return nil, nil, fmt.Errorf("parsing TABLES: %w", err)
+		}
+	}
+	if subset != nil && tables != nil {
+		return subset, tables, nil
+	}
+
+	dp, err := loadDataProfile(ctx)
+	if err != nil || dp == nil {
+		return subset, tables, err
+	}
+	if subset == nil {
+		subset = dp.Spec.Subset
+	}
+	if tables == nil {
+		tables = dp.Spec.Tables
+	}
+	return subset, tables, nil
+}
+
+// loadDataProfile fetches the DataProfile named by DATAPROFILE_NAME in
+// DATAPROFILE_NAMESPACE. It returns nil if DATAPROFILE_NAME is not set.
+func loadDataProfile(ctx context.Context) (*vandalv1alpha1.DataProfile, error) {
+	name := os.Getenv("DATAPROFILE_NAME")
+	if name == "" {
+		return nil, nil
+	}
+	c, err := client.New()
+	if err != nil {
+		return nil, err
+	}
+	namespace := os.Getenv("DATAPROFILE_NAMESPACE")
+	if namespace == "" {
+		namespace = "default"
+	}
+	var dp vandalv1alpha1.DataProfile
+	if err := c.Get(ctx, ctrlclient.ObjectKey{Namespace: namespace, Name: name}, &dp); err != nil {
+		return nil, fmt.Errorf("fetching DataProfile %s/%s: %w", namespace, name, err)
+	}
+	return &dp, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Oridak771/Vandal/masking"
+	"github.com/Oridak771/Vandal/storage"
+)
+
+// partialSuffix is appended to OUTPUT_FILE while the dump is being written, so
+// that a dump that failed halfway is never restored.
+const partialSuffix = ".partial"
+
+// restoreFile restores the dump at path into the target database.
+func restoreFile(ctx context.Context, s *summary, target connConfig, path string) error {
+	if target.isZero() {
+		return &jobError{exitConfig, fmt.Errorf("no target database given, set TARGET_* or TARGET_SECRET_DIR")}
+	}
+	s.Source = path
+	s.Target = target.String()
+
+	opts, err := loadStorageOptions()
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	if opts.TLS, err = target.tls(); err != nil {
+		return &jobError{exitConfig, err}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	defer f.Close()
+
+	db, err := storage.NewDatabase(os.Getenv("DATABASE_ENGINE"), target.Host, target.Port, target.User, target.Password, target.DBName, opts)
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	defer db.Close()
+	if err := db.Connect(ctx); err != nil {
+		return &jobError{exitConnect, fmt.Errorf("connecting to %s: %w", s.Target, err)}
+	}
+
+	log.Printf("restoring %s into %s", s.Source, s.Target)
+	if err := db.Restore(ctx, f); err != nil {
+		return &jobError{exitRestore, fmt.Errorf("restoring %s: %w", path, err)}
+	}
+	return nil
+}
+
+// finishOutput closes the complete dump and moves it to path. If OUTPUT_KEEP
+// is set, only that many of the newest dumps of the directory of path are
+// kept.
+func finishOutput(sink *masking.FileSink, path string) error {
+	if err := sink.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+partialSuffix, path); err != nil {
+		return err
+	}
+
+	v := os.Getenv("OUTPUT_KEEP")
+	if v == "" {
+		return nil
+	}
+	keep, err := strconv.Atoi(v)
+	if err != nil || keep < 1 {
+		return &jobError{exitConfig, fmt.Errorf("OUTPUT_KEEP must be a positive number, got %q", v)}
+	}
+	return pruneDumps(filepath.Dir(path), filepath.Ext(path), keep)
+}
+
+// pruneDumps removes the oldest files with the given extension from dir,
+// keeping the newest keep, along with the partial dumps left by failed jobs.
+func pruneDumps(dir, ext string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var dumps []os.FileInfo
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasSuffix(name, ext) || strings.HasSuffix(name, ext+partialSuffix)) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(name, partialSuffix) {
+			log.Printf("removing partial dump %s", name)
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		dumps = append(dumps, info)
+	}
+
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].ModTime().After(dumps[j].ModTime()) })
+	for i := keep; i < len(dumps); i++ {
+		log.Printf("removing old dump %s", dumps[i].Name())
+		if err := os.Remove(filepath.Join(dir, dumps[i].Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Oridak771/Vandal/masking"
+)
+
+// writeDump writes a file of dir with the given age.
+func writeDump(t *testing.T, dir, name string, age time.Duration) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("SELECT 1;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-age)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// files returns the names of the files of dir, sorted.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFinishOutputPrunesDumps(t *testing.T) {
+	dir := t.TempDir()
+	writeDump(t, dir, "oldest.sql", 3*time.Hour)
+	writeDump(t, dir, "older.sql", 2*time.Hour)
+	writeDump(t, dir, "failed.sql"+partialSuffix, time.Hour)
+	writeDump(t, dir, "notes.txt", 4*time.Hour)
+
+	path := filepath.Join(dir, "newest.sql")
+	sink, err := masking.NewFileSink(path + partialSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Restore(context.Background(), strings.NewReader("SELECT 1;\n")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OUTPUT_KEEP", "2")
+	if err := finishOutput(sink, path); err != nil {
+		t.Fatalf("finishOutput() error = %v", err)
+	}
+
+	// The partial dump of a failed job is removed whatever its age, along
+	// with the dumps beyond the newest two. Other files are left.
+	want := []string{"newest.sql", "notes.txt", "older.sql"}
+	if got := files(t, dir); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("files = %q, want %q", got, want)
+	}
+}
+
+func TestFinishOutputRejectsInvalidKeep(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.sql")
+	sink, err := masking.NewFileSink(path + partialSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OUTPUT_KEEP", "0")
+	err = finishOutput(sink, path)
+	var jerr *jobError
+	if !errors.As(err, &jerr) || jerr.code != exitConfig {
+		t.Errorf("finishOutput() error = %v, want a configuration error", err)
+	}
+}
@@ -2,23 +2,212 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
 	"github.com/Oridak771/Vandal/masking"
+	"github.com/Oridak771/Vandal/storage"
 )
 
+// Exit codes of the masking job, reported back to the DataClone controller.
+const (
+	exitOK      = 0
+	exitFailed  = 1
+	exitConfig  = 2
+	exitConnect = 3
+	exitMasking = 4
+	exitPolicy  = 5
+	exitRestore = 6
+)
+
+// defaultTerminationLog is where Kubernetes picks up the termination message.
+const defaultTerminationLog = "/dev/termination-log"
+
+// summary is the JSON document printed when the job exits.
+type summary struct {
+	Status          string  `json:"status"`
+	ExitCode        int     `json:"exitCode"`
+	Error           string  `json:"error,omitempty"`
+	Source          string  `json:"source,omitempty"`
+	Target          string  `json:"target,omitempty"`
+	Rules           int     `json:"rules"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// jobError is an error with the exit code it should be reported with.
+type jobError struct {
+	code int
+	err  error
+}
+
+func (e *jobError) Error() string { return e.err.Error() }
+
+func (e *jobError) Unwrap() error { return e.err }
+
 func main() {
-	// This is a placeholder implementation.
-	// In a real implementation, you would get the database credentials
-	// and masking rules from the environment or a config file.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	start := time.Now()
+	s := &summary{Status: "succeeded", ExitCode: exitOK}
+	if err := run(ctx, s); err != nil {
+		s.Status = "failed"
+		s.ExitCode = exitFailed
+		var jerr *jobError
+		if errors.As(err, &jerr) {
+			s.ExitCode = jerr.code
+		}
+		s.Error = err.Error()
+		log.Printf("masking job failed: %v", err)
+	}
+	s.DurationSeconds = time.Since(start).Seconds()
+
+	writeSummary(s)
+	os.Exit(s.ExitCode)
+}
+
+// run loads the job configuration and runs the masking pipeline. Data is read
+// from the source database and written to the target database, or to
+// OUTPUT_FILE if set. The source defaults to the target, which masks the
+// target in place. Both databases run the engine named by DATABASE_ENGINE,
+// PostgreSQL by default. When INPUT_FILE is set, the job instead restores that
+// dump, masked when it was written, into the target.
+func run(ctx context.Context, s *summary) error {
+	target, err := loadConnConfig("TARGET")
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	if inputFile := os.Getenv("INPUT_FILE"); inputFile != "" {
+		return restoreFile(ctx, s, target, inputFile)
+	}
+	source, err := loadConnConfig("SOURCE")
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	if source.isZero() {
+		source = target
+	}
+	if source.isZero() {
+		return &jobError{exitConfig, fmt.Errorf("no source database given, set SOURCE_*, TARGET_* or their _SECRET_DIR")}
+	}
+	outputFile := os.Getenv("OUTPUT_FILE")
+	if target.isZero() && outputFile == "" {
+		return &jobError{exitConfig, fmt.Errorf("no target given, set TARGET_*, TARGET_SECRET_DIR or OUTPUT_FILE")}
+	}
+	s.Source = source.String()
 
-	dumper := masking.NewPostgresDumper("localhost", "5432", "user", "password", "mydb")
-	restorer := masking.NewPostgresRestorer("localhost", "5432", "user", "password", "maskeddb")
+	spec, err := loadMaskingSpec(ctx)
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	s.Rules = len(spec.Rules)
+
+	subset, tables, err := loadSelection(ctx)
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	if subset != nil && outputFile == "" && target == source {
+		return &jobError{exitConfig, fmt.Errorf("subsetting copies rows into a separate target, set SOURCE_* or OUTPUT_FILE")}
+	}
+
+	key, err := loadMaskingKey()
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
 	masker := masking.NewMasker()
+	if key != nil {
+		masker = masking.NewKeyedMasker(key)
+	}
+
+	opts, err := loadStorageOptions()
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	engine := os.Getenv("DATABASE_ENGINE")
+	sourceOpts := opts
+	if sourceOpts.TLS, err = source.tls(); err != nil {
+		return &jobError{exitConfig, err}
+	}
+	sourceDB, err := storage.NewDatabase(engine, source.Host, source.Port, source.User, source.Password, source.DBName, sourceOpts)
+	if err != nil {
+		return &jobError{exitConfig, err}
+	}
+	defer sourceDB.Close()
+	if err := sourceDB.Connect(ctx); err != nil {
+		return &jobError{exitConnect, fmt.Errorf("connecting to %s: %w", s.Source, err)}
+	}
+
+	var sink masking.Sink
+	var fileSink *masking.FileSink
+	if outputFile != "" {
+		fileSink, err = masking.NewFileSink(outputFile + partialSuffix)
+		if err != nil {
+			return &jobError{exitConfig, err}
+		}
+		defer fileSink.Close()
+		sink = fileSink
+		s.Target = outputFile
+	} else {
+		targetDB := sourceDB
+		if target != source {
+			targetOpts := opts
+			if targetOpts.TLS, err = target.tls(); err != nil {
+				return &jobError{exitConfig, err}
+			}
+			targetDB, err = storage.NewDatabase(engine, target.Host, target.Port, target.User, target.Password, target.DBName, targetOpts)
+			if err != nil {
+				return &jobError{exitConfig, err}
+			}
+			defer targetDB.Close()
+			if err := targetDB.Connect(ctx); err != nil {
+				return &jobError{exitConnect, fmt.Errorf("connecting to %s: %w", target, err)}
+			}
+		}
+		sink = targetDB
+		s.Target = target.String()
+	}
+
+	log.Printf("masking %s into %s with %d rules", s.Source, s.Target, len(spec.Rules))
+	pipeline := masking.NewPipeline(sourceDB, sink, masker, vandalv1alpha1.DataProfileSpec{
+		Masking: spec,
+		Subset:  subset,
+		Tables:  tables,
+	})
+	if err := pipeline.Run(ctx); err != nil {
+		var unclassified *masking.UnclassifiedColumnsError
+		if errors.As(err, &unclassified) {
+			return &jobError{exitPolicy, err}
+		}
+		return &jobError{exitMasking, err}
+	}
+	if fileSink != nil {
+		return finishOutput(fileSink, outputFile)
+	}
+	return nil
+}
 
-	pipeline := masking.NewPipeline(dumper, masker, restorer, nil)
+// writeSummary prints the summary to stdout and to the termination log, where
+// the controller can read it from the status of the job's pod.
+func writeSummary(s *summary) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("unable to encode summary: %v", err)
+		return
+	}
+	fmt.Println(string(data))
 
-	if err := pipeline.Run(context.Background()); err != nil {
-		log.Fatalf("failed to run masking pipeline: %v", err)
+	path := os.Getenv("TERMINATION_LOG")
+	if path == "" {
+		path = defaultTerminationLog
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Printf("unable to write termination log: %v", err)
 	}
 }
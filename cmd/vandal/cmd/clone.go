@@ -10,7 +10,7 @@ import (
 	"github.com/Oridak771/Vandal/pkg/client"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/util/yaml"
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func init() {
@@ -79,7 +79,7 @@ var getCloneCmd = &cobra.Command{
 
 		name := args[0]
 		var dc vandalv1alpha1.DataClone
-		if err := c.Get(context.Background(), client.ObjectKey{Name: name}, &dc); err != nil {
+		if err := c.Get(context.Background(), ctrlclient.ObjectKey{Name: name}, &dc); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -100,7 +100,7 @@ var listCloneCmd = &cobra.Command{
 		}
 
 		var dataClones vandalv1alpha1.DataCloneList
-		if err := c.List(context.Background(), &dataClones, &client.ListOptions{}); err != nil {
+		if err := c.List(context.Background(), &dataClones, &ctrlclient.ListOptions{}); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -124,7 +124,7 @@ var deleteCloneCmd = &cobra.Command{
 
 		name := args[0]
 		var dc vandalv1alpha1.DataClone
-		if err := c.Get(context.Background(), client.ObjectKey{Name: name}, &dc); err != nil {
+		if err := c.Get(context.Background(), ctrlclient.ObjectKey{Name: name}, &dc); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -151,7 +151,7 @@ var statusCloneCmd = &cobra.Command{
 
 		name := args[0]
 		var dc vandalv1alpha1.DataClone
-		if err := c.Get(context.Background(), client.ObjectKey{Name: name}, &dc); err != nil {
+		if err := c.Get(context.Background(), ctrlclient.ObjectKey{Name: name}, &dc); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -173,7 +173,7 @@ var connectionCloneCmd = &cobra.Command{
 
 		name := args[0]
 		var dc vandalv1alpha1.DataClone
-		if err := c.Get(context.Background(), client.ObjectKey{Name: name}, &dc); err != nil {
+		if err := c.Get(context.Background(), ctrlclient.ObjectKey{Name: name}, &dc); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
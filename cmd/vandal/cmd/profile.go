@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"text/tabwriter"
 
 	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/discovery"
 	"github.com/Oridak771/Vandal/pkg/client"
+	"github.com/Oridak771/Vandal/pkg/target"
+	"github.com/Oridak771/Vandal/schema"
+	"github.com/Oridak771/Vandal/storage"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/util/yaml"
-	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlclient "sigs.k8s.io/controller-runtime/pkg/client"
+	sigsyaml "sigs.k8s.io/yaml"
 )
 
 func init() {
@@ -20,9 +26,25 @@ func init() {
 	profileCmd.AddCommand(listProfileCmd)
 	profileCmd.AddCommand(deleteProfileCmd)
 	profileCmd.AddCommand(statusProfileCmd)
+	profileCmd.AddCommand(scanProfileCmd)
 	createProfileCmd.Flags().StringP("filename", "f", "", "Filename of the Profile to create")
+	scanProfileCmd.Flags().StringP("namespace", "n", "default", "Namespace of the Profile")
+	scanProfileCmd.Flags().StringP("output", "o", "table", "Output format, table or rules")
+	scanProfileCmd.Flags().Int("sample-size", discovery.DefaultSampleSize, "Number of rows to sample from every table")
+	scanProfileCmd.Flags().String("host", "", "Database host, overriding the Profile's credentials secret")
+	scanProfileCmd.Flags().String("port", "", "Database port, overriding the Profile's credentials secret")
+	scanProfileCmd.Flags().String("user", "", "Database user, overriding the Profile's credentials secret")
+	scanProfileCmd.Flags().String("dbname", "", "Database name, overriding the Profile's credentials secret")
+	scanProfileCmd.Flags().String("sslmode", "", "TLS mode: disable, require, verify-ca or verify-full, overriding the Profile's")
+	scanProfileCmd.Flags().String("sslrootcert", "", "File of the CA certificates the server certificate is verified with")
+	scanProfileCmd.Flags().String("sslcert", "", "File of the client certificate")
+	scanProfileCmd.Flags().String("sslkey", "", "File of the client key")
 }
 
+// passwordEnv is the environment variable overriding the database password of
+// the Profile's credentials secret.
+const passwordEnv = "VANDAL_DB_PASSWORD"
+
 var profileCmd = &cobra.Command{
 	Use:   "profile",
 	Short: "Manage Profiles",
@@ -78,7 +100,7 @@ var getProfileCmd = &cobra.Command{
 
 		name := args[0]
 		var dp vandalv1alpha1.DataProfile
-		if err := c.Get(context.Background(), client.ObjectKey{Name: name}, &dp); err != nil {
+		if err := c.Get(context.Background(), ctrlclient.ObjectKey{Name: name}, &dp); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -99,7 +121,7 @@ var listProfileCmd = &cobra.Command{
 		}
 
 		var dataProfiles vandalv1alpha1.DataProfileList
-		if err := c.List(context.Background(), &dataProfiles, &client.ListOptions{}); err != nil {
+		if err := c.List(context.Background(), &dataProfiles, &ctrlclient.ListOptions{}); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -123,7 +145,7 @@ var deleteProfileCmd = &cobra.Command{
 
 		name := args[0]
 		var dp vandalv1alpha1.DataProfile
-		if err := c.Get(context.Background(), client.ObjectKey{Name: name}, &dp); err != nil {
+		if err := c.Get(context.Background(), ctrlclient.ObjectKey{Name: name}, &dp); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -150,7 +172,7 @@ var statusProfileCmd = &cobra.Command{
 
 		name := args[0]
 		var dp vandalv1alpha1.DataProfile
-		if err := c.Get(context.Background(), client.ObjectKey{Name: name}, &dp); err != nil {
+		if err := c.Get(context.Background(), ctrlclient.ObjectKey{Name: name}, &dp); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -158,3 +180,166 @@ var statusProfileCmd = &cobra.Command{
 		fmt.Printf("Status: %s\n", dp.Status.Phase)
 	},
 }
+
+var scanProfileCmd = &cobra.Command{
+	Use:   "scan [name]",
+	Short: "Scan the database of a Profile for sensitive data",
+	Long: `Scan classifies the columns of the Profile's target database by their names
+and a sample of their values, and lists the ones that appear to hold
+sensitive data, such as emails, phone numbers or card numbers. With
+-o rules it prints suggested masking rules for the unmasked ones.
+
+The connection settings of the Profile's credentials secret can be
+overridden with flags, and the password with the VANDAL_DB_PASSWORD
+environment variable.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := client.New()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		namespace, _ := cmd.Flags().GetString("namespace")
+		output, _ := cmd.Flags().GetString("output")
+		sampleSize, _ := cmd.Flags().GetInt("sample-size")
+		if output != "table" && output != "rules" {
+			fmt.Printf("Unknown output format %q, use table or rules\n", output)
+			os.Exit(1)
+		}
+
+		var dp vandalv1alpha1.DataProfile
+		if err := c.Get(context.Background(), ctrlclient.ObjectKey{Namespace: namespace, Name: args[0]}, &dp); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// Connection settings come from the Profile's secrets, which may be
+		// unreachable from outside the cluster, so flags override them.
+		resolver := &target.Resolver{Reader: c}
+		conn, resolveErr := resolver.Connection(context.Background(), &dp)
+		if resolveErr != nil {
+			conn = &target.Connection{Engine: dp.Spec.Target.Engine}
+		}
+		for _, f := range []struct {
+			flag  string
+			value *string
+		}{
+			{"host", &conn.Host},
+			{"port", &conn.Port},
+			{"user", &conn.User},
+			{"dbname", &conn.DBName},
+		} {
+			if v, _ := cmd.Flags().GetString(f.flag); v != "" {
+				*f.value = v
+			}
+		}
+		// The password is not a flag, so that it stays out of the process
+		// list and the shell history.
+		if v := os.Getenv(passwordEnv); v != "" {
+			conn.Password = v
+		}
+		if err := conn.Validate(); err != nil {
+			if resolveErr != nil {
+				fmt.Println(resolveErr)
+			}
+			fmt.Println("Database host, user and dbname are required, from the Profile's credentials secret or flags")
+			os.Exit(1)
+		}
+		if err := applyTLSFlags(cmd, &dp, conn); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		db, err := conn.Database(storage.Options{})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		s, err := db.GetSchema(context.Background())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		sampler, ok := db.(storage.Sampler)
+		if !ok {
+			fmt.Printf("%s databases cannot be sampled\n", dp.Spec.Target.Engine)
+			os.Exit(1)
+		}
+		sample := func(table *schema.Table, limit int) (map[string][]string, error) {
+			return sampler.SampleValues(context.Background(), table, limit)
+		}
+		findings, err := discovery.Scan(s, sample, sampleSize, dp.Spec.Masking.Rules)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if output == "rules" {
+			var rules []vandalv1alpha1.MaskingRule
+			for _, f := range discovery.Unmasked(findings) {
+				rules = append(rules, f.Rule)
+			}
+			out, err := sigsyaml.Marshal(map[string]interface{}{"rules": rules})
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Print(string(out))
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TABLE\tCOLUMN\tCATEGORY\tMASKED\tSUGGESTED")
+		for _, f := range findings {
+			suggested := "-"
+			if !f.Masked {
+				suggested = f.Rule.Transformation
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", f.Table, f.Column, f.Category, f.Masked, suggested)
+		}
+		w.Flush()
+	},
+}
+
+// applyTLSFlags overrides the TLS settings of a connection with the flags of a
+// scan. Certificates are read from the files the flags name.
+func applyTLSFlags(cmd *cobra.Command, dp *vandalv1alpha1.DataProfile, conn *target.Connection) error {
+	if conn.TLS == nil && dp.Spec.Target.TLS != nil {
+		conn.TLS = &storage.TLS{Mode: dp.Spec.Target.TLS.Mode}
+		if conn.TLS.Mode == "" {
+			conn.TLS.Mode = storage.TLSModeVerifyFull
+		}
+	}
+	if mode, _ := cmd.Flags().GetString("sslmode"); mode != "" {
+		if conn.TLS == nil {
+			conn.TLS = &storage.TLS{}
+		}
+		conn.TLS.Mode = mode
+	}
+	if conn.TLS == nil || conn.TLS.Mode == storage.TLSModeDisable {
+		conn.TLS = nil
+		return nil
+	}
+
+	for _, f := range []struct {
+		flag string
+		data *[]byte
+	}{
+		{"sslrootcert", &conn.TLS.CA},
+		{"sslcert", &conn.TLS.Cert},
+		{"sslkey", &conn.TLS.Key},
+	} {
+		path, _ := cmd.Flags().GetString(f.flag)
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		*f.data = data
+	}
+	return nil
+}
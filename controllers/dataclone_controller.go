@@ -18,26 +18,46 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/pkg/target"
 )
 
 const dataCloneFinalizer = "vandal.db.io/finalizer"
 
+const (
+	// defaultMaskingImage is the image used for masking jobs if none is configured.
+	defaultMaskingImage = "vandal-masking-job:latest"
+	// conditionTypeMasked is the condition reporting the outcome of masking.
+	conditionTypeMasked = "Masked"
+	// maskingPollInterval is how often a clone is requeued while masking is in progress.
+	maskingPollInterval = 10 * time.Second
+)
+
 // DataCloneReconciler reconciles a DataClone object
 type DataCloneReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// MaskingImage is the image of the masking job run against new clones.
+	MaskingImage string
 }
 
 //+kubebuilder:rbac:groups=vandal.db.io,resources=dataclones,verbs=get;list;watch;create;update;patch;delete
@@ -47,6 +67,9 @@ type DataCloneReconciler struct {
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=vandal.db.io,resources=dataprofiles,verbs=get;list;watch
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -102,6 +125,11 @@ func (r *DataCloneReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 
 	log.Info("Reconciling DataClone", "Name", dataClone.Name)
 
+	// A failed clone stays failed until it is deleted.
+	if dataClone.Status.Phase == vandalv1alpha1.DataClonePhaseFailed {
+		return ctrl.Result{}, nil
+	}
+
 	// 1. Set the phase to CreatingPVC
 	if dataClone.Status.Phase == "" || dataClone.Status.Phase == vandalv1alpha1.DataClonePhasePending {
 		dataClone.Status.Phase = vandalv1alpha1.DataClonePhaseCreatingPVC
@@ -117,12 +145,40 @@ func (r *DataCloneReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, err
 	}
 
+	// Clones of profiles that take logical dumps start from an empty volume
+	// the dump is restored into.
+	dumpProfile, err := r.dumpProfile(ctx, &dataClone)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Clones of profiles with a subset, unless they take dumps or mask their
+	// snapshots, start from an empty volume the subset is copied into.
+	subsetProfile, err := r.subsetProfile(ctx, &dataClone)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// 3. Create PVC from snapshot
-	pvc, err := r.createPVCFromSnapshot(ctx, &dataClone)
+	var pvc *corev1.PersistentVolumeClaim
+	switch {
+	case dumpProfile != nil:
+		pvc, err = r.createEmptyPVC(ctx, &dataClone, dumpProfile.Spec.Dump.StorageClassName, dumpSize(dumpProfile.Spec.Dump))
+	case subsetProfile != nil:
+		pvc, err = r.createEmptyPVC(ctx, &dataClone, subsetProfile.Spec.Subset.StorageClassName, subsetSize(subsetProfile.Spec.Subset))
+	default:
+		pvc, err = r.createPVCFromSnapshot(ctx, &dataClone)
+	}
 	if err != nil {
-		log.Error(err, "unable to create PVC from snapshot", "DataClone", dataClone.Name)
+		log.Error(err, "unable to create PVC", "DataClone", dataClone.Name)
 		return ctrl.Result{}, err
 	}
+	if pvc == nil {
+		if dataClone.Status.Phase == vandalv1alpha1.DataClonePhaseFailed {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{RequeueAfter: snapshotPollInterval}, nil
+	}
 
 	// 4. Set the phase to PodInitializing
 	if dataClone.Status.Phase == vandalv1alpha1.DataClonePhaseCreatingPVC {
@@ -133,52 +189,90 @@ func (r *DataCloneReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		}
 	}
 
-	// 5. Create the database pod
-	pod, err := r.createDatabasePod(ctx, &dataClone, pvc)
+	// 5. Create the database pod, running the engine of the source profile
+	engine := r.sourceEngine(ctx, &dataClone)
+	dbname, err := r.cloneDBName(ctx, &dataClone, engine)
+	if err != nil {
+		return ctrl.Result{}, r.setMaskingFailed(ctx, &dataClone, "DatabaseUnknown",
+			fmt.Sprintf("Clones of MySQL databases use the database of the target of their profile: %v", err))
+	}
+	pod, err := r.createDatabasePod(ctx, &dataClone, pvc, engine, dumpProfile != nil || subsetProfile != nil)
 	if err != nil {
 		log.Error(err, "unable to create database pod", "DataClone", dataClone.Name)
 		return ctrl.Result{}, err
 	}
 
 	// 6. Create the connection secret
-	secret, err := r.createConnectionSecret(ctx, &dataClone)
+	secret, err := r.createConnectionSecret(ctx, &dataClone, engine, dbname)
 	if err != nil {
 		log.Error(err, "unable to create connection secret", "DataClone", dataClone.Name)
 		return ctrl.Result{}, err
 	}
 
 	// 4. Create the service
-	service, err := r.createService(ctx, &dataClone)
+	service, err := r.createService(ctx, &dataClone, engine)
 	if err != nil {
 		log.Error(err, "unable to create service", "DataClone", dataClone.Name)
 		return ctrl.Result{}, err
 	}
 
-	// 8. Set the phase to Masking
+	// 8. Set the phase to Masking, or to Restoring for clones of dumps, which
+	// were masked when they were taken
 	if dataClone.Status.Phase == vandalv1alpha1.DataClonePhasePodInitializing {
 		dataClone.Status.Phase = vandalv1alpha1.DataClonePhaseMasking
+		if dumpProfile != nil {
+			dataClone.Status.Phase = vandalv1alpha1.DataClonePhaseRestoring
+		}
 		if err := r.Status().Update(ctx, &dataClone); err != nil {
 			log.Error(err, "unable to update DataClone status")
 			return ctrl.Result{}, err
 		}
 	}
 
-	// TODO: Implement masking logic here
+	// Restore the dump into the clone
+	if dataClone.Status.Phase == vandalv1alpha1.DataClonePhaseRestoring {
+		done, err := r.reconcileRestore(ctx, &dataClone, pod, dumpProfile)
+		if err != nil {
+			log.Error(err, "unable to restore DataClone", "DataClone", dataClone.Name)
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: maskingPollInterval}, nil
+		}
+		if dataClone.Status.Phase == vandalv1alpha1.DataClonePhaseFailed {
+			return ctrl.Result{}, nil
+		}
+	}
 
-	// 9. Update status
+	// 9. Run the masking job against the clone
+	if dataClone.Status.Phase == vandalv1alpha1.DataClonePhaseMasking {
+		done, err := r.reconcileMasking(ctx, &dataClone, pod)
+		if err != nil {
+			log.Error(err, "unable to mask DataClone", "DataClone", dataClone.Name)
+			return ctrl.Result{}, err
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: maskingPollInterval}, nil
+		}
+		if dataClone.Status.Phase == vandalv1alpha1.DataClonePhaseFailed {
+			return ctrl.Result{}, nil
+		}
+	}
+
+	// 10. Update status
 	dataClone.Status.Phase = vandalv1alpha1.DataClonePhaseReady
 	dataClone.Status.DatabaseConnection = &vandalv1alpha1.DatabaseConnection{
 		Host:     service.Name,
 		Port:     service.Spec.Ports[0].Port,
-		User:     "user",     // TODO
-		Password: "password", // TODO
+		User:     secret.StringData["user"],
+		Password: secret.StringData["password"],
 	}
 	if err := r.Status().Update(ctx, &dataClone); err != nil {
 		log.Error(err, "unable to update DataClone status", "DataClone", dataClone.Name)
 		return ctrl.Result{}, err
 	}
 
-	// 10. Handle TTL
+	// 11. Handle TTL
 	if dataClone.Spec.TTL != nil {
 		ttl := dataClone.Spec.TTL.Duration
 		if ttl > 0 {
@@ -189,9 +283,51 @@ func (r *DataCloneReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	return ctrl.Result{}, nil
 }
 
+// createPVCFromSnapshot creates the volume of a clone from a snapshot. Clones
+// of profiles that mask their snapshots are only restored from masked
+// snapshots, the latest one by default; it returns nil while the profile has
+// none, and fails the clone if it names one that is not masked.
 func (r *DataCloneReconciler) createPVCFromSnapshot(ctx context.Context, dataClone *vandalv1alpha1.DataClone) (*corev1.PersistentVolumeClaim, error) {
 	log := log.FromContext(ctx)
 
+	existing := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Name}, existing)
+	if err == nil {
+		return existing, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	var dataProfile vandalv1alpha1.DataProfile
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Spec.SourceProfile}, &dataProfile); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, r.setMaskingFailed(ctx, dataClone, "ProfileNotFound",
+				fmt.Sprintf("DataProfile %s not found", dataClone.Spec.SourceProfile))
+		}
+		return nil, err
+	}
+
+	snapshotName := dataClone.Spec.SnapshotName
+	if dataProfile.Spec.MaskedSnapshot != nil {
+		if snapshotName == "" {
+			snapshotName = dataProfile.Status.LatestMaskedSnapshot
+		}
+		if snapshotName == "" {
+			log.Info("Waiting for a masked snapshot of DataProfile", "DataProfile", dataProfile.Name)
+			return nil, nil
+		}
+		var snapshot snapshotv1.VolumeSnapshot
+		err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: snapshotName}, &snapshot)
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		if err != nil || !snapshotMaskedFor(&snapshot, dataProfile.Name) {
+			return nil, r.setMaskingFailed(ctx, dataClone, "SnapshotNotMasked",
+				fmt.Sprintf("DataProfile %s masks its snapshots, and VolumeSnapshot %s is not one of its masked snapshots", dataProfile.Name, snapshotName))
+		}
+	}
+
 	// Define the PVC
 	pvc := &corev1.PersistentVolumeClaim{
 		ObjectMeta: metav1.ObjectMeta{
@@ -208,26 +344,136 @@ func (r *DataCloneReconciler) createPVCFromSnapshot(ctx context.Context, dataClo
 			DataSource: &corev1.TypedLocalObjectReference{
 				APIGroup: &[]string{"snapshot.storage.k8s.io"}[0],
 				Kind:     "VolumeSnapshot",
-				Name:     dataClone.Spec.SnapshotName,
+				Name:     snapshotName,
 			},
 			// TODO: Make storage class and resources configurable
 		},
 	}
 
 	// Create the PVC
-	if err := r.Create(ctx, pvc); err != nil {
+	if err := r.Create(ctx, pvc); err != nil && !apierrors.IsAlreadyExists(err) {
 		log.Error(err, "unable to create PVC")
 		return nil, err
 	}
 
-	log.Info("Created PVC from snapshot", "PVC", pvc.Name, "Snapshot", dataClone.Spec.SnapshotName)
+	log.Info("Created PVC from snapshot", "PVC", pvc.Name, "Snapshot", snapshotName)
 	return pvc, nil
 }
 
-func (r *DataCloneReconciler) createDatabasePod(ctx context.Context, dataClone *vandalv1alpha1.DataClone, pvc *corev1.PersistentVolumeClaim) (*corev1.Pod, error) {
+// databaseEngine describes how a clone pod runs a database engine.
+type databaseEngine struct {
+	// image is the default image of the clone.
+	image string
+	// container is the name of the database container.
+	container string
+	// dataDir is where the data directory of the engine is mounted.
+	dataDir string
+	// user and dbname are the defaults of the connection secret. Engines
+	// without a database of their own, such as MySQL, whose "mysql" database
+	// holds the system tables, have no default dbname.
+	user, dbname string
+	port         int32
+	// initVars are the variables the image initializes an empty database
+	// with, set from keys of the connection secret.
+	initVars []secretVar
+}
+
+// secretVar is an environment variable set from a key of a secret.
+type secretVar struct {
+	name, key string
+}
+
+// initEnv returns the environment initializing a database with the settings
+// of the connection secret of a clone.
+func (e databaseEngine) initEnv(secretName string) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, v := range e.initVars {
+		env = append(env, corev1.EnvVar{
+			Name: v.name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+					Key:                  v.key,
+				},
+			},
+		})
+	}
+	return env
+}
+
+// databaseEngines are the engines clones can run, by DataProfile engine name.
+var databaseEngines = map[string]databaseEngine{
+	vandalv1alpha1.DatabaseEnginePostgres: {
+		image:     "postgres:13",
+		container: "postgres",
+		dataDir:   "/var/lib/postgresql/data",
+		user:      "postgres",
+		dbname:    "postgres",
+		port:      5432,
+		initVars: []secretVar{
+			{"POSTGRES_USER", "user"},
+			{"POSTGRES_PASSWORD", "password"},
+			{"POSTGRES_DB", "dbname"},
+		},
+	},
+	vandalv1alpha1.DatabaseEngineMySQL: {
+		image:     "mysql:8.0",
+		container: "mysql",
+		dataDir:   "/var/lib/mysql",
+		user:      "root",
+		port:      3306,
+		// The image refuses to create root as MYSQL_USER, so only the
+		// default user is set up from the connection secret.
+		initVars: []secretVar{
+			{"MYSQL_ROOT_PASSWORD", "password"},
+			{"MYSQL_DATABASE", "dbname"},
+		},
+	},
+}
+
+// sourceEngine returns the engine of the source profile of a clone. PostgreSQL
+// is assumed if the profile cannot be read; masking then reports why.
+func (r *DataCloneReconciler) sourceEngine(ctx context.Context, dataClone *vandalv1alpha1.DataClone) databaseEngine {
+	var dataProfile vandalv1alpha1.DataProfile
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Spec.SourceProfile}, &dataProfile); err == nil {
+		if engine, ok := databaseEngines[dataProfile.Spec.Target.Engine]; ok {
+			return engine
+		}
+	}
+	return databaseEngines[vandalv1alpha1.DatabaseEnginePostgres]
+}
+
+// cloneDBName returns the database of a clone: the one its spec names, the
+// default of its engine or, for engines without one, the database of the
+// target of its profile.
+func (r *DataCloneReconciler) cloneDBName(ctx context.Context, dataClone *vandalv1alpha1.DataClone, engine databaseEngine) (string, error) {
+	if dataClone.Spec.Database != nil && dataClone.Spec.Database.DBName != "" {
+		return dataClone.Spec.Database.DBName, nil
+	}
+	if engine.dbname != "" {
+		return engine.dbname, nil
+	}
+	var dataProfile vandalv1alpha1.DataProfile
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Spec.SourceProfile}, &dataProfile); err != nil {
+		return "", err
+	}
+	resolver := &target.Resolver{Reader: r.Client}
+	conn, err := resolver.Connection(ctx, &dataProfile)
+	if err != nil {
+		return "", err
+	}
+	return conn.DBName, nil
+}
+
+// createDatabasePod creates the pod running the database of a clone. The
+// engine initializes its database from the connection secret of the clone
+// when the volume is empty, as when a dump is to be restored into it; the
+// data directory is then a subdirectory of the volume, which may hold files
+// of its own such as lost+found.
+func (r *DataCloneReconciler) createDatabasePod(ctx context.Context, dataClone *vandalv1alpha1.DataClone, pvc *corev1.PersistentVolumeClaim, engine databaseEngine, empty bool) (*corev1.Pod, error) {
 	log := log.FromContext(ctx)
 
-	image := "postgres:13"
+	image := engine.image
 	if dataClone.Spec.Database != nil && dataClone.Spec.Database.Image != "" {
 		image = dataClone.Spec.Database.Image
 	}
@@ -238,6 +484,7 @@ func (r *DataCloneReconciler) createDatabasePod(ctx context.Context, dataClone *
 			Name:      dataClone.Name,
 			Namespace: dataClone.Namespace,
 			Labels: map[string]string{
+				"app":                          dataClone.Name,
 				"app.kubernetes.io/name":       "vandal",
 				"app.kubernetes.io/instance":   dataClone.Name,
 				"app.kubernetes.io/created-by": "dataclone-controller",
@@ -246,15 +493,20 @@ func (r *DataCloneReconciler) createDatabasePod(ctx context.Context, dataClone *
 		Spec: corev1.PodSpec{
 			Containers: []corev1.Container{
 				{
-					Name:  "postgres",
+					Name:  engine.container,
 					Image: image,
+					Ports: []corev1.ContainerPort{
+						{
+							ContainerPort: engine.port,
+						},
+					},
 					VolumeMounts: []corev1.VolumeMount{
 						{
 							Name:      "data",
-							MountPath: "/var/lib/postgresql/data",
+							MountPath: engine.dataDir,
 						},
 					},
-					// TODO: Add env vars for password, etc.
+					Env: engine.initEnv(dataClone.Name),
 				},
 			},
 			Volumes: []corev1.Volume{
@@ -270,8 +522,12 @@ func (r *DataCloneReconciler) createDatabasePod(ctx context.Context, dataClone *
 		},
 	}
 
+	if empty {
+		pod.Spec.Containers[0].VolumeMounts[0].SubPath = "data"
+	}
+
 	// Create the Pod
-	if err := r.Create(ctx, pod); err != nil {
+	if err := r.Create(ctx, pod); err != nil && !apierrors.IsAlreadyExists(err) {
 		log.Error(err, "unable to create pod")
 		return nil, err
 	}
@@ -280,20 +536,16 @@ func (r *DataCloneReconciler) createDatabasePod(ctx context.Context, dataClone *
 	return pod, nil
 }
 
-func (r *DataCloneReconciler) createConnectionSecret(ctx context.Context, dataClone *vandalv1alpha1.DataClone) (*corev1.Secret, error) {
+func (r *DataCloneReconciler) createConnectionSecret(ctx context.Context, dataClone *vandalv1alpha1.DataClone, engine databaseEngine, dbname string) (*corev1.Secret, error) {
 	log := log.FromContext(ctx)
 
-	user := "postgres"
+	user := engine.user
 	password := "password" // TODO: Generate random password
-	dbname := "postgres"
 
 	if dataClone.Spec.Database != nil {
 		if dataClone.Spec.Database.User != "" {
 			user = dataClone.Spec.Database.User
 		}
-		if dataClone.Spec.Database.DBName != "" {
-			dbname = dataClone.Spec.Database.DBName
-		}
 		if dataClone.Spec.Database.PasswordSecretRef != nil {
 			secret := &corev1.Secret{}
 			err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Spec.Database.PasswordSecretRef.Name}, secret)
@@ -317,7 +569,7 @@ func (r *DataCloneReconciler) createConnectionSecret(ctx context.Context, dataCl
 		},
 		StringData: map[string]string{
 			"host":     dataClone.Name,
-			"port":     "5432",
+			"port":     strconv.Itoa(int(engine.port)),
 			"user":     user,
 			"password": password,
 			"dbname":   dbname,
@@ -325,7 +577,7 @@ func (r *DataCloneReconciler) createConnectionSecret(ctx context.Context, dataCl
 	}
 
 	// Create the Secret
-	if err := r.Create(ctx, secret); err != nil {
+	if err := r.Create(ctx, secret); err != nil && !apierrors.IsAlreadyExists(err) {
 		log.Error(err, "unable to create secret")
 		return nil, err
 	}
@@ -334,7 +586,7 @@ func (r *DataCloneReconciler) createConnectionSecret(ctx context.Context, dataCl
 	return secret, nil
 }
 
-func (r *DataCloneReconciler) createService(ctx context.Context, dataClone *vandalv1alpha1.DataClone) (*corev1.Service, error) {
+func (r *DataCloneReconciler) createService(ctx context.Context, dataClone *vandalv1alpha1.DataClone, engine databaseEngine) (*corev1.Service, error) {
 	log := log.FromContext(ctx)
 
 	// Define the Service
@@ -354,14 +606,14 @@ func (r *DataCloneReconciler) createService(ctx context.Context, dataClone *vand
 			},
 			Ports: []corev1.ServicePort{
 				{
-					Port: 5432,
+					Port: engine.port,
 				},
 			},
 		},
 	}
 
 	// Create the Service
-	if err := r.Create(ctx, service); err != nil {
+	if err := r.Create(ctx, service); err != nil && !apierrors.IsAlreadyExists(err) {
 		log.Error(err, "unable to create service")
 		return nil, err
 	}
@@ -373,9 +625,11 @@ func (r *DataCloneReconciler) createService(ctx context.Context, dataClone *vand
 func (r *DataCloneReconciler) cleanupResources(ctx context.Context, dataClone *vandalv1alpha1.DataClone) error {
 	log := log.FromContext(ctx)
 
-	// Delete the rolebinding, pod, pvc, secret, and service
+	// Delete the rolebinding, restore and masking jobs, pod, pvc, secret, and service
 	resources := []client.Object{
 		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "dataclone-editor-rolebinding", Namespace: dataClone.Namespace}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: restoreJobName(dataClone), Namespace: dataClone.Namespace}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: maskingJobName(dataClone), Namespace: dataClone.Namespace}},
 		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: dataClone.Name, Namespace: dataClone.Namespace}},
 		&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: dataClone.Name, Namespace: dataClone.Namespace}},
 		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: dataClone.Name, Namespace: dataClone.Namespace}},
@@ -383,7 +637,7 @@ func (r *DataCloneReconciler) cleanupResources(ctx context.Context, dataClone *v
 	}
 
 	for _, resource := range resources {
-		if err := r.Delete(ctx, resource); err != nil && !client.IgnoreNotFound(err) {
+		if err := r.Delete(ctx, resource, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
 			log.Error(err, "unable to delete resource", "resource", resource.GetName())
 			return err
 		}
@@ -393,6 +647,290 @@ func (r *DataCloneReconciler) cleanupResources(ctx context.Context, dataClone *v
 	return nil
 }
 
+// reconcileMasking runs the masking job for a clone whose database is up. It
+// reports whether masking has finished; on failure the clone is moved to the
+// Failed phase.
+func (r *DataCloneReconciler) reconcileMasking(ctx context.Context, dataClone *vandalv1alpha1.DataClone, pod *corev1.Pod) (bool, error) {
+	log := log.FromContext(ctx)
+
+	// The masking job needs a running database to connect to.
+	if err := r.Get(ctx, client.ObjectKeyFromObject(pod), pod); err != nil {
+		return false, err
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		log.Info("Waiting for database pod", "Pod", pod.Name, "Phase", pod.Status.Phase)
+		return false, nil
+	}
+
+	var dataProfile vandalv1alpha1.DataProfile
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Spec.SourceProfile}, &dataProfile); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, r.setMaskingFailed(ctx, dataClone, "ProfileNotFound",
+				fmt.Sprintf("DataProfile %s not found", dataClone.Spec.SourceProfile))
+		}
+		return false, err
+	}
+
+	// Masked snapshots are not masked again.
+	if snapshot, masked := r.maskedSnapshot(ctx, dataClone); masked {
+		meta.SetStatusCondition(&dataClone.Status.Conditions, metav1.Condition{
+			Type:    conditionTypeMasked,
+			Status:  metav1.ConditionTrue,
+			Reason:  "MaskedSnapshot",
+			Message: fmt.Sprintf("VolumeSnapshot %s was masked when it was taken", snapshot),
+		})
+		return true, nil
+	}
+
+	// Without rules or a table selection the masking job has nothing to do,
+	// unless the allowlist requires every column to be reviewed or the job
+	// copies a subset into the clone.
+	if len(dataProfile.Spec.Masking.Rules) == 0 && dataProfile.Spec.Tables == nil && !copiesSubset(&dataProfile) &&
+		dataProfile.Spec.Masking.DefaultAction != vandalv1alpha1.MaskingDefaultActionAllowlist {
+		meta.SetStatusCondition(&dataClone.Status.Conditions, metav1.Condition{
+			Type:    conditionTypeMasked,
+			Status:  metav1.ConditionTrue,
+			Reason:  "NoRules",
+			Message: fmt.Sprintf("DataProfile %s has no masking rules", dataProfile.Name),
+		})
+		return true, nil
+	}
+
+	job, err := r.createMaskingJob(ctx, dataClone, &dataProfile)
+	if err != nil {
+		return false, err
+	}
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			log.Info("Masking job succeeded", "Job", job.Name)
+			meta.SetStatusCondition(&dataClone.Status.Conditions, metav1.Condition{
+				Type:    conditionTypeMasked,
+				Status:  metav1.ConditionTrue,
+				Reason:  "MaskingSucceeded",
+				Message: fmt.Sprintf("Masking job %s succeeded", job.Name),
+			})
+			return true, nil
+		case batchv1.JobFailed:
+			message := fmt.Sprintf("Masking job %s failed: %s", job.Name, condition.Message)
+			if summary := r.maskingJobSummary(ctx, job); summary != "" {
+				message += ": " + summary
+			}
+			return true, r.setMaskingFailed(ctx, dataClone, "MaskingJobFailed", message)
+		}
+	}
+
+	log.Info("Waiting for masking job", "Job", job.Name)
+	return false, nil
+}
+
+// maskedSnapshot reports whether the volume of a clone was restored from a
+// snapshot its profile masked, and returns the name of the snapshot.
+func (r *DataCloneReconciler) maskedSnapshot(ctx context.Context, dataClone *vandalv1alpha1.DataClone) (string, bool) {
+	var pvc corev1.PersistentVolumeClaim
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Name}, &pvc); err != nil {
+		return "", false
+	}
+	source := pvc.Spec.DataSource
+	if source == nil || source.Kind != "VolumeSnapshot" {
+		return "", false
+	}
+	var snapshot snapshotv1.VolumeSnapshot
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: source.Name}, &snapshot); err != nil {
+		return "", false
+	}
+	return snapshot.Name, snapshotMaskedFor(&snapshot, dataClone.Spec.SourceProfile)
+}
+
+// snapshotMaskedFor reports whether a VolumeSnapshot is a masked snapshot of
+// the named profile.
+func snapshotMaskedFor(snapshot *snapshotv1.VolumeSnapshot, profile string) bool {
+	return snapshot.Labels[labelSnapshotMasked] == "true" && snapshot.Labels[labelSnapshotProfile] == profile
+}
+
+// maskingJobSummary returns the summary the masking job wrote to its
+// termination log, or an empty string if none of its pods has one.
+func (r *DataCloneReconciler) maskingJobSummary(ctx context.Context, job *batchv1.Job) string {
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list masking job pods", "Job", job.Name)
+		return ""
+	}
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated != nil && status.State.Terminated.Message != "" {
+				return status.State.Terminated.Message
+			}
+		}
+	}
+	return ""
+}
+
+// setMaskingFailed moves a clone to the Failed phase with a Masked condition
+// explaining why.
+func (r *DataCloneReconciler) setMaskingFailed(ctx context.Context, dataClone *vandalv1alpha1.DataClone, reason, message string) error {
+	dataClone.Status.Phase = vandalv1alpha1.DataClonePhaseFailed
+	meta.SetStatusCondition(&dataClone.Status.Conditions, metav1.Condition{
+		Type:    conditionTypeMasked,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	})
+	return r.Status().Update(ctx, dataClone)
+}
+
+// maskingJobName returns the name of the masking job of a clone.
+func maskingJobName(dataClone *vandalv1alpha1.DataClone) string {
+	return dataClone.Name + "-masking"
+}
+
+// createMaskingJob returns the masking job of a clone, creating it if it does
+// not exist yet. The job connects to the clone with the credentials of its
+// connection secret and applies the masking rules of the profile. If the
+// profile has a subset, the job copies it from the target of the profile into
+// the clone instead of masking the clone in place.
+func (r *DataCloneReconciler) createMaskingJob(ctx context.Context, dataClone *vandalv1alpha1.DataClone, dataProfile *vandalv1alpha1.DataProfile) (*batchv1.Job, error) {
+	log := log.FromContext(ctx)
+
+	job := &batchv1.Job{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: maskingJobName(dataClone)}, job)
+	if err == nil {
+		return job, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	env, err := maskingEnv(dataProfile)
+	if err != nil {
+		return nil, err
+	}
+	env = append(cloneTargetEnv(dataClone), env...)
+	var mounts []corev1.VolumeMount
+	var volumes []corev1.Volume
+	if copiesSubset(dataProfile) {
+		subsetVars, subsetMounts, subsetVolumes, err := subsetJobEnv(dataProfile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, subsetVars...)
+		mounts, volumes = subsetMounts, subsetVolumes
+	}
+
+	backoffLimit := int32(2)
+
+	// Define the Job
+	job = &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      maskingJobName(dataClone),
+			Namespace: dataClone.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "vandal",
+				"app.kubernetes.io/instance":   dataClone.Name,
+				"app.kubernetes.io/created-by": "dataclone-controller",
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "masking",
+							Image:        jobImage(r.MaskingImage),
+							Env:          env,
+							VolumeMounts: mounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+	if err := controllerutil.SetControllerReference(dataClone, job, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	// Create the Job
+	if err := r.Create(ctx, job); err != nil {
+		log.Error(err, "unable to create masking job")
+		return nil, err
+	}
+
+	log.Info("Created masking job", "Job", job.Name, "Profile", dataProfile.Name)
+	return job, nil
+}
+
+// jobImage returns the image of the masking jobs, defaultMaskingImage unless
+// image is set.
+func jobImage(image string) string {
+	if image == "" {
+		return defaultMaskingImage
+	}
+	return image
+}
+
+// cloneTargetEnv returns the environment pointing the masking job at the
+// database of a clone, read from its connection secret.
+func cloneTargetEnv(dataClone *vandalv1alpha1.DataClone) []corev1.EnvVar {
+	secretEnv := func(name, key string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: dataClone.Name},
+					Key:                  key,
+				},
+			},
+		}
+	}
+	return []corev1.EnvVar{
+		secretEnv("TARGET_HOST", "host"),
+		secretEnv("TARGET_PORT", "port"),
+		secretEnv("TARGET_USER", "user"),
+		secretEnv("TARGET_PASSWORD", "password"),
+		secretEnv("TARGET_DBNAME", "dbname"),
+	}
+}
+
+// maskingEnv returns the environment configuring the masking job with the
+// engine, masking rules and table selection of a profile.
+func maskingEnv(dataProfile *vandalv1alpha1.DataProfile) ([]corev1.EnvVar, error) {
+	rules, err := json.Marshal(dataProfile.Spec.Masking.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	env := []corev1.EnvVar{
+		{Name: "MASKING_RULES", Value: string(rules)},
+	}
+	if engine := dataProfile.Spec.Target.Engine; engine != "" {
+		env = append(env, corev1.EnvVar{Name: "DATABASE_ENGINE", Value: engine})
+	}
+	if action := dataProfile.Spec.Masking.DefaultAction; action != "" {
+		env = append(env, corev1.EnvVar{Name: "MASKING_DEFAULT_ACTION", Value: action})
+	}
+	if tables := dataProfile.Spec.Tables; tables != nil {
+		selection, err := json.Marshal(tables)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, corev1.EnvVar{Name: "TABLES", Value: string(selection)})
+	}
+	if keyRef := dataProfile.Spec.Masking.KeySecretRef; keyRef != nil {
+		env = append(env, corev1.EnvVar{
+			Name:      "MASKING_KEY",
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: keyRef},
+		})
+	}
+	return env, nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *DataCloneReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
@@ -402,6 +940,7 @@ func (r *DataCloneReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Owns(&corev1.Secret{}).
 		Owns(&corev1.Service{}).
 		Owns(&rbacv1.RoleBinding{}).
+		Owns(&batchv1.Job{}).
 		Complete(r)
 }
 
@@ -429,7 +968,7 @@ func (r *DataCloneReconciler) createRoleBinding(ctx context.Context, dataClone *
 	}
 
 	// Create the RoleBinding
-	if err := r.Create(ctx, roleBinding); err != nil {
+	if err := r.Create(ctx, roleBinding); err != nil && !apierrors.IsAlreadyExists(err) {
 		log.Error(err, "unable to create RoleBinding")
 		return err
 	}
@@ -2,11 +2,16 @@ package controllers
 
 import (
 	"context"
-	"testing"
+	"encoding/json"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
 )
@@ -28,4 +33,125 @@ var _ = Describe("DataClone controller", func() {
 			Expect(k8sClient.Create(ctx, dataClone)).Should(Succeed())
 		})
 	})
+
+	Context("When cloning a DataProfile with a subset", func() {
+		It("Should copy the subset from the target into an empty volume", func() {
+			ctx := context.Background()
+			subset := &vandalv1alpha1.SubsetSpec{
+				Tables: []vandalv1alpha1.TableSubset{
+					{Table: "customers", Where: "country = 'DE'", Percent: 10},
+				},
+				FollowReferencing: true,
+			}
+			dataProfile := &vandalv1alpha1.DataProfile{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "subset-dataprofile",
+					Namespace: "default",
+				},
+				Spec: vandalv1alpha1.DataProfileSpec{
+					Target: vandalv1alpha1.DatabaseTarget{SecretName: "production-db"},
+					Subset: subset,
+				},
+			}
+			Expect(k8sClient.Create(ctx, dataProfile)).Should(Succeed())
+			dataClone := &vandalv1alpha1.DataClone{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "subset-dataclone",
+					Namespace: "default",
+				},
+				Spec: vandalv1alpha1.DataCloneSpec{
+					SourceProfile: dataProfile.Name,
+				},
+			}
+			Expect(k8sClient.Create(ctx, dataClone)).Should(Succeed())
+
+			r := &DataCloneReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			key := client.ObjectKeyFromObject(dataClone)
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Creating an empty volume")
+			var pvc corev1.PersistentVolumeClaim
+			Expect(k8sClient.Get(ctx, key, &pvc)).Should(Succeed())
+			Expect(pvc.Spec.DataSource).To(BeNil())
+
+			By("Copying the subset once the database runs")
+			var pod corev1.Pod
+			Expect(k8sClient.Get(ctx, key, &pod)).Should(Succeed())
+			pod.Status.Phase = corev1.PodRunning
+			Expect(k8sClient.Status().Update(ctx, &pod)).Should(Succeed())
+			_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			var job batchv1.Job
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: key.Namespace, Name: maskingJobName(dataClone)}, &job)).Should(Succeed())
+			env := make(map[string]corev1.EnvVar)
+			for _, v := range job.Spec.Template.Spec.Containers[0].Env {
+				env[v.Name] = v
+			}
+			Expect(env).To(HaveKey("TARGET_HOST"))
+			Expect(env).To(HaveKey("SOURCE_SECRET_DIR"))
+			Expect(env).To(HaveKey("SUBSET"))
+			var copied vandalv1alpha1.SubsetSpec
+			Expect(json.Unmarshal([]byte(env["SUBSET"].Value), &copied)).To(Succeed())
+			Expect(copied).To(Equal(*subset))
+			Expect(job.Spec.Template.Spec.Volumes).To(ContainElement(HaveField("VolumeSource.Secret.SecretName", "production-db")))
+		})
+	})
+
+	Context("When cloning a MySQL DataProfile", func() {
+		It("Should use the database of the target", func() {
+			ctx := context.Background()
+			Expect(k8sClient.Create(ctx, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "mysql-db", Namespace: "default"},
+				StringData: map[string]string{"host": "mysql", "user": "app", "password": "secret", "dbname": "shop"},
+			})).Should(Succeed())
+			dataProfile := &vandalv1alpha1.DataProfile{
+				ObjectMeta: metav1.ObjectMeta{Name: "mysql-dataprofile", Namespace: "default"},
+				Spec: vandalv1alpha1.DataProfileSpec{
+					Target: vandalv1alpha1.DatabaseTarget{SecretName: "mysql-db", PVCName: "mysql-data", Engine: vandalv1alpha1.DatabaseEngineMySQL},
+				},
+			}
+			Expect(k8sClient.Create(ctx, dataProfile)).Should(Succeed())
+			dataClone := &vandalv1alpha1.DataClone{
+				ObjectMeta: metav1.ObjectMeta{Name: "mysql-dataclone", Namespace: "default"},
+				Spec:       vandalv1alpha1.DataCloneSpec{SourceProfile: dataProfile.Name, SnapshotName: "mysql-snapshot"},
+			}
+			Expect(k8sClient.Create(ctx, dataClone)).Should(Succeed())
+
+			r := &DataCloneReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			key := client.ObjectKeyFromObject(dataClone)
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			var secret corev1.Secret
+			Expect(k8sClient.Get(ctx, key, &secret)).Should(Succeed())
+			Expect(string(secret.Data["dbname"])).To(Equal("shop"))
+		})
+
+		It("Should fail if the database of the target is unknown", func() {
+			ctx := context.Background()
+			dataProfile := &vandalv1alpha1.DataProfile{
+				ObjectMeta: metav1.ObjectMeta{Name: "mysql-nosecret-dataprofile", Namespace: "default"},
+				Spec: vandalv1alpha1.DataProfileSpec{
+					Target: vandalv1alpha1.DatabaseTarget{SecretName: "missing-db", PVCName: "mysql-data", Engine: vandalv1alpha1.DatabaseEngineMySQL},
+				},
+			}
+			Expect(k8sClient.Create(ctx, dataProfile)).Should(Succeed())
+			dataClone := &vandalv1alpha1.DataClone{
+				ObjectMeta: metav1.ObjectMeta{Name: "mysql-nosecret-dataclone", Namespace: "default"},
+				Spec:       vandalv1alpha1.DataCloneSpec{SourceProfile: dataProfile.Name, SnapshotName: "mysql-snapshot"},
+			}
+			Expect(k8sClient.Create(ctx, dataClone)).Should(Succeed())
+
+			r := &DataCloneReconciler{Client: k8sClient, Scheme: scheme.Scheme}
+			key := client.ObjectKeyFromObject(dataClone)
+			_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, key, dataClone)).Should(Succeed())
+			Expect(dataClone.Status.Phase).To(Equal(vandalv1alpha1.DataClonePhaseFailed))
+			Expect(k8sClient.Get(ctx, key, &corev1.Secret{})).NotTo(Succeed())
+		})
+	})
 })
@@ -19,18 +19,32 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
-	"k8s.io/apimachinery/pkg/api/meta"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/discovery"
+	"github.com/Oridak771/Vandal/masking"
+	"github.com/Oridak771/Vandal/pkg/target"
+	"github.com/Oridak771/Vandal/schema"
 	"github.com/Oridak771/Vandal/storage"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // DataProfileReconciler reconciles a DataProfile object
@@ -39,14 +53,66 @@ type DataProfileReconciler struct {
 	Scheme          *runtime.Scheme
 	Cron            *cron.Cron
 	StorageProvider storage.StorageProvider
+	// MaskingImage is the image of the jobs dumping the target databases of
+	// profiles that take logical dumps.
+	MaskingImage string
+
+	mu        sync.Mutex
+	schedules map[types.UID]scheduledSnapshot
+	// probes records the last connection to the target database of each
+	// DataProfile.
+	probes map[types.UID]targetProbe
 }
 
+// targetProbe is the outcome of connecting to the target database of a
+// DataProfile.
+type targetProbe struct {
+	generation int64
+	at         time.Time
+	reachable  bool
+}
+
+const (
+	// conditionTypeTargetReachable reports whether the target database of a
+	// DataProfile could be connected to.
+	conditionTypeTargetReachable = "TargetReachable"
+	// targetRetryInterval is how soon an unreachable target database is
+	// connected to again.
+	targetRetryInterval = time.Minute
+	// conditionTypeScanned reports whether the target database of a
+	// DataProfile was scanned for sensitive data.
+	conditionTypeScanned = "Scanned"
+	// scanInterval is how often the target database is scanned.
+	scanInterval = time.Hour
+	// conditionTypeSchemaDrift reports whether the schema of the target
+	// database drifted from the masking rules of a DataProfile.
+	conditionTypeSchemaDrift = "SchemaDrift"
+
+	// schemaDocumentKey is the key of the schema document in the ConfigMaps
+	// holding the schema of a snapshot or the baseline schema of a profile.
+	schemaDocumentKey = "schema.yaml"
+	// annotationSchemaFingerprint is the fingerprint of the schema document
+	// of a ConfigMap.
+	annotationSchemaFingerprint = "vandal.db.io/schema-fingerprint"
+	// annotationProfileGeneration is the generation of the DataProfile a
+	// baseline schema was taken for.
+	annotationProfileGeneration = "vandal.db.io/profile-generation"
+	// maxDriftColumns is the number of columns listed in the message of the
+	// SchemaDrift condition.
+	maxDriftColumns = 10
+)
+
 //+kubebuilder:rbac:groups=vandal.db.io,resources=dataprofiles,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=vandal.db.io,resources=dataprofiles/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=vandal.db.io,resources=dataprofiles/finalizers,verbs=update
 //+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshotclasses,verbs=get;list;watch
-//+kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -73,39 +139,39 @@ func (r *DataProfileReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	log.Info("Reconciling DataProfile", "Name", dataProfile.Name)
 
 	// Handle cron job scheduling
-	if dataProfile.Spec.Schedule != "" {
-		entryID := cron.EntryID(dataProfile.UID)
-		entry := r.Cron.Entry(entryID)
-
-		if entry.ID == 0 {
-			// No entry found, create a new one
-			id, err := r.Cron.AddFunc(dataProfile.Spec.Schedule, func() {
-				log.Info("Triggering snapshot for DataProfile", "Name", dataProfile.Name)
-				if err := r.createVolumeSnapshot(ctx, &dataProfile); err != nil {
-					log.Error(err, "failed to create volume snapshot", "DataProfile", dataProfile.Name)
-				}
-			})
-			if err != nil {
-				log.Error(err, "unable to add cron job", "DataProfile", dataProfile.Name)
-				return ctrl.Result{}, err
-			}
-			log.Info("Added new cron job", "EntryID", id)
+	if err := r.scheduleSnapshots(ctx, &dataProfile); err != nil {
+		log.Error(err, "unable to add cron job", "DataProfile", dataProfile.Name)
+		return ctrl.Result{}, err
+	}
+
+	original := dataProfile.Status.DeepCopy()
+
+	// Check that the target database is reachable, then scan it for
+	// sensitive data no masking rule covers. Connecting blocks while it
+	// retries, so the target is only connected to again when the profile
+	// changed or the last attempt is old enough.
+	requeueAfter, probe := r.probeDue(&dataProfile)
+	var db storage.Database
+	if probe {
+		var err error
+		db, err = r.connectTarget(ctx, &dataProfile)
+		if err != nil {
+			log.Error(err, "unable to connect to target database", "DataProfile", dataProfile.Name)
 		} else {
-			// Entry exists, check if schedule needs update
-			if entry.Schedule.String() != dataProfile.Spec.Schedule {
-				r.Cron.Remove(entryID)
-				id, err := r.Cron.AddFunc(dataProfile.Spec.Schedule, func() {
-					log.Info("Triggering snapshot for DataProfile", "Name", dataProfile.Name)
-				if err := r.createVolumeSnapshot(ctx, &dataProfile); err != nil {
-					log.Error(err, "failed to create volume snapshot", "DataProfile", dataProfile.Name)
-				}
-				})
-				if err != nil {
-					log.Error(err, "unable to update cron job", "DataProfile", dataProfile.Name)
-					return ctrl.Result{}, err
-				}
-				log.Info("Updated cron job", "EntryID", id)
-			}
+			defer db.Close()
+		}
+		requeueAfter = r.recordProbe(&dataProfile, err == nil)
+	}
+	if db != nil && scanDue(&dataProfile) {
+		if err := r.scanTarget(ctx, &dataProfile, db); err != nil {
+			log.Error(err, "unable to scan target database", "DataProfile", dataProfile.Name)
+			meta.SetStatusCondition(&dataProfile.Status.Conditions, metav1.Condition{
+				Type:               conditionTypeScanned,
+				Status:             metav1.ConditionFalse,
+				Reason:             "ScanFailed",
+				Message:            err.Error(),
+				ObservedGeneration: dataProfile.Generation,
+			})
 		}
 	}
 
@@ -131,18 +197,338 @@ func (r *DataProfileReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		Status: metav1.ConditionTrue,
 		Reason: "Success",
 	})
-	dataProfile.Status.LastSnapshotTime = &metav1.Time{Time: time.Now()}
-	if err := r.Status().Update(ctx, &dataProfile); err != nil {
-		log.Error(err, "unable to update DataProfile status", "DataProfile", dataProfile.Name)
-		return ctrl.Result{}, err
+	switch {
+	case dataProfile.Spec.Dump != nil:
+		// Record the outcome of the dump jobs
+		if err := r.reconcileDumps(ctx, &dataProfile); err != nil {
+			log.Error(err, "unable to reconcile dumps", "DataProfile", dataProfile.Name)
+			return ctrl.Result{}, err
+		}
+	case dataProfile.Spec.MaskedSnapshot != nil:
+		// Move the masking of new snapshots forward
+		pending, err := r.reconcileMaskedSnapshots(ctx, &dataProfile)
+		if err != nil {
+			log.Error(err, "unable to mask snapshots", "DataProfile", dataProfile.Name)
+			return ctrl.Result{}, err
+		}
+		if pending {
+			requeueAfter = snapshotPollInterval
+		}
+	}
+	// Status updates trigger a new reconciliation, so the status is only
+	// written when it changed.
+	if !equality.Semantic.DeepEqual(original, &dataProfile.Status) {
+		if err := r.Status().Update(ctx, &dataProfile); err != nil {
+			log.Error(err, "unable to update DataProfile status", "DataProfile", dataProfile.Name)
+			return ctrl.Result{}, err
+		}
 	}
 
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// scanDue reports whether the target database of a DataProfile should be
+// scanned: it never was, the spec changed since, or the last scan is older
+// than scanInterval.
+func scanDue(dataProfile *vandalv1alpha1.DataProfile) bool {
+	cond := meta.FindStatusCondition(dataProfile.Status.Conditions, conditionTypeScanned)
+	if cond == nil || cond.ObservedGeneration != dataProfile.Generation || dataProfile.Status.LastScanTime == nil {
+		return true
+	}
+	return time.Since(dataProfile.Status.LastScanTime.Time) >= scanInterval
+}
+
+// scanTarget scans the target database db for sensitive columns and records
+// the ones no masking rule covers in the status.
+func (r *DataProfileReconciler) scanTarget(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, db storage.Database) error {
+	s, err := db.GetSchema(ctx)
+	if err != nil {
+		return fmt.Errorf("reading schema: %w", err)
+	}
+	if err := r.checkSchemaDrift(ctx, dataProfile, s); err != nil {
+		return fmt.Errorf("checking schema drift: %w", err)
+	}
+
+	// Tables whose rows are not copied cannot leak into clones.
+	s = s.WithData(masking.TableFilter(dataProfile.Spec.Tables))
+	sampler, ok := db.(storage.Sampler)
+	if !ok {
+		return fmt.Errorf("%s databases cannot be sampled", dataProfile.Spec.Target.Engine)
+	}
+	sample := func(table *schema.Table, limit int) (map[string][]string, error) {
+		return sampler.SampleValues(ctx, table, limit)
+	}
+	findings, err := discovery.Scan(s, sample, discovery.DefaultSampleSize, dataProfile.Spec.Masking.Rules)
+	if err != nil {
+		return err
+	}
+
+	unmasked := discovery.Unmasked(findings)
+	dataProfile.Status.UnmaskedColumns = nil
+	for _, f := range unmasked {
+		rule := f.Rule
+		dataProfile.Status.UnmaskedColumns = append(dataProfile.Status.UnmaskedColumns, vandalv1alpha1.SensitiveColumn{
+			Table:         f.Table,
+			Column:        f.Column,
+			Category:      string(f.Category),
+			SuggestedRule: &rule,
+		})
+	}
+	dataProfile.Status.LastScanTime = &metav1.Time{Time: time.Now()}
+	meta.SetStatusCondition(&dataProfile.Status.Conditions, metav1.Condition{
+		Type:               conditionTypeScanned,
+		Status:             metav1.ConditionTrue,
+		Reason:             "ScanSucceeded",
+		Message:            fmt.Sprintf("%d of %d sensitive columns are not masked", len(unmasked), len(findings)),
+		ObservedGeneration: dataProfile.Generation,
+	})
+	return nil
+}
+
+// checkSchemaDrift records the fingerprint of the schema of the target
+// database and compares the schema with the baseline taken when the profile
+// last changed. The SchemaDrift condition is raised when masking rules
+// reference columns that no longer exist or columns were added since, as
+// those have not been reviewed for sensitive data.
+func (r *DataProfileReconciler) checkSchemaDrift(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, s *schema.Schema) error {
+	fingerprint, err := schema.Fingerprint(s)
+	if err != nil {
+		return err
+	}
+	dataProfile.Status.SchemaFingerprint = fingerprint
+
+	baseline, err := r.schemaBaseline(ctx, dataProfile, s, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, rule := range dataProfile.Spec.Masking.Rules {
+		if table := s.Table(rule.Table); table == nil || table.Column(rule.Column) == nil {
+			missing = append(missing, rule.Table+"."+rule.Column)
+		}
+	}
+	var added []string
+	filter := masking.TableFilter(dataProfile.Spec.Tables)
+	for _, change := range schema.Diff(baseline.Select(filter), s.Select(filter)) {
+		switch {
+		case change.Kind != schema.ChangeAdded:
+		case change.Column == "":
+			added = append(added, change.Table+".*")
+		default:
+			added = append(added, change.Table+"."+change.Column)
+		}
+	}
+
+	cond := metav1.Condition{
+		Type:               conditionTypeSchemaDrift,
+		Status:             metav1.ConditionFalse,
+		Reason:             "NoDrift",
+		Message:            "The schema of the target database matches the masking rules",
+		ObservedGeneration: dataProfile.Generation,
+	}
+	var messages []string
+	if len(missing) > 0 {
+		cond.Reason = "MissingColumns"
+		messages = append(messages, "masking rules reference columns that no longer exist: "+listColumns(missing))
+	}
+	if len(added) > 0 {
+		if cond.Reason == "NoDrift" {
+			cond.Reason = "ColumnsAdded"
+		}
+		messages = append(messages, "columns were added since the profile was last updated: "+listColumns(added))
+	}
+	if len(messages) > 0 {
+		cond.Status = metav1.ConditionTrue
+		cond.Message = strings.Join(messages, "; ")
+	}
+	meta.SetStatusCondition(&dataProfile.Status.Conditions, cond)
+	return nil
+}
+
+// listColumns joins the first maxDriftColumns names.
+func listColumns(names []string) string {
+	if len(names) > maxDriftColumns {
+		return fmt.Sprintf("%s and %d more", strings.Join(names[:maxDriftColumns], ", "), len(names)-maxDriftColumns)
+	}
+	return strings.Join(names, ", ")
+}
+
+// schemaBaseline returns the schema of the target database when the profile
+// last changed, kept in the ConfigMap <profile>-schema. When the profile has
+// changed since, its rules are taken to be reviewed against the current
+// schema s, which becomes the new baseline.
+func (r *DataProfileReconciler) schemaBaseline(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, s *schema.Schema, fingerprint string) (*schema.Schema, error) {
+	generation := strconv.FormatInt(dataProfile.Generation, 10)
+
+	var configMap corev1.ConfigMap
+	key := client.ObjectKey{Namespace: dataProfile.Namespace, Name: dataProfile.Name + "-schema"}
+	err := r.Get(ctx, key, &configMap)
+	if err == nil && configMap.Annotations[annotationProfileGeneration] == generation {
+		return schema.Unmarshal([]byte(configMap.Data[schemaDocumentKey]))
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	create := err != nil
+
+	doc, err := schema.MarshalYAML(s)
+	if err != nil {
+		return nil, err
+	}
+	configMap.Name, configMap.Namespace = key.Name, key.Namespace
+	if configMap.Annotations == nil {
+		configMap.Annotations = make(map[string]string)
+	}
+	configMap.Annotations[annotationProfileGeneration] = generation
+	configMap.Annotations[annotationSchemaFingerprint] = fingerprint
+	configMap.Data = map[string]string{schemaDocumentKey: string(doc)}
+
+	if create {
+		if err := controllerutil.SetControllerReference(dataProfile, &configMap, r.Scheme); err != nil {
+			return nil, err
+		}
+		err = r.Create(ctx, &configMap)
+	} else {
+		err = r.Update(ctx, &configMap)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storing baseline schema: %w", err)
+	}
+	return s, nil
+}
+
+// storeSnapshotSchema stores the schema of the target database in the
+// ConfigMap <snapshot>-schema, owned by the snapshot so that it is deleted
+// with it.
+func (r *DataProfileReconciler) storeSnapshotSchema(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, snapshot *snapshotv1.VolumeSnapshot) error {
+	db, err := r.targetDatabase(ctx, dataProfile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	s, err := db.GetSchema(ctx)
+	if err != nil {
+		return fmt.Errorf("reading schema: %w", err)
+	}
+	fingerprint, err := schema.Fingerprint(s)
+	if err != nil {
+		return err
+	}
+	doc, err := schema.MarshalYAML(s)
+	if err != nil {
+		return err
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshot.Name + "-schema",
+			Namespace: snapshot.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "vandal",
+				"app.kubernetes.io/instance":   dataProfile.Name,
+				"app.kubernetes.io/created-by": "dataprofile-controller",
+			},
+			Annotations: map[string]string{annotationSchemaFingerprint: fingerprint},
+		},
+		Data: map[string]string{schemaDocumentKey: string(doc)},
+	}
+	if err := controllerutil.SetControllerReference(snapshot, configMap, r.Scheme); err != nil {
+		return err
+	}
+	return r.Create(ctx, configMap)
+}
+
+// targetDatabase returns the target database of a profile, resolved from the
+// secrets it references.
+func (r *DataProfileReconciler) targetDatabase(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) (storage.Database, error) {
+	resolver := &target.Resolver{Reader: r.Client}
+	return resolver.Database(ctx, dataProfile)
+}
+
+// connectTarget connects to the target database of a profile and records
+// whether it is reachable in the TargetReachable condition. The database is
+// returned only if it is reachable, and must then be closed.
+func (r *DataProfileReconciler) connectTarget(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) (storage.Database, error) {
+	cond := metav1.Condition{
+		Type:               conditionTypeTargetReachable,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: dataProfile.Generation,
+	}
+	defer func() { meta.SetStatusCondition(&dataProfile.Status.Conditions, cond) }()
+
+	db, err := r.targetDatabase(ctx, dataProfile)
+	if err != nil {
+		cond.Reason, cond.Message = "InvalidTarget", err.Error()
+		return nil, err
+	}
+	if err := db.Connect(ctx); err != nil {
+		db.Close()
+		cond.Reason, cond.Message = "ConnectionFailed", err.Error()
+		return nil, err
+	}
+	cond.Status, cond.Reason, cond.Message = metav1.ConditionTrue, "Connected", "The target database is reachable"
+	return db, nil
+}
+
+// probeDue reports whether the target database of a DataProfile should be
+// connected to: it never was by this controller, the spec changed since, or
+// the last attempt is older than scanInterval, or targetRetryInterval if it
+// failed. Otherwise it returns the time left until the next attempt.
+func (r *DataProfileReconciler) probeDue(dataProfile *vandalv1alpha1.DataProfile) (time.Duration, bool) {
+	r.mu.Lock()
+	probe, ok := r.probes[dataProfile.UID]
+	r.mu.Unlock()
+	if !ok || probe.generation != dataProfile.Generation {
+		return 0, true
+	}
+	interval := targetRetryInterval
+	if probe.reachable {
+		interval = scanInterval
+	}
+	left := interval - time.Since(probe.at)
+	return left, left <= 0
+}
+
+// recordProbe records the outcome of connecting to the target database of a
+// DataProfile and returns the time until the next attempt.
+func (r *DataProfileReconciler) recordProbe(dataProfile *vandalv1alpha1.DataProfile, reachable bool) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.probes == nil {
+		r.probes = make(map[types.UID]targetProbe)
+	}
+	r.probes[dataProfile.UID] = targetProbe{generation: dataProfile.Generation, at: time.Now(), reachable: reachable}
+	if reachable {
+		return scanInterval
+	}
+	return targetRetryInterval
+}
+
+// takeSnapshot takes a snapshot of the current version of a profile: a
+// logical dump if the profile takes dumps, a VolumeSnapshot otherwise, which
+// is then masked if the profile masks its snapshots.
+func (r *DataProfileReconciler) takeSnapshot(ctx context.Context, key client.ObjectKey) error {
+	var dataProfile vandalv1alpha1.DataProfile
+	if err := r.Get(ctx, key, &dataProfile); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	switch {
+	case dataProfile.Spec.Dump != nil:
+		return r.createDumpJob(ctx, &dataProfile)
+	case dataProfile.Spec.MaskedSnapshot != nil:
+		return r.startMaskedSnapshot(ctx, &dataProfile)
+	}
+	return r.createVolumeSnapshot(ctx, &dataProfile)
 }
 
 func (r *DataProfileReconciler) createVolumeSnapshot(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) error {
 	log := log.FromContext(ctx)
 
+	if dataProfile.Spec.Target.PVCName == "" {
+		return fmt.Errorf("target.pvcName is required unless the profile takes dumps")
+	}
+
 	// 1. Set the phase to CreatingSnapshot
 	dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseCreatingSnapshot
 	if err := r.Status().Update(ctx, dataProfile); err != nil {
@@ -166,12 +552,18 @@ func (r *DataProfileReconciler) createVolumeSnapshot(ctx context.Context, dataPr
 
 	// 4. Set the phase to SnapshotReady
 	dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseSnapshotReady
+	dataProfile.Status.LastSnapshotTime = &metav1.Time{Time: time.Now()}
 	if err := r.Status().Update(ctx, dataProfile); err != nil {
 		log.Error(err, "unable to update DataProfile status")
 		return err
 	}
 
 	log.Info("Created VolumeSnapshot", "Name", snapshot.Name)
+
+	// 5. Store the schema of the database with the snapshot
+	if err := r.storeSnapshotSchema(ctx, dataProfile, snapshot); err != nil {
+		log.Error(err, "unable to store the schema of the snapshot", "VolumeSnapshot", snapshot.Name)
+	}
 	return nil
 }
 
@@ -179,5 +571,6 @@ func (r *DataProfileReconciler) createVolumeSnapshot(ctx context.Context, dataPr
 func (r *DataProfileReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&vandalv1alpha1.DataProfile{}).
+		Owns(&batchv1.Job{}).
 		Complete(r)
 }
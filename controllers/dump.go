@@ -0,0 +1,534 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/pkg/target"
+	"github.com/Oridak771/Vandal/storage"
+)
+
+const (
+	// defaultDumpSize is the size of the claim holding the dumps of a profile
+	// when its spec sets none.
+	defaultDumpSize = "10Gi"
+	// dumpsMountPath is where jobs mount the claim holding the dumps.
+	dumpsMountPath = "/dumps"
+	// componentDump is the component label of the jobs dumping a profile.
+	componentDump = "dump"
+	// restoreConnectRetries is how many times a job restoring a dump or
+	// copying a subset retries to connect to a clone whose database is still
+	// initializing.
+	restoreConnectRetries = 30
+	// conditionTypeRestored is the condition reporting the outcome of
+	// restoring a dump into a clone.
+	conditionTypeRestored = "Restored"
+	// secretsMountPath is where jobs mount the secrets of the target
+	// database.
+	secretsMountPath = "/etc/vandal"
+)
+
+// dumpClaimName returns the name of the claim holding the dumps of a profile.
+func dumpClaimName(dataProfile *vandalv1alpha1.DataProfile) string {
+	return dataProfile.Name + "-dumps"
+}
+
+// dumpPath returns the path of a dump in the jobs mounting the claim holding
+// it. Dumps are named after the jobs that took them.
+func dumpPath(dump string) string {
+	return dumpsMountPath + "/" + dump + ".sql"
+}
+
+// dumpSize returns the size of the claim holding the dumps of a profile and
+// of the volumes of the clones restored from them.
+func dumpSize(spec *vandalv1alpha1.DumpSpec) resource.Quantity {
+	if spec.Size != nil {
+		return *spec.Size
+	}
+	return resource.MustParse(defaultDumpSize)
+}
+
+// dumpJobLabels returns the labels of the jobs dumping a profile.
+func dumpJobLabels(dataProfile *vandalv1alpha1.DataProfile) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":       "vandal",
+		"app.kubernetes.io/instance":   dataProfile.Name,
+		"app.kubernetes.io/component":  componentDump,
+		"app.kubernetes.io/created-by": "dataprofile-controller",
+	}
+}
+
+// jobFinished returns the condition of a job that completed or failed, or
+// nil while it runs.
+func jobFinished(job *batchv1.Job) *batchv1.JobCondition {
+	for i, condition := range job.Status.Conditions {
+		if condition.Status == corev1.ConditionTrue &&
+			(condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) {
+			return &job.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// dumpJobs returns the jobs dumping a profile, newest first.
+func (r *DataProfileReconciler) dumpJobs(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) ([]batchv1.Job, error) {
+	var jobs batchv1.JobList
+	if err := r.List(ctx, &jobs, client.InNamespace(dataProfile.Namespace), client.MatchingLabels(dumpJobLabels(dataProfile))); err != nil {
+		return nil, err
+	}
+	var owned []batchv1.Job
+	for _, job := range jobs.Items {
+		if metav1.IsControlledBy(&job, dataProfile) {
+			owned = append(owned, job)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[j].CreationTimestamp.Before(&owned[i].CreationTimestamp)
+	})
+	return owned, nil
+}
+
+// createDumpJob starts a job dumping the target database of a profile into
+// the claim holding its dumps, masking the rows as they are read. No job is
+// started while the previous one runs.
+func (r *DataProfileReconciler) createDumpJob(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) error {
+	log := log.FromContext(ctx)
+
+	jobs, err := r.dumpJobs(ctx, dataProfile)
+	if err != nil {
+		return err
+	}
+	if len(jobs) > 0 && jobFinished(&jobs[0]) == nil {
+		log.Info("Previous dump still running", "Job", jobs[0].Name)
+		return nil
+	}
+	if err := r.ensureDumpClaim(ctx, dataProfile); err != nil {
+		return err
+	}
+
+	job, err := r.dumpJob(dataProfile)
+	if err != nil {
+		return err
+	}
+	if err := controllerutil.SetControllerReference(dataProfile, job, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		return err
+	}
+	log.Info("Created dump job", "Job", job.Name)
+
+	dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseCreatingSnapshot
+	return r.Status().Update(ctx, dataProfile)
+}
+
+// dumpJob returns the job dumping the target database of a profile. It reads
+// the connection settings from the mounted secrets of the target and writes
+// the dump to a file of the claim holding the dumps, named after the job.
+func (r *DataProfileReconciler) dumpJob(dataProfile *vandalv1alpha1.DataProfile) (*batchv1.Job, error) {
+	name := fmt.Sprintf("%s-dump-%d", dataProfile.Name, time.Now().Unix())
+
+	env, err := maskingEnv(dataProfile)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, corev1.EnvVar{Name: "OUTPUT_FILE", Value: dumpPath(name)})
+	if subset := dataProfile.Spec.Subset; subset != nil {
+		subsetVar, err := subsetEnv(subset)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, subsetVar)
+	}
+	if retention := dataProfile.Spec.RetentionPolicy; retention != nil && retention.Count > 0 {
+		env = append(env, corev1.EnvVar{Name: "OUTPUT_KEEP", Value: strconv.Itoa(int(retention.Count))})
+	}
+
+	connEnv, mounts, volumes := targetJobConnection(dataProfile, "SOURCE")
+	env = append(env, connEnv...)
+	mounts = append(mounts, corev1.VolumeMount{Name: "dumps", MountPath: dumpsMountPath})
+	volumes = append(volumes, corev1.Volume{
+		Name: "dumps",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: dumpClaimName(dataProfile)},
+		},
+	})
+
+	backoffLimit := int32(2)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: dataProfile.Namespace,
+			Labels:    dumpJobLabels(dataProfile),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "dump",
+							Image:        jobImage(r.MaskingImage),
+							Env:          env,
+							VolumeMounts: mounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}, nil
+}
+
+// targetJobConnection returns the environment, volume mounts and volumes
+// giving a masking job the connection settings of the target database of a
+// profile as its <prefix> database: the credentials secret is mounted for
+// <prefix>_SECRET_DIR, and the secrets of the TLS configuration for
+// <prefix>_SSLROOTCERT, <prefix>_SSLCERT and <prefix>_SSLKEY.
+func targetJobConnection(dataProfile *vandalv1alpha1.DataProfile, prefix string) ([]corev1.EnvVar, []corev1.VolumeMount, []corev1.Volume) {
+	var env []corev1.EnvVar
+	var mounts []corev1.VolumeMount
+	var volumes []corev1.Volume
+	mountSecret := func(suffix, secretName string) string {
+		name := strings.ToLower(prefix) + suffix
+		dir := secretsMountPath + "/" + name
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: dir, ReadOnly: true})
+		volumes = append(volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secretName}},
+		})
+		return dir
+	}
+
+	dir := mountSecret("", dataProfile.Spec.Target.SecretName)
+	env = append(env, corev1.EnvVar{Name: prefix + "_SECRET_DIR", Value: dir})
+	if tls := dataProfile.Spec.Target.TLS; tls != nil {
+		mode := tls.Mode
+		if mode == "" {
+			mode = storage.TLSModeVerifyFull
+		}
+		env = append(env, corev1.EnvVar{Name: prefix + "_SSLMODE", Value: mode})
+		if tls.CASecretName != "" {
+			dir := mountSecret("-ca", tls.CASecretName)
+			env = append(env, corev1.EnvVar{Name: prefix + "_SSLROOTCERT", Value: dir + "/" + target.KeyCA})
+		}
+		if tls.ClientCertSecretName != "" {
+			dir := mountSecret("-cert", tls.ClientCertSecretName)
+			env = append(env,
+				corev1.EnvVar{Name: prefix + "_SSLCERT", Value: dir + "/" + corev1.TLSCertKey},
+				corev1.EnvVar{Name: prefix + "_SSLKEY", Value: dir + "/" + corev1.TLSPrivateKeyKey},
+			)
+		}
+	}
+	return env, mounts, volumes
+}
+
+// ensureDumpClaim creates the claim holding the dumps of a profile, owned by
+// the profile, if it does not exist yet.
+func (r *DataProfileReconciler) ensureDumpClaim(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) error {
+	spec := dataProfile.Spec.Dump
+	accessModes := spec.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dumpClaimName(dataProfile),
+			Namespace: dataProfile.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "vandal",
+				"app.kubernetes.io/instance":   dataProfile.Name,
+				"app.kubernetes.io/created-by": "dataprofile-controller",
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			StorageClassName: spec.StorageClassName,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: dumpSize(spec)},
+			},
+		},
+	}
+	if err := controllerutil.SetControllerReference(dataProfile, pvc, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, pvc); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating dump claim: %w", err)
+	}
+	return nil
+}
+
+// reconcileDumps records the outcome of the dump jobs of a profile in its
+// status and deletes the jobs of completed dumps beyond the retention policy,
+// whose files the jobs that followed removed, and failed jobs once a later
+// one has run.
+func (r *DataProfileReconciler) reconcileDumps(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) error {
+	jobs, err := r.dumpJobs(ctx, dataProfile)
+	if err != nil {
+		return err
+	}
+
+	completed := 0
+	for i := range jobs {
+		job := &jobs[i]
+		finished := jobFinished(job)
+		if i == 0 {
+			switch {
+			case finished == nil:
+				dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseCreatingSnapshot
+			case finished.Type == batchv1.JobComplete:
+				dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseSnapshotReady
+			default:
+				dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseFailed
+			}
+		}
+		if finished == nil {
+			continue
+		}
+
+		remove := i > 0 && finished.Type == batchv1.JobFailed
+		if finished.Type == batchv1.JobComplete {
+			completed++
+			if completed == 1 {
+				dataProfile.Status.LatestDump = job.Name
+				dataProfile.Status.LastSnapshotTime = job.Status.CompletionTime
+			}
+			if retention := dataProfile.Spec.RetentionPolicy; retention != nil && retention.Count > 0 {
+				remove = completed > int(retention.Count)
+			}
+		}
+		if remove {
+			if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dumpProfile returns the source profile of a clone if it takes logical
+// dumps, or nil otherwise or if it does not exist.
+func (r *DataCloneReconciler) dumpProfile(ctx context.Context, dataClone *vandalv1alpha1.DataClone) (*vandalv1alpha1.DataProfile, error) {
+	var dataProfile vandalv1alpha1.DataProfile
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Spec.SourceProfile}, &dataProfile); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	if dataProfile.Spec.Dump == nil {
+		return nil, nil
+	}
+	return &dataProfile, nil
+}
+
+// createEmptyPVC creates the empty volume of a clone a dump is restored or a
+// subset copied into.
+func (r *DataCloneReconciler) createEmptyPVC(ctx context.Context, dataClone *vandalv1alpha1.DataClone, storageClassName *string, size resource.Quantity) (*corev1.PersistentVolumeClaim, error) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dataClone.Name,
+			Namespace: dataClone.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "vandal",
+				"app.kubernetes.io/instance":   dataClone.Name,
+				"app.kubernetes.io/created-by": "dataclone-controller",
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: storageClassName,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}
+	if err := r.Create(ctx, pvc); err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	log.FromContext(ctx).Info("Created empty PVC", "PVC", pvc.Name)
+	return pvc, nil
+}
+
+// restoreJobName returns the name of the job restoring a dump into a clone.
+func restoreJobName(dataClone *vandalv1alpha1.DataClone) string {
+	return dataClone.Name + "-restore"
+}
+
+// reconcileRestore runs the job restoring a dump of the profile into a clone
+// whose database is up: the dump named by the clone, or the latest one. It
+// reports whether restoring has finished; on failure the clone is moved to
+// the Failed phase.
+func (r *DataCloneReconciler) reconcileRestore(ctx context.Context, dataClone *vandalv1alpha1.DataClone, pod *corev1.Pod, dataProfile *vandalv1alpha1.DataProfile) (bool, error) {
+	log := log.FromContext(ctx)
+
+	if dataProfile == nil {
+		return true, r.setRestoreFailed(ctx, dataClone, "ProfileNotDumped",
+			fmt.Sprintf("DataProfile %s does not exist or does not take dumps", dataClone.Spec.SourceProfile))
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(pod), pod); err != nil {
+		return false, err
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		log.Info("Waiting for database pod", "Pod", pod.Name, "Phase", pod.Status.Phase)
+		return false, nil
+	}
+
+	job := &batchv1.Job{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: restoreJobName(dataClone)}, job)
+	if apierrors.IsNotFound(err) {
+		dump := dataClone.Spec.SnapshotName
+		if dump == "" {
+			dump = dataProfile.Status.LatestDump
+		}
+		if dump == "" {
+			log.Info("Waiting for a dump of DataProfile", "DataProfile", dataProfile.Name)
+			return false, nil
+		}
+		if errs := validation.IsDNS1123Subdomain(dump); len(errs) > 0 {
+			return true, r.setRestoreFailed(ctx, dataClone, "InvalidDump",
+				fmt.Sprintf("Invalid dump name %q: %s", dump, strings.Join(errs, ", ")))
+		}
+		job, err = r.createRestoreJob(ctx, dataClone, dataProfile, dump)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	finished := jobFinished(job)
+	switch {
+	case finished == nil:
+		log.Info("Waiting for restore job", "Job", job.Name)
+		return false, nil
+	case finished.Type == batchv1.JobFailed:
+		message := fmt.Sprintf("Restore job %s failed: %s", job.Name, finished.Message)
+		if summary := r.maskingJobSummary(ctx, job); summary != "" {
+			message += ": " + summary
+		}
+		return true, r.setRestoreFailed(ctx, dataClone, "RestoreJobFailed", message)
+	}
+
+	log.Info("Restore job succeeded", "Job", job.Name)
+	meta.SetStatusCondition(&dataClone.Status.Conditions, metav1.Condition{
+		Type:    conditionTypeRestored,
+		Status:  metav1.ConditionTrue,
+		Reason:  "RestoreSucceeded",
+		Message: fmt.Sprintf("Restore job %s succeeded", job.Name),
+	})
+	meta.SetStatusCondition(&dataClone.Status.Conditions, metav1.Condition{
+		Type:    conditionTypeMasked,
+		Status:  metav1.ConditionTrue,
+		Reason:  "MaskedWhenDumped",
+		Message: fmt.Sprintf("The dump of DataProfile %s was masked when it was taken", dataProfile.Name),
+	})
+	return true, nil
+}
+
+// createRestoreJob creates the job restoring a dump into a clone. The job
+// mounts the claim holding the dumps of the profile read-only and connects to
+// the clone with the credentials of its connection secret.
+func (r *DataCloneReconciler) createRestoreJob(ctx context.Context, dataClone *vandalv1alpha1.DataClone, dataProfile *vandalv1alpha1.DataProfile, dump string) (*batchv1.Job, error) {
+	env := append(cloneTargetEnv(dataClone),
+		corev1.EnvVar{Name: "INPUT_FILE", Value: dumpPath(dump)},
+		corev1.EnvVar{Name: "DATABASE_CONNECT_RETRIES", Value: strconv.Itoa(restoreConnectRetries)},
+	)
+	if engine := dataProfile.Spec.Target.Engine; engine != "" {
+		env = append(env, corev1.EnvVar{Name: "DATABASE_ENGINE", Value: engine})
+	}
+
+	backoffLimit := int32(2)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      restoreJobName(dataClone),
+			Namespace: dataClone.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "vandal",
+				"app.kubernetes.io/instance":   dataClone.Name,
+				"app.kubernetes.io/created-by": "dataclone-controller",
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:  "restore",
+							Image: jobImage(r.MaskingImage),
+							Env:   env,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "dumps", MountPath: dumpsMountPath, ReadOnly: true},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "dumps",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: dumpClaimName(dataProfile),
+									ReadOnly:  true,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	if err := controllerutil.SetControllerReference(dataClone, job, r.Scheme); err != nil {
+		return nil, err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		return nil, err
+	}
+
+	log.FromContext(ctx).Info("Created restore job", "Job", job.Name, "Dump", dump)
+	return job, nil
+}
+
+// setRestoreFailed moves a clone to the Failed phase with a Restored
+// condition explaining why.
+func (r *DataCloneReconciler) setRestoreFailed(ctx context.Context, dataClone *vandalv1alpha1.DataClone, reason, message string) error {
+	dataClone.Status.Phase = vandalv1alpha1.DataClonePhaseFailed
+	meta.SetStatusCondition(&dataClone.Status.Conditions, metav1.Condition{
+		Type:    conditionTypeRestored,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	})
+	return r.Status().Update(ctx, dataClone)
+}
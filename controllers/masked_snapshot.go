@@ -0,0 +1,495 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/storage"
+)
+
+const (
+	// labelSnapshotProfile is the label naming the DataProfile a
+	// VolumeSnapshot was taken for.
+	labelSnapshotProfile = "vandal.db.io/profile"
+	// labelSnapshotMasked is "true" on VolumeSnapshots of masked data and
+	// "false" on the snapshots waiting to be masked.
+	labelSnapshotMasked = "vandal.db.io/masked"
+	// conditionTypeSnapshotMasked is the condition reporting the outcome of
+	// masking the last snapshot of a DataProfile.
+	conditionTypeSnapshotMasked = "SnapshotMasked"
+	// snapshotPollInterval is how often a profile is requeued while one of
+	// its snapshots is being masked.
+	snapshotPollInterval = 10 * time.Second
+)
+
+// scratchName returns the name of the scratch volume, pod, service and job
+// masking a snapshot.
+func scratchName(snapshot *snapshotv1.VolumeSnapshot) string {
+	return snapshot.Name + "-masking"
+}
+
+// maskedSnapshotName returns the name of the masked snapshot of a snapshot.
+func maskedSnapshotName(snapshot *snapshotv1.VolumeSnapshot) string {
+	return snapshot.Name + "-masked"
+}
+
+// snapshotReady reports whether a VolumeSnapshot can be restored, and returns
+// its error if taking it failed.
+func snapshotReady(snapshot *snapshotv1.VolumeSnapshot) (bool, error) {
+	if snapshot.Status == nil {
+		return false, nil
+	}
+	if e := snapshot.Status.Error; e != nil && e.Message != nil {
+		return false, fmt.Errorf("VolumeSnapshot %s failed: %s", snapshot.Name, *e.Message)
+	}
+	return snapshot.Status.ReadyToUse != nil && *snapshot.Status.ReadyToUse, nil
+}
+
+// startMaskedSnapshot takes a snapshot of the target volume of a profile that
+// masks its snapshots, labelled to be masked by reconcileMaskedSnapshots. No
+// snapshot is taken while the previous one is being masked.
+func (r *DataProfileReconciler) startMaskedSnapshot(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) error {
+	log := log.FromContext(ctx)
+
+	if dataProfile.Spec.Target.PVCName == "" {
+		return fmt.Errorf("target.pvcName is required unless the profile takes dumps")
+	}
+	pending, err := r.unmaskedSnapshots(ctx, dataProfile)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		log.Info("Previous snapshot still being masked", "VolumeSnapshot", pending[0].Name)
+		return nil
+	}
+
+	dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseCreatingSnapshot
+	if err := r.Status().Update(ctx, dataProfile); err != nil {
+		return err
+	}
+
+	snapshot, err := r.StorageProvider.CreateSnapshot(ctx, dataProfile, dataProfile.Spec.Target.PVCName)
+	if err != nil {
+		return err
+	}
+	// The unmasked snapshot is not controlled by the profile, so that the
+	// retention policy only counts masked snapshots, but it is deleted with
+	// the profile.
+	if snapshot.Labels == nil {
+		snapshot.Labels = make(map[string]string)
+	}
+	snapshot.Labels[labelSnapshotProfile] = dataProfile.Name
+	snapshot.Labels[labelSnapshotMasked] = "false"
+	if err := controllerutil.SetOwnerReference(dataProfile, snapshot, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Update(ctx, snapshot); err != nil {
+		return err
+	}
+
+	log.Info("Created VolumeSnapshot to mask", "Name", snapshot.Name)
+	return nil
+}
+
+// unmaskedSnapshots returns the snapshots of a profile waiting to be masked.
+// Snapshots being deleted, which may linger while volumes restored from them
+// are deleted, are left out.
+func (r *DataProfileReconciler) unmaskedSnapshots(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) ([]snapshotv1.VolumeSnapshot, error) {
+	var snapshots snapshotv1.VolumeSnapshotList
+	if err := r.List(ctx, &snapshots, client.InNamespace(dataProfile.Namespace), client.MatchingLabels{
+		labelSnapshotProfile: dataProfile.Name,
+		labelSnapshotMasked:  "false",
+	}); err != nil {
+		return nil, err
+	}
+	var pending []snapshotv1.VolumeSnapshot
+	for _, snapshot := range snapshots.Items {
+		if snapshot.DeletionTimestamp.IsZero() {
+			pending = append(pending, snapshot)
+		}
+	}
+	return pending, nil
+}
+
+// reconcileMaskedSnapshots moves the masking of the snapshots of a profile
+// forward and reports whether any is still being masked.
+func (r *DataProfileReconciler) reconcileMaskedSnapshots(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) (bool, error) {
+	snapshots, err := r.unmaskedSnapshots(ctx, dataProfile)
+	if err != nil {
+		return false, err
+	}
+	pending := false
+	for i := range snapshots {
+		done, err := r.maskSnapshot(ctx, dataProfile, &snapshots[i])
+		if err != nil {
+			return false, err
+		}
+		pending = pending || !done
+	}
+	return pending, nil
+}
+
+// maskSnapshot masks a snapshot of the target volume of a profile, one step
+// per call, and reports whether it has finished. The snapshot is restored to
+// a scratch volume, a database pod is started on it and the masking job masks
+// it in place. The pod is then deleted, so that the database shuts down
+// cleanly, and the volume is snapshotted again. Once that masked snapshot is
+// ready, the unmasked snapshot and the scratch resources are deleted.
+func (r *DataProfileReconciler) maskSnapshot(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, snapshot *snapshotv1.VolumeSnapshot) (bool, error) {
+	log := log.FromContext(ctx)
+
+	ready, err := snapshotReady(snapshot)
+	if err != nil {
+		return true, r.failMaskedSnapshot(ctx, dataProfile, snapshot, err.Error())
+	}
+	if !ready {
+		log.Info("Waiting for VolumeSnapshot", "VolumeSnapshot", snapshot.Name)
+		return false, nil
+	}
+
+	engine, ok := databaseEngines[dataProfile.Spec.Target.Engine]
+	if !ok {
+		engine = databaseEngines[vandalv1alpha1.DatabaseEnginePostgres]
+	}
+	if err := r.createScratchClaim(ctx, dataProfile, snapshot); err != nil {
+		return false, err
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKey{Namespace: snapshot.Namespace, Name: scratchName(snapshot)}, job)
+	if apierrors.IsNotFound(err) {
+		pod, err := r.createScratchDatabase(ctx, dataProfile, snapshot, engine)
+		if err != nil {
+			return false, err
+		}
+		if pod.Status.Phase != corev1.PodRunning {
+			log.Info("Waiting for scratch database pod", "Pod", pod.Name, "Phase", pod.Status.Phase)
+			return false, nil
+		}
+		return false, r.createScratchMaskingJob(ctx, dataProfile, snapshot, engine)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	finished := jobFinished(job)
+	switch {
+	case finished == nil:
+		log.Info("Waiting for masking job", "Job", job.Name)
+		return false, nil
+	case finished.Type == batchv1.JobFailed:
+		return true, r.failMaskedSnapshot(ctx, dataProfile, snapshot,
+			fmt.Sprintf("Masking job %s failed: %s", job.Name, finished.Message))
+	}
+
+	// Stop the database before snapshotting its volume
+	pod := &corev1.Pod{}
+	err = r.Get(ctx, client.ObjectKey{Namespace: snapshot.Namespace, Name: scratchName(snapshot)}, pod)
+	if err == nil {
+		if pod.DeletionTimestamp.IsZero() {
+			if err := r.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+				return false, err
+			}
+		}
+		log.Info("Waiting for scratch database pod to stop", "Pod", pod.Name)
+		return false, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+
+	masked, err := r.createMaskedVolumeSnapshot(ctx, dataProfile, snapshot)
+	if err != nil {
+		return false, err
+	}
+	if ready, err := snapshotReady(masked); err != nil {
+		return true, r.failMaskedSnapshot(ctx, dataProfile, snapshot, err.Error())
+	} else if !ready {
+		log.Info("Waiting for masked VolumeSnapshot", "VolumeSnapshot", masked.Name)
+		return false, nil
+	}
+
+	if err := r.storeSnapshotSchema(ctx, dataProfile, masked); err != nil && !apierrors.IsAlreadyExists(err) {
+		log.Error(err, "unable to store the schema of the snapshot", "VolumeSnapshot", masked.Name)
+	}
+	if err := r.deleteScratch(ctx, snapshot); err != nil {
+		return false, err
+	}
+
+	log.Info("Masked VolumeSnapshot is ready", "VolumeSnapshot", masked.Name)
+	dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseSnapshotReady
+	dataProfile.Status.LatestMaskedSnapshot = masked.Name
+	dataProfile.Status.LastSnapshotTime = &metav1.Time{Time: time.Now()}
+	meta.SetStatusCondition(&dataProfile.Status.Conditions, metav1.Condition{
+		Type:    conditionTypeSnapshotMasked,
+		Status:  metav1.ConditionTrue,
+		Reason:  "MaskingSucceeded",
+		Message: fmt.Sprintf("VolumeSnapshot %s holds the masked data of %s", masked.Name, snapshot.Name),
+	})
+	return true, nil
+}
+
+// failMaskedSnapshot records that a snapshot could not be masked and deletes
+// it with its scratch resources.
+func (r *DataProfileReconciler) failMaskedSnapshot(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, snapshot *snapshotv1.VolumeSnapshot, message string) error {
+	log.FromContext(ctx).Info("Unable to mask VolumeSnapshot", "VolumeSnapshot", snapshot.Name, "Reason", message)
+	dataProfile.Status.Phase = vandalv1alpha1.DataProfilePhaseFailed
+	meta.SetStatusCondition(&dataProfile.Status.Conditions, metav1.Condition{
+		Type:    conditionTypeSnapshotMasked,
+		Status:  metav1.ConditionFalse,
+		Reason:  "MaskingFailed",
+		Message: message,
+	})
+	return r.deleteScratch(ctx, snapshot)
+}
+
+// deleteScratch deletes an unmasked snapshot and the resources masking it.
+func (r *DataProfileReconciler) deleteScratch(ctx context.Context, snapshot *snapshotv1.VolumeSnapshot) error {
+	objectMeta := metav1.ObjectMeta{Name: scratchName(snapshot), Namespace: snapshot.Namespace}
+	resources := []client.Object{
+		&batchv1.Job{ObjectMeta: objectMeta},
+		&corev1.Pod{ObjectMeta: objectMeta},
+		&corev1.Service{ObjectMeta: objectMeta},
+		&corev1.PersistentVolumeClaim{ObjectMeta: objectMeta},
+		snapshot,
+	}
+	for _, resource := range resources {
+		if err := r.Delete(ctx, resource, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scratchLabels returns the labels of the resources masking a snapshot.
+func scratchLabels(dataProfile *vandalv1alpha1.DataProfile, snapshot *snapshotv1.VolumeSnapshot) map[string]string {
+	return map[string]string{
+		"app":                          scratchName(snapshot),
+		"app.kubernetes.io/name":       "vandal",
+		"app.kubernetes.io/instance":   dataProfile.Name,
+		"app.kubernetes.io/created-by": "dataprofile-controller",
+	}
+}
+
+// createScratchClaim restores a snapshot to a scratch volume the size of the
+// target volume, if it does not exist yet.
+func (r *DataProfileReconciler) createScratchClaim(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, snapshot *snapshotv1.VolumeSnapshot) error {
+	var target corev1.PersistentVolumeClaim
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataProfile.Namespace, Name: dataProfile.Spec.Target.PVCName}, &target); err != nil {
+		return fmt.Errorf("reading target volume: %w", err)
+	}
+	storageClassName := target.Spec.StorageClassName
+	if dataProfile.Spec.MaskedSnapshot.StorageClassName != nil {
+		storageClassName = dataProfile.Spec.MaskedSnapshot.StorageClassName
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      scratchName(snapshot),
+			Namespace: snapshot.Namespace,
+			Labels:    scratchLabels(dataProfile, snapshot),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: storageClassName,
+			DataSource: &corev1.TypedLocalObjectReference{
+				APIGroup: &snapshotv1.SchemeGroupVersion.Group,
+				Kind:     "VolumeSnapshot",
+				Name:     snapshot.Name,
+			},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: target.Spec.Resources.Requests[corev1.ResourceStorage]},
+			},
+		},
+	}
+	if err := controllerutil.SetControllerReference(dataProfile, pvc, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, pvc); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// createScratchDatabase returns the pod running the database of the scratch
+// volume of a snapshot, creating it and its service if they do not exist yet.
+func (r *DataProfileReconciler) createScratchDatabase(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, snapshot *snapshotv1.VolumeSnapshot, engine databaseEngine) (*corev1.Pod, error) {
+	image := engine.image
+	if dataProfile.Spec.MaskedSnapshot.Image != "" {
+		image = dataProfile.Spec.MaskedSnapshot.Image
+	}
+	labels := scratchLabels(dataProfile, snapshot)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: scratchName(snapshot), Namespace: snapshot.Namespace, Labels: labels},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": scratchName(snapshot)},
+			Ports:    []corev1.ServicePort{{Port: engine.port}},
+		},
+	}
+	if err := controllerutil.SetControllerReference(dataProfile, service, r.Scheme); err != nil {
+		return nil, err
+	}
+	if err := r.Create(ctx, service); err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	pod := &corev1.Pod{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: snapshot.Namespace, Name: scratchName(snapshot)}, pod)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return pod, err
+	}
+	pod = &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: scratchName(snapshot), Namespace: snapshot.Namespace, Labels: labels},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:         engine.container,
+					Image:        image,
+					Ports:        []corev1.ContainerPort{{ContainerPort: engine.port}},
+					VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: engine.dataDir}},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "data",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: scratchName(snapshot)},
+					},
+				},
+			},
+		},
+	}
+	if err := controllerutil.SetControllerReference(dataProfile, pod, r.Scheme); err != nil {
+		return nil, err
+	}
+	if err := r.Create(ctx, pod); err != nil {
+		return nil, err
+	}
+	log.FromContext(ctx).Info("Created scratch database pod", "Pod", pod.Name)
+	return pod, nil
+}
+
+// createScratchMaskingJob creates the job masking the scratch database of a
+// snapshot in place. The database was restored from the target volume, so the
+// job connects with the credentials and TLS configuration of the target, at
+// the address of the scratch service. The server certificate of the target
+// does not name that address, so it is verified against the CA only.
+func (r *DataProfileReconciler) createScratchMaskingJob(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, snapshot *snapshotv1.VolumeSnapshot, engine databaseEngine) error {
+	env, err := maskingEnv(dataProfile)
+	if err != nil {
+		return err
+	}
+	connEnv, mounts, volumes := targetJobConnection(dataProfile, "TARGET")
+	for i := range connEnv {
+		if connEnv[i].Name == "TARGET_SSLMODE" && connEnv[i].Value == storage.TLSModeVerifyFull {
+			connEnv[i].Value = storage.TLSModeVerifyCA
+		}
+	}
+	env = append(env, connEnv...)
+	env = append(env,
+		corev1.EnvVar{Name: "TARGET_HOST", Value: scratchName(snapshot)},
+		corev1.EnvVar{Name: "TARGET_PORT", Value: strconv.Itoa(int(engine.port))},
+		corev1.EnvVar{Name: "DATABASE_CONNECT_RETRIES", Value: strconv.Itoa(restoreConnectRetries)},
+	)
+
+	backoffLimit := int32(2)
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      scratchName(snapshot),
+			Namespace: snapshot.Namespace,
+			Labels:    scratchLabels(dataProfile, snapshot),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:         "masking",
+							Image:        jobImage(r.MaskingImage),
+							Env:          env,
+							VolumeMounts: mounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+	if err := controllerutil.SetControllerReference(dataProfile, job, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("Created masking job", "Job", job.Name)
+	return nil
+}
+
+// createMaskedVolumeSnapshot returns the masked snapshot of the scratch volume
+// of a snapshot, creating it if it does not exist yet. It is controlled by
+// the profile, so that the retention policy applies to it.
+func (r *DataProfileReconciler) createMaskedVolumeSnapshot(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile, snapshot *snapshotv1.VolumeSnapshot) (*snapshotv1.VolumeSnapshot, error) {
+	masked := &snapshotv1.VolumeSnapshot{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: snapshot.Namespace, Name: maskedSnapshotName(snapshot)}, masked)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return masked, err
+	}
+
+	pvcName := scratchName(snapshot)
+	masked = &snapshotv1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      maskedSnapshotName(snapshot),
+			Namespace: snapshot.Namespace,
+			Labels: map[string]string{
+				labelSnapshotProfile: dataProfile.Name,
+				labelSnapshotMasked:  "true",
+			},
+		},
+		Spec: snapshotv1.VolumeSnapshotSpec{
+			Source: snapshotv1.VolumeSnapshotSource{
+				PersistentVolumeClaimName: &pvcName,
+			},
+			VolumeSnapshotClassName: dataProfile.Spec.MaskedSnapshot.VolumeSnapshotClassName,
+		},
+	}
+	if err := controllerutil.SetControllerReference(dataProfile, masked, r.Scheme); err != nil {
+		return nil, err
+	}
+	if err := r.Create(ctx, masked); err != nil {
+		return nil, err
+	}
+	log.FromContext(ctx).Info("Created masked VolumeSnapshot", "VolumeSnapshot", masked.Name)
+	return masked, nil
+}
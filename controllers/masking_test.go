@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+)
+
+// newFakeCloneReconciler returns a DataCloneReconciler whose client holds objs.
+func newFakeCloneReconciler(t *testing.T, objs ...client.Object) *DataCloneReconciler {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, vandalv1alpha1.AddToScheme, snapshotv1.AddToScheme} {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&vandalv1alpha1.DataClone{}, &vandalv1alpha1.DataProfile{}, &corev1.Pod{}, &batchv1.Job{}).
+		Build()
+	return &DataCloneReconciler{Client: c, Scheme: scheme}
+}
+
+// reconcileClone reconciles the clone named by key and returns it.
+func reconcileClone(t *testing.T, r *DataCloneReconciler, key client.ObjectKey) *vandalv1alpha1.DataClone {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	var dataClone vandalv1alpha1.DataClone
+	if err := r.Get(ctx, key, &dataClone); err != nil {
+		t.Fatal(err)
+	}
+	return &dataClone
+}
+
+// maskedProfile returns a profile masking the emails of its users.
+func maskedProfile() *vandalv1alpha1.DataProfile {
+	return &vandalv1alpha1.DataProfile{
+		ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "default"},
+		Spec: vandalv1alpha1.DataProfileSpec{
+			Target: vandalv1alpha1.DatabaseTarget{SecretName: "shop-db", PVCName: "shop-data"},
+			Masking: vandalv1alpha1.MaskingSpec{Rules: []vandalv1alpha1.MaskingRule{
+				{Table: "users", Column: "email", Transformation: "redact"},
+			}},
+		},
+	}
+}
+
+// startMaskingJob reconciles a new clone until its masking job is
+// created, and returns the clone and the job.
+func startMaskingJob(t *testing.T, r *DataCloneReconciler, key client.ObjectKey) (*vandalv1alpha1.DataClone, *batchv1.Job) {
+	t.Helper()
+	ctx := context.Background()
+	if dataClone := reconcileClone(t, r, key); dataClone.Status.Phase != vandalv1alpha1.DataClonePhaseMasking {
+		t.Fatalf("phase = %s, want %s while the database starts", dataClone.Status.Phase, vandalv1alpha1.DataClonePhaseMasking)
+	}
+	var job batchv1.Job
+	jobKey := client.ObjectKey{Namespace: key.Namespace, Name: key.Name + "-masking"}
+	if err := r.Get(ctx, jobKey, &job); err == nil {
+		t.Fatal("masking job created before the database runs")
+	}
+
+	var pod corev1.Pod
+	if err := r.Get(ctx, key, &pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Status.Phase = corev1.PodRunning
+	if err := r.Status().Update(ctx, &pod); err != nil {
+		t.Fatal(err)
+	}
+	dataClone := reconcileClone(t, r, key)
+	if err := r.Get(ctx, jobKey, &job); err != nil {
+		t.Fatalf("masking job not created: %v", err)
+	}
+	return dataClone, &job
+}
+
+// finishJob sets a final condition on a job.
+func finishJob(t *testing.T, r *DataCloneReconciler, job *batchv1.Job, condition batchv1.JobConditionType, message string) {
+	t.Helper()
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{Type: condition, Status: corev1.ConditionTrue, Message: message})
+	if err := r.Status().Update(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloneReadyOnceMaskingJobSucceeds(t *testing.T) {
+	dataClone := &vandalv1alpha1.DataClone{
+		ObjectMeta: metav1.ObjectMeta{Name: "shop-clone", Namespace: "default"},
+		Spec:       vandalv1alpha1.DataCloneSpec{SourceProfile: "shop", SnapshotName: "shop-snapshot"},
+	}
+	r := newFakeCloneReconciler(t, maskedProfile(), dataClone)
+	key := client.ObjectKeyFromObject(dataClone)
+
+	dataClone, job := startMaskingJob(t, r, key)
+	if dataClone.Status.Phase != vandalv1alpha1.DataClonePhaseMasking {
+		t.Errorf("phase = %s, want %s while the job runs", dataClone.Status.Phase, vandalv1alpha1.DataClonePhaseMasking)
+	}
+	if job.Spec.BackoffLimit == nil || *job.Spec.BackoffLimit != 2 {
+		t.Errorf("job backoff limit = %v, want 2", job.Spec.BackoffLimit)
+	}
+
+	finishJob(t, r, job, batchv1.JobComplete, "")
+	dataClone = reconcileClone(t, r, key)
+	if dataClone.Status.Phase != vandalv1alpha1.DataClonePhaseReady {
+		t.Errorf("phase = %s, want %s", dataClone.Status.Phase, vandalv1alpha1.DataClonePhaseReady)
+	}
+	masked := meta.FindStatusCondition(dataClone.Status.Conditions, conditionTypeMasked)
+	if masked == nil || masked.Status != metav1.ConditionTrue || masked.Reason != "MaskingSucceeded" {
+		t.Errorf("Masked condition = %+v, want MaskingSucceeded", masked)
+	}
+	if dataClone.Status.DatabaseConnection == nil {
+		t.Error("ready clone has no database connection")
+	}
+}
+
+func TestCloneFailsWithMaskingJob(t *testing.T) {
+	dataClone := &vandalv1alpha1.DataClone{
+		ObjectMeta: metav1.ObjectMeta{Name: "shop-clone", Namespace: "default"},
+		Spec:       vandalv1alpha1.DataCloneSpec{SourceProfile: "shop", SnapshotName: "shop-snapshot"},
+	}
+	r := newFakeCloneReconciler(t, maskedProfile(), dataClone)
+	key := client.ObjectKeyFromObject(dataClone)
+	_, job := startMaskingJob(t, r, key)
+
+	// The summary of the job is read from the termination log of its pod.
+	summary := `{"status":"failed","exitCode":4,"error":"masking rule references unknown table users"}`
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: job.Name + "-x7k2p", Namespace: job.Namespace, Labels: map[string]string{"job-name": job.Name}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "masking", Image: "masking"}}},
+	}
+	ctx := context.Background()
+	if err := r.Create(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:  "masking",
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 4, Message: summary}},
+	}}
+	if err := r.Status().Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	finishJob(t, r, job, batchv1.JobFailed, "Job has reached the specified backoff limit")
+
+	dataClone = reconcileClone(t, r, key)
+	if dataClone.Status.Phase != vandalv1alpha1.DataClonePhaseFailed {
+		t.Errorf("phase = %s, want %s", dataClone.Status.Phase, vandalv1alpha1.DataClonePhaseFailed)
+	}
+	masked := meta.FindStatusCondition(dataClone.Status.Conditions, conditionTypeMasked)
+	if masked == nil || masked.Status != metav1.ConditionFalse || masked.Reason != "MaskingJobFailed" {
+		t.Fatalf("Masked condition = %+v, want MaskingJobFailed", masked)
+	}
+	if !strings.Contains(masked.Message, "backoff limit") || !strings.Contains(masked.Message, summary) {
+		t.Errorf("Masked condition message = %q, want the job condition and its summary", masked.Message)
+	}
+
+	// A failed clone stays failed.
+	if dataClone = reconcileClone(t, r, key); dataClone.Status.Phase != vandalv1alpha1.DataClonePhaseFailed {
+		t.Errorf("phase = %s after another reconcile, want %s", dataClone.Status.Phase, vandalv1alpha1.DataClonePhaseFailed)
+	}
+}
+
+func TestCloneOfMaskedSnapshots(t *testing.T) {
+	snapshot := func(name string, labels map[string]string) *snapshotv1.VolumeSnapshot {
+		return &snapshotv1.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels}}
+	}
+	masked := map[string]string{labelSnapshotProfile: "shop", labelSnapshotMasked: "true"}
+
+	for _, tt := range []struct {
+		name       string
+		snapshot   string
+		wantPhase  string
+		wantReason string
+	}{
+		{name: "unmasked snapshot", snapshot: "shop-raw", wantPhase: vandalv1alpha1.DataClonePhaseFailed, wantReason: "SnapshotNotMasked"},
+		{name: "masked snapshot of another profile", snapshot: "other-masked", wantPhase: vandalv1alpha1.DataClonePhaseFailed, wantReason: "SnapshotNotMasked"},
+		{name: "missing snapshot", snapshot: "shop-missing", wantPhase: vandalv1alpha1.DataClonePhaseFailed, wantReason: "SnapshotNotMasked"},
+		{name: "masked snapshot", snapshot: "shop-masked", wantPhase: vandalv1alpha1.DataClonePhaseMasking},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := maskedProfile()
+			profile.Spec.MaskedSnapshot = &vandalv1alpha1.MaskedSnapshotSpec{}
+			dataClone := &vandalv1alpha1.DataClone{
+				ObjectMeta: metav1.ObjectMeta{Name: "shop-clone", Namespace: "default"},
+				Spec:       vandalv1alpha1.DataCloneSpec{SourceProfile: "shop", SnapshotName: tt.snapshot},
+			}
+			r := newFakeCloneReconciler(t, profile, dataClone,
+				snapshot("shop-raw", map[string]string{labelSnapshotProfile: "shop"}),
+				snapshot("other-masked", map[string]string{labelSnapshotProfile: "other", labelSnapshotMasked: "true"}),
+				snapshot("shop-masked", masked),
+			)
+			key := client.ObjectKeyFromObject(dataClone)
+
+			dataClone = reconcileClone(t, r, key)
+			if dataClone.Status.Phase != tt.wantPhase {
+				t.Errorf("phase = %s, want %s", dataClone.Status.Phase, tt.wantPhase)
+			}
+			var pvc corev1.PersistentVolumeClaim
+			err := r.Get(context.Background(), key, &pvc)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("volume of the clone not created: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("volume of the clone created from %s", tt.snapshot)
+			}
+			condition := meta.FindStatusCondition(dataClone.Status.Conditions, conditionTypeMasked)
+			if condition == nil || condition.Reason != tt.wantReason {
+				t.Errorf("Masked condition = %+v, want %s", condition, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestCloneOfMaskedSnapshotSkipsMasking(t *testing.T) {
+	profile := maskedProfile()
+	profile.Spec.MaskedSnapshot = &vandalv1alpha1.MaskedSnapshotSpec{}
+	profile.Status.LatestMaskedSnapshot = "shop-masked"
+	dataClone := &vandalv1alpha1.DataClone{
+		ObjectMeta: metav1.ObjectMeta{Name: "shop-clone", Namespace: "default"},
+		Spec:       vandalv1alpha1.DataCloneSpec{SourceProfile: "shop"},
+	}
+	r := newFakeCloneReconciler(t, profile, dataClone, &snapshotv1.VolumeSnapshot{ObjectMeta: metav1.ObjectMeta{
+		Name: "shop-masked", Namespace: "default",
+		Labels: map[string]string{labelSnapshotProfile: "shop", labelSnapshotMasked: "true"},
+	}})
+	key := client.ObjectKeyFromObject(dataClone)
+	ctx := context.Background()
+
+	// The clone is restored from the latest masked snapshot by default.
+	reconcileClone(t, r, key)
+	var pvc corev1.PersistentVolumeClaim
+	if err := r.Get(ctx, key, &pvc); err != nil {
+		t.Fatal(err)
+	}
+	if pvc.Spec.DataSource == nil || pvc.Spec.DataSource.Name != "shop-masked" {
+		t.Errorf("volume data source = %+v, want VolumeSnapshot shop-masked", pvc.Spec.DataSource)
+	}
+
+	var pod corev1.Pod
+	if err := r.Get(ctx, key, &pod); err != nil {
+		t.Fatal(err)
+	}
+	pod.Status.Phase = corev1.PodRunning
+	if err := r.Status().Update(ctx, &pod); err != nil {
+		t.Fatal(err)
+	}
+	dataClone = reconcileClone(t, r, key)
+	if dataClone.Status.Phase != vandalv1alpha1.DataClonePhaseReady {
+		t.Errorf("phase = %s, want %s", dataClone.Status.Phase, vandalv1alpha1.DataClonePhaseReady)
+	}
+	if condition := meta.FindStatusCondition(dataClone.Status.Conditions, conditionTypeMasked); condition == nil || condition.Reason != "MaskedSnapshot" {
+		t.Errorf("Masked condition = %+v, want MaskedSnapshot", condition)
+	}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: key.Namespace, Name: maskingJobName(dataClone)}, &batchv1.Job{}); err == nil {
+		t.Error("masking job created for a clone of a masked snapshot")
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/robfig/cron/v3"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+)
+
+// scheduledSnapshot is the cron entry taking the snapshots of a DataProfile.
+type scheduledSnapshot struct {
+	id       cron.EntryID
+	schedule string
+}
+
+// scheduleSnapshots adds the cron entry taking the snapshots of a profile, or
+// replaces it when the schedule changed. Cron entry IDs are assigned by the
+// scheduler, so the entry of every profile is tracked by the UID of the
+// profile. The entry reads the profile again when it fires, so that it always
+// snapshots its current version, and runs with a context of its own: the
+// context of the reconcile that scheduled it is cancelled once the reconcile
+// returns.
+func (r *DataProfileReconciler) scheduleSnapshots(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) error {
+	if dataProfile.Spec.Schedule == "" {
+		return nil
+	}
+	logger := log.FromContext(ctx)
+
+	r.mu.Lock()
+	scheduled, ok := r.schedules[dataProfile.UID]
+	r.mu.Unlock()
+	if ok && scheduled.schedule == dataProfile.Spec.Schedule {
+		return nil
+	}
+	if ok {
+		r.Cron.Remove(scheduled.id)
+	}
+
+	key := client.ObjectKeyFromObject(dataProfile)
+	id, err := r.Cron.AddFunc(dataProfile.Spec.Schedule, func() {
+		logger.Info("Triggering snapshot for DataProfile", "Name", key.Name)
+		ctx := log.IntoContext(context.Background(), logger)
+		if err := r.takeSnapshot(ctx, key); err != nil {
+			logger.Error(err, "failed to take snapshot", "DataProfile", key.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.schedules == nil {
+		r.schedules = make(map[types.UID]scheduledSnapshot)
+	}
+	r.schedules[dataProfile.UID] = scheduledSnapshot{id: id, schedule: dataProfile.Spec.Schedule}
+	r.mu.Unlock()
+	logger.Info("Scheduled cron job", "EntryID", id)
+	return nil
+}
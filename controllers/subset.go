@@ -0,0 +1,86 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+)
+
+// defaultSubsetSize is the size of the volumes of the clones a subset is
+// copied into when the subset sets none.
+const defaultSubsetSize = "10Gi"
+
+// copiesSubset reports whether the clones of a profile are built by copying a
+// subset of the rows of its target into an empty database. Profiles that take
+// dumps subset them instead, and subsetting does not apply to masked
+// snapshots.
+func copiesSubset(dataProfile *vandalv1alpha1.DataProfile) bool {
+	return dataProfile.Spec.Subset != nil && dataProfile.Spec.Dump == nil && dataProfile.Spec.MaskedSnapshot == nil
+}
+
+// subsetSize returns the size of the volumes of the clones a subset is copied
+// into.
+func subsetSize(spec *vandalv1alpha1.SubsetSpec) resource.Quantity {
+	if spec.Size != nil {
+		return *spec.Size
+	}
+	return resource.MustParse(defaultSubsetSize)
+}
+
+// subsetEnv returns the environment restricting the masking job to a subset
+// of the rows.
+func subsetEnv(spec *vandalv1alpha1.SubsetSpec) (corev1.EnvVar, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return corev1.EnvVar{}, err
+	}
+	return corev1.EnvVar{Name: "SUBSET", Value: string(data)}, nil
+}
+
+// subsetProfile returns the source profile of a clone if a subset of its
+// target is copied into its clones, or nil otherwise or if it does not exist.
+func (r *DataCloneReconciler) subsetProfile(ctx context.Context, dataClone *vandalv1alpha1.DataClone) (*vandalv1alpha1.DataProfile, error) {
+	var dataProfile vandalv1alpha1.DataProfile
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dataClone.Namespace, Name: dataClone.Spec.SourceProfile}, &dataProfile); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	if !copiesSubset(&dataProfile) {
+		return nil, nil
+	}
+	return &dataProfile, nil
+}
+
+// subsetJobEnv returns the environment, volume mounts and volumes making the
+// masking job of a clone copy the subset of its profile from the target of
+// the profile, rather than mask the clone in place.
+func subsetJobEnv(dataProfile *vandalv1alpha1.DataProfile) ([]corev1.EnvVar, []corev1.VolumeMount, []corev1.Volume, error) {
+	subset, err := subsetEnv(dataProfile.Spec.Subset)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	env, mounts, volumes := targetJobConnection(dataProfile, "SOURCE")
+	env = append(env, subset, corev1.EnvVar{Name: "DATABASE_CONNECT_RETRIES", Value: strconv.Itoa(restoreConnectRetries)})
+	return env, mounts, volumes, nil
+}
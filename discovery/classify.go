@@ -0,0 +1,210 @@
+package discovery
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/Oridak771/Vandal/schema"
+)
+
+// Category is a kind of sensitive data.
+type Category string
+
+const (
+	CategoryEmail      Category = "email"
+	CategoryPhone      Category = "phone"
+	CategoryName       Category = "name"
+	CategoryCreditCard Category = "creditCard"
+	CategoryIPAddress  Category = "ipAddress"
+	CategoryNationalID Category = "nationalID"
+	CategoryFreeText   Category = "freeText"
+)
+
+// namePatterns match column names that suggest a category. They are tried in
+// order, so more specific patterns come first.
+var namePatterns = []struct {
+	category Category
+	pattern  *regexp.Regexp
+}{
+	{CategoryEmail, regexp.MustCompile(`e_?mail`)},
+	{CategoryCreditCard, regexp.MustCompile(`credit_?card|card_?(number|num|no)$|^pan$|^cc_?(number|num|no)$`)},
+	{CategoryNationalID, regexp.MustCompile(`(^|_)(ssn|sin|nin|tin)$|social_?security|national_?id|passport|tax_?id|driver_?licen[cs]e`)},
+	{CategoryPhone, regexp.MustCompile(`phone|mobile|(^|_)(cell|fax|msisdn|tel)$`)},
+	{CategoryIPAddress, regexp.MustCompile(`(^|_)ip(_?addr(ess)?)?$|ip_?address`)},
+	{CategoryName, regexp.MustCompile(`^(first|last|middle|full|given|family|sur|maiden|display|customer|user|person|contact|employee)_?name$|^name$`)},
+	{CategoryFreeText, regexp.MustCompile(`(^|_)(notes?|comments?|remarks|bio|message|description)$`)},
+}
+
+var (
+	emailValue = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phoneValue = regexp.MustCompile(`^\+?[0-9][0-9 ().-]{5,18}[0-9]$`)
+	ssnValue   = regexp.MustCompile(`^[0-9]{3}-[0-9]{2}-[0-9]{4}$`)
+)
+
+// matchThreshold is the fraction of sampled values that must match a content
+// pattern for a column to be classified by it.
+const matchThreshold = 0.8
+
+// freeTextLength is the average length from which values with spaces are
+// considered free text.
+const freeTextLength = 40
+
+// Classify returns the category of sensitive data a column holds, judged from
+// its name and a sample of its values, and whether it holds any at all. A
+// name only classifies a column whose type can hold data of the category, so
+// that a boolean email_verified column is not taken for an email address.
+func Classify(column schema.Column, samples []string) (Category, bool) {
+	name := strings.ToLower(column.Name)
+	for _, p := range namePatterns {
+		if p.pattern.MatchString(name) && holdsCategory(column.Type, p.category) {
+			return p.category, true
+		}
+	}
+
+	// Values of numeric, date and other non-text columns are not inspected, as
+	// identifiers and amounts would be mistaken for phone or card numbers.
+	if !isTextType(column.Type) {
+		return "", false
+	}
+	var values []string
+	for _, v := range samples {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return "", false
+	}
+
+	switch {
+	case matches(values, emailValue.MatchString):
+		return CategoryEmail, true
+	case matches(values, isCreditCard):
+		return CategoryCreditCard, true
+	case matches(values, ssnValue.MatchString):
+		return CategoryNationalID, true
+	case matches(values, func(v string) bool { return net.ParseIP(v) != nil }):
+		return CategoryIPAddress, true
+	case matches(values, isPhone):
+		return CategoryPhone, true
+	case isFreeText(values):
+		return CategoryFreeText, true
+	}
+	return "", false
+}
+
+// baseType returns the lower-case name of a column type without its
+// modifiers, e.g. "character varying" for "character varying(20)".
+func baseType(sqlType string) string {
+	t := strings.ToLower(strings.TrimSpace(sqlType))
+	if i := strings.IndexByte(t, '('); i >= 0 {
+		t = strings.TrimSpace(t[:i])
+	}
+	return t
+}
+
+// holdsCategory reports whether a column of a type can hold data of a
+// category. Text holds any category; phone, card and national ID numbers may
+// also be stored as integers or decimals, and IP addresses with a network
+// address type.
+func holdsCategory(sqlType string, category Category) bool {
+	if isTextType(sqlType) {
+		return true
+	}
+	switch baseType(sqlType) {
+	case "smallint", "integer", "bigint", "int", "int2", "int4", "int8", "numeric", "decimal":
+		return category == CategoryPhone || category == CategoryCreditCard || category == CategoryNationalID
+	case "inet", "cidr":
+		return category == CategoryIPAddress
+	}
+	return false
+}
+
+// isIntegerType reports whether a column type holds integers.
+func isIntegerType(sqlType string) bool {
+	switch baseType(sqlType) {
+	case "smallint", "integer", "bigint", "int", "int2", "int4", "int8", "smallserial", "serial", "bigserial",
+		"tinyint", "mediumint":
+		return true
+	}
+	return false
+}
+
+// isTextType reports whether a column type holds text. An unknown type is
+// treated as text.
+func isTextType(sqlType string) bool {
+	switch baseType(sqlType) {
+	case "", "text", "character varying", "varchar", "character", "char", "bpchar", "citext",
+		"tinytext", "mediumtext", "longtext":
+		return true
+	}
+	return false
+}
+
+// matches reports whether at least matchThreshold of values satisfy match.
+func matches(values []string, match func(string) bool) bool {
+	n := 0
+	for _, v := range values {
+		if match(v) {
+			n++
+		}
+	}
+	return float64(n) >= matchThreshold*float64(len(values))
+}
+
+// isCreditCard reports whether v is a 13 to 19 digit number, optionally
+// grouped with spaces or dashes, with a valid Luhn check digit.
+func isCreditCard(v string) bool {
+	var digits []int
+	for _, r := range v {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, int(r-'0'))
+		case r == ' ' || r == '-':
+		default:
+			return false
+		}
+	}
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+
+	sum := 0
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// isPhone reports whether v looks like a phone number: digits with the
+// separators or international prefix phone numbers are written with.
+func isPhone(v string) bool {
+	if !phoneValue.MatchString(v) || !strings.ContainsAny(v, "+ ()-.") {
+		return false
+	}
+	digits := 0
+	for _, r := range v {
+		if unicode.IsDigit(r) {
+			digits++
+		}
+	}
+	return digits >= 7 && digits <= 15
+}
+
+// isFreeText reports whether values look like prose, which may mention
+// anything.
+func isFreeText(values []string) bool {
+	total := 0
+	for _, v := range values {
+		total += len(v)
+	}
+	return total/len(values) >= freeTextLength && matches(values, func(v string) bool { return strings.Contains(v, " ") })
+}
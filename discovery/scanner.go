@@ -0,0 +1,132 @@
+// Package discovery finds columns holding sensitive data and suggests masking
+// rules for them.
+package discovery
+
+import (
+	"fmt"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/schema"
+)
+
+// DefaultSampleSize is the number of rows sampled from every table.
+const DefaultSampleSize = 100
+
+// Sampler returns up to limit values of every column of a table, keyed by
+// column name.
+type Sampler func(table *schema.Table, limit int) (map[string][]string, error)
+
+// Finding is a column found to hold sensitive data.
+type Finding struct {
+	// Table is the qualified name of the table.
+	Table    string
+	Column   string
+	Category Category
+	// Masked reports whether a masking rule covers the column, either directly
+	// or through the column a foreign key references. A passthrough rule
+	// does not mask the column.
+	Masked bool
+	// Rule is the suggested masking rule for the column.
+	Rule vandalv1alpha1.MaskingRule
+}
+
+// Scan classifies every column of s from its name and values sampled with
+// sample, and returns the columns holding sensitive data, in schema order.
+// rules are the masking rules already in place. sample may be nil to classify
+// by column names only.
+func Scan(s *schema.Schema, sample Sampler, sampleSize int, rules []vandalv1alpha1.MaskingRule) ([]Finding, error) {
+	// Rules may name tables qualified or not; they are matched by the
+	// qualified name of the table they resolve to.
+	qualified := func(name string) string {
+		if table := s.Table(name); table != nil {
+			return table.QualifiedName()
+		}
+		return name
+	}
+	masked := make(map[string]bool)
+	for _, rule := range rules {
+		// Columns marked passthrough are copied in cleartext, on purpose or
+		// not, so they are still reported.
+		if rule.Transformation == "passthrough" {
+			continue
+		}
+		masked[qualified(rule.Table)+"."+rule.Column] = true
+	}
+	isMasked := func(table string, column schema.Column) bool {
+		if masked[table+"."+column.Name] {
+			return true
+		}
+		return column.IsForeignKey && masked[qualified(column.ForeignKeyQualifiedTable())+"."+column.ForeignKeyColumn]
+	}
+
+	var findings []Finding
+	for i := range s.Tables {
+		table := &s.Tables[i]
+		name := table.QualifiedName()
+		var samples map[string][]string
+		if sample != nil && sampleSize > 0 {
+			var err error
+			if samples, err = sample(table, sampleSize); err != nil {
+				return nil, fmt.Errorf("sampling table %s: %w", name, err)
+			}
+		}
+
+		for _, column := range table.Columns {
+			category, ok := Classify(column, samples[column.Name])
+			if !ok {
+				continue
+			}
+			findings = append(findings, Finding{
+				Table:    name,
+				Column:   column.Name,
+				Category: category,
+				Masked:   isMasked(name, column),
+				Rule:     SuggestRule(table, column, category),
+			})
+		}
+	}
+	return findings, nil
+}
+
+// SuggestRule returns a masking rule for a column of a table holding data of
+// a category. Keys are hashed, so that masked rows keep referencing each
+// other, and so are unique columns, such as the email address of a user,
+// which a rule mapping different values to the same one would break. Hashes
+// of integers are reduced to the range of their column and collide, so
+// integer keys are encrypted with fpe instead, which needs a masking key.
+// Columns of types only NULL can safely replace are cleared.
+func SuggestRule(table *schema.Table, column schema.Column, category Category) vandalv1alpha1.MaskingRule {
+	rule := vandalv1alpha1.MaskingRule{Table: table.QualifiedName(), Column: column.Name}
+	key := column.IsPrimaryKey || column.IsForeignKey || table.IsUnique(column.Name)
+	switch {
+	case key && isIntegerType(column.Type):
+		rule.Transformation = "fpe"
+	case key:
+		rule.Transformation = "hash"
+	case !isTextType(column.Type) && column.IsNullable:
+		rule.Transformation = "null"
+	case category == CategoryName:
+		rule.Transformation = "name"
+	case category == CategoryCreditCard:
+		rule.Transformation = "creditCard"
+	case category == CategoryNationalID:
+		rule.Transformation = "redact"
+		rule.Params = &vandalv1alpha1.TransformationParams{KeepLast: 4}
+	case category == CategoryFreeText:
+		rule.Transformation = "redact"
+	default:
+		rule.Transformation = "synthesize"
+	}
+	return rule
+}
+
+// Unmasked returns the findings no masking rule covers.
+func Unmasked(findings []Finding) []Finding {
+	var unmasked []Finding
+	for _, f := range findings {
+		if !f.Masked {
+			unmasked = append(unmasked, f)
+		}
+	}
+	return unmasked
+}
@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"testing"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/schema"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		column  schema.Column
+		samples []string
+		want    Category
+	}{
+		{schema.Column{Name: "email_address", Type: "text"}, nil, CategoryEmail},
+		{schema.Column{Name: "last_name", Type: "text"}, nil, CategoryName},
+		{schema.Column{Name: "ssn", Type: "text"}, nil, CategoryNationalID},
+		{schema.Column{Name: "contact", Type: "text"}, []string{"a@example.com", "b@example.org"}, CategoryEmail},
+		{schema.Column{Name: "card", Type: "character varying"}, []string{"4111 1111 1111 1111", "5500-0000-0000-0004"}, CategoryCreditCard},
+		{schema.Column{Name: "origin", Type: "text"}, []string{"10.0.0.1", "2001:db8::1"}, CategoryIPAddress},
+		{schema.Column{Name: "contact", Type: "text"}, []string{"+1 (555) 123-4567", "555-987-6543"}, CategoryPhone},
+		{schema.Column{Name: "ref", Type: "text"}, []string{"123-45-6789"}, CategoryNationalID},
+		{schema.Column{Name: "body", Type: "text"}, []string{"The customer called twice about the delayed order and asked for a refund."}, CategoryFreeText},
+	} {
+		got, ok := Classify(tc.column, tc.samples)
+		if !ok || got != tc.want {
+			t.Errorf("Classify(%s, %q) = %q, %v, want %q", tc.column.Name, tc.samples, got, ok, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		column  schema.Column
+		samples []string
+	}{
+		{schema.Column{Name: "id", Type: "bigint"}, []string{"4111111111111111"}},
+		{schema.Column{Name: "status", Type: "text"}, []string{"active", "closed"}},
+		{schema.Column{Name: "table_name", Type: "text"}, []string{"users"}},
+		{schema.Column{Name: "email_verified", Type: "boolean"}, []string{"true"}},
+		{schema.Column{Name: "phone_confirmed_at", Type: "timestamp with time zone"}, nil},
+	} {
+		if got, ok := Classify(tc.column, tc.samples); ok {
+			t.Errorf("Classify(%s, %q) = %q, want no category", tc.column.Name, tc.samples, got)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{
+		{Name: "users", Columns: []schema.Column{
+			{Name: "id", Type: "integer", IsPrimaryKey: true},
+			{Name: "email", Type: "text"},
+			{Name: "phone", Type: "text"},
+			{Name: "notes", Type: "text"},
+		}},
+		{Name: "orders", Columns: []schema.Column{
+			{Name: "customer_email", Type: "text", IsForeignKey: true, ForeignKeyTable: "users", ForeignKeyColumn: "email"},
+		}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{
+		{Table: "users", Column: "email", Transformation: "hash"},
+		{Table: "users", Column: "phone", Transformation: "passthrough"},
+	}
+	sample := func(table *schema.Table, limit int) (map[string][]string, error) {
+		return map[string][]string{"notes": {"short"}}, nil
+	}
+
+	findings, err := Scan(s, sample, 10, rules)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if len(findings) != 4 {
+		t.Fatalf("Scan() = %v, want 4 findings", findings)
+	}
+
+	unmasked := Unmasked(findings)
+	if len(unmasked) != 2 || unmasked[0].Column != "phone" || unmasked[1].Column != "notes" {
+		t.Fatalf("Unmasked() = %v, want phone and notes", unmasked)
+	}
+	if unmasked[0].Rule.Transformation != "synthesize" || unmasked[1].Rule.Transformation != "redact" {
+		t.Errorf("suggested rules = %+v, %+v", unmasked[0].Rule, unmasked[1].Rule)
+	}
+}
+
+func TestSuggestRuleUniqueColumn(t *testing.T) {
+	table := &schema.Table{
+		Name:        "users",
+		Columns:     []schema.Column{{Name: "email", Type: "text"}, {Name: "phone", Type: "text"}},
+		Constraints: []schema.Constraint{{Name: "users_email_key", Type: schema.ConstraintUnique, Columns: []string{"email"}}},
+	}
+	if rule := SuggestRule(table, table.Columns[0], CategoryEmail); rule.Transformation != "hash" {
+		t.Errorf("SuggestRule(unique email) = %+v, want hash", rule)
+	}
+	if rule := SuggestRule(table, table.Columns[1], CategoryPhone); rule.Transformation != "synthesize" {
+		t.Errorf("SuggestRule(phone) = %+v, want synthesize", rule)
+	}
+
+	table = &schema.Table{Name: "citizens", Columns: []schema.Column{{Name: "ssn", Type: "bigint", IsPrimaryKey: true}}}
+	if rule := SuggestRule(table, table.Columns[0], CategoryNationalID); rule.Transformation != "fpe" {
+		t.Errorf("SuggestRule(integer key) = %+v, want fpe", rule)
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	"github.com/robfig/cron/v3"
 
 	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
@@ -49,7 +50,6 @@ func init() {
 	utilruntime.Must(vandalv1alpha1.AddToScheme(scheme))
 
 	// Add snapshot API to scheme
-	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	utilruntime.Must(snapshotv1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
@@ -58,11 +58,14 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maskingImage string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&maskingImage, "masking-image", "vandal-masking-job:latest",
+		"The image of the masking job run against new clones.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -94,13 +97,15 @@ func main() {
 		Scheme:          mgr.GetScheme(),
 		Cron:            c,
 		StorageProvider: storageProvider,
+		MaskingImage:    maskingImage,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DataProfile")
 		os.Exit(1)
 	}
 	if err = (&controllers.DataCloneReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:       mgr.GetClient(),
+		Scheme:       mgr.GetScheme(),
+		MaskingImage: maskingImage,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DataClone")
 		os.Exit(1)
@@ -0,0 +1,186 @@
+package masking
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Oridak771/Vandal/schema"
+)
+
+// typeClass groups SQL column types by the text values they accept.
+type typeClass int
+
+const (
+	// classAny is used for columns of unknown type, whose values are not
+	// adapted or checked.
+	classAny typeClass = iota
+	classText
+	classDate
+	classTimestamp
+	classTimestampTZ
+	classInteger
+	classNumeric
+	classUUID
+	classBoolean
+	// classEnum is used for columns of an enumerated type.
+	classEnum
+	classOther
+)
+
+// classifyType returns the class of a PostgreSQL type name as reported by
+// information_schema or format_type, e.g. "character varying(20)", or of a
+// MySQL data type.
+func classifyType(sqlType string) typeClass {
+	t := strings.ToLower(strings.TrimSpace(sqlType))
+	if i := strings.IndexByte(t, '('); i >= 0 {
+		t = strings.TrimSpace(t[:i])
+	}
+	switch t {
+	case "":
+		return classAny
+	case "text", "character varying", "varchar", "character", "char", "bpchar", "citext",
+		"tinytext", "mediumtext", "longtext":
+		return classText
+	case "date":
+		return classDate
+	case "timestamp", "timestamp without time zone", "datetime":
+		return classTimestamp
+	case "timestamptz", "timestamp with time zone":
+		return classTimestampTZ
+	case "smallint", "integer", "bigint", "int", "int2", "int4", "int8", "smallserial", "serial", "bigserial",
+		"tinyint", "mediumint":
+		return classInteger
+	case "numeric", "decimal", "real", "double precision", "float4", "float8", "double", "float":
+		return classNumeric
+	case "uuid":
+		return classUUID
+	case "boolean", "bool":
+		return classBoolean
+	}
+	return classOther
+}
+
+// integerMax returns the largest value of an integer type.
+func integerMax(sqlType string) uint64 {
+	switch t := strings.ToLower(strings.TrimSpace(sqlType)); t {
+	case "tinyint":
+		return 1<<7 - 1
+	case "smallint", "int2", "smallserial":
+		return 1<<15 - 1
+	case "mediumint":
+		return 1<<23 - 1
+	case "integer", "int", "int4", "serial":
+		return 1<<31 - 1
+	}
+	return 1<<63 - 1
+}
+
+// columnLength returns the maximum number of characters of a column, or 0 if
+// it is unbounded. The length is taken from MaxLength or, failing that, from a
+// type modifier such as "varchar(20)".
+func columnLength(column *schema.Column) int {
+	if column.MaxLength > 0 {
+		return column.MaxLength
+	}
+	open, end := strings.IndexByte(column.Type, '('), strings.IndexByte(column.Type, ')')
+	if open < 0 || end < open {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(column.Type[open+1 : end]))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// acceptedClasses lists the column type classes every transformation can
+// produce valid values for. "null" is accepted by every nullable column and
+// "passthrough" by every column.
+var acceptedClasses = map[string][]typeClass{
+	"hash":       {classText, classInteger, classUUID},
+	"redact":     {classText},
+	"synthesize": {classText, classInteger, classNumeric, classDate, classTimestamp, classTimestampTZ, classUUID, classBoolean, classEnum},
+	"creditCard": {classText},
+	"name":       {classText},
+	"address":    {classText},
+	"dateTime":   {classText, classDate, classTimestamp, classTimestampTZ},
+	"dateShift":  {classText, classDate, classTimestamp, classTimestampTZ},
+	"truncate":   {classText},
+	"fpe":        {classText, classInteger},
+}
+
+// forColumn adapts the transformer of a masking rule to the type, length and
+// nullability of the column it masks, so that every value it produces can be
+// restored into the column. It returns an error if the transformation cannot
+// produce valid values for the column.
+func forColumn(t Transformer, transformation string, table string, column *schema.Column) (Transformer, error) {
+	class := classifyType(column.Type)
+	if len(column.EnumValues) > 0 {
+		class = classEnum
+	}
+	if transformation == "null" {
+		if !column.IsNullable {
+			return nil, fmt.Errorf("transformation %q cannot be applied to column %s.%s, it is NOT NULL", transformation, table, column.Name)
+		}
+		return t, nil
+	}
+	if class == classAny || transformation == "passthrough" {
+		return withColumnType(t, class, column), nil
+	}
+
+	accepted := false
+	for _, c := range acceptedClasses[transformation] {
+		accepted = accepted || c == class
+	}
+	if !accepted {
+		return nil, fmt.Errorf("transformation %q cannot be applied to column %s.%s of type %s", transformation, table, column.Name, column.Type)
+	}
+
+	t = withColumnType(t, class, column)
+	if length := columnLength(column); class == classText && length > 0 {
+		t = &truncateTransformer{Transformer: t, maxLength: length}
+	}
+	return t, nil
+}
+
+// withColumnType returns a copy of t that formats its output for a column of
+// the given class.
+func withColumnType(t Transformer, class typeClass, column *schema.Column) Transformer {
+	switch t := t.(type) {
+	case *truncateTransformer:
+		return &truncateTransformer{Transformer: withColumnType(t.Transformer, class, column), maxLength: t.maxLength}
+	case *hashTransformer:
+		typed := *t
+		switch class {
+		case classInteger:
+			typed.format, typed.max = hashInteger, integerMax(column.Type)
+		case classUUID:
+			typed.format = hashUUID
+		}
+		return &typed
+	case *fpeTransformer:
+		typed := *t
+		if class == classInteger {
+			typed.max = integerMax(column.Type)
+		}
+		return &typed
+	case *dateTimeTransformer:
+		typed := *t
+		switch class {
+		case classDate:
+			typed.layout = "2006-01-02"
+		case classTimestamp:
+			typed.layout = "2006-01-02 15:04:05"
+		default:
+			typed.layout = time.RFC3339
+		}
+		return &typed
+	case *synthesizeTransformer:
+		typed := *t
+		typed.column, typed.class = column, class
+		return &typed
+	}
+	return t
+}
@@ -0,0 +1,165 @@
+package masking
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/schema"
+)
+
+func TestForColumnFormatsOutput(t *testing.T) {
+	for _, tc := range []struct {
+		transformation string
+		column         schema.Column
+		want           *regexp.Regexp
+	}{
+		{"dateTime", schema.Column{Name: "born", Type: "date"}, regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)},
+		{"dateTime", schema.Column{Name: "seen", Type: "timestamp without time zone"}, regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}$`)},
+		{"hash", schema.Column{Name: "code", Type: "character varying", MaxLength: 20}, regexp.MustCompile(`^[0-9a-f]{20}$`)},
+		{"hash", schema.Column{Name: "ref", Type: "uuid"}, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)},
+		{"name", schema.Column{Name: "name", Type: "varchar(3)"}, regexp.MustCompile(`^.{1,3}$`)},
+	} {
+		tr, err := NewKeyedTransformer(tc.transformation, nil, []byte("key"))
+		if err != nil {
+			t.Fatalf("NewKeyedTransformer(%s) error = %v", tc.transformation, err)
+		}
+		tr, err = forColumn(tr, tc.transformation, "t", &tc.column)
+		if err != nil {
+			t.Fatalf("forColumn(%s, %s) error = %v", tc.transformation, tc.column.Type, err)
+		}
+		got, err := tr.Transform("Alice Smith")
+		if err != nil {
+			t.Fatalf("%s: Transform() error = %v", tc.transformation, err)
+		}
+		if !tc.want.MatchString(got) {
+			t.Errorf("%s on %s = %q, want a match of %s", tc.transformation, tc.column.Type, got, tc.want)
+		}
+	}
+
+	tr, _ := NewTransformer("hash", nil)
+	tr, err := forColumn(tr, "hash", "t", &schema.Column{Name: "id", Type: "smallint"})
+	if err != nil {
+		t.Fatalf("forColumn() error = %v", err)
+	}
+	got, _ := tr.Transform("42")
+	if n, err := strconv.ParseInt(got, 10, 16); err != nil || n <= 0 {
+		t.Errorf("hash on smallint = %q, want a positive smallint", got)
+	}
+}
+
+func TestForColumnRejectsIncompatibleRules(t *testing.T) {
+	for _, tc := range []struct {
+		transformation string
+		column         schema.Column
+	}{
+		{"null", schema.Column{Name: "email", Type: "text"}},
+		{"redact", schema.Column{Name: "age", Type: "integer", IsNullable: true}},
+		{"dateTime", schema.Column{Name: "count", Type: "bigint"}},
+		{"name", schema.Column{Name: "doc", Type: "jsonb"}},
+	} {
+		tr, err := NewTransformer(tc.transformation, nil)
+		if err != nil {
+			t.Fatalf("NewTransformer(%s) error = %v", tc.transformation, err)
+		}
+		if _, err := forColumn(tr, tc.transformation, "t", &tc.column); err == nil {
+			t.Errorf("forColumn(%s, %s) succeeded, want an error", tc.transformation, tc.column.Type)
+		}
+	}
+}
+
+func TestFPEKeepsIntegersInRange(t *testing.T) {
+	tr, err := NewKeyedTransformer("fpe", nil, []byte("key"))
+	if err != nil {
+		t.Fatalf("NewKeyedTransformer(fpe) error = %v", err)
+	}
+	integer, err := forColumn(tr, "fpe", "t", &schema.Column{Name: "id", Type: "integer"})
+	if err != nil {
+		t.Fatalf("forColumn(fpe, integer) error = %v", err)
+	}
+	for _, v := range []string{"2147483647", "2147483646", "2147400000", "1999999999", "999999999", "-2147483648", "10", "7", "0"} {
+		got, err := integer.Transform(v)
+		if err != nil {
+			t.Fatalf("Transform(%s) error = %v", v, err)
+		}
+		if n, err := strconv.ParseInt(got, 10, 32); err != nil || len(got) != len(v) || strconv.FormatInt(n, 10) != got {
+			t.Errorf("fpe on integer %s = %q, want an integer of the same width in range", v, got)
+		}
+	}
+	if _, err := integer.Transform("2147483648"); err == nil {
+		t.Error("Transform() accepted a value out of the range of the column")
+	}
+
+	// Every value of a smallint column is masked to a different one.
+	smallint, err := forColumn(tr, "fpe", "t", &schema.Column{Name: "id", Type: "smallint"})
+	if err != nil {
+		t.Fatalf("forColumn(fpe, smallint) error = %v", err)
+	}
+	seen := make(map[string]bool)
+	for i := 10000; i <= 32767; i++ {
+		got, err := smallint.Transform(strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("Transform(%d) error = %v", i, err)
+		}
+		if n, err := strconv.ParseInt(got, 10, 16); err != nil || n < 10000 {
+			t.Fatalf("fpe on smallint %d = %q, want a 5-digit smallint", i, got)
+		}
+		if seen[got] {
+			t.Fatalf("fpe on smallint masked two values to %s", got)
+		}
+		seen[got] = true
+	}
+
+	if _, err := forColumn(tr, "fpe", "t", &schema.Column{Name: "price", Type: "numeric(10,2)"}); err == nil {
+		t.Error("forColumn(fpe, numeric) succeeded, want an error")
+	}
+}
+
+func TestSynthesizeByColumn(t *testing.T) {
+	for _, tc := range []struct {
+		column schema.Column
+		want   *regexp.Regexp
+	}{
+		{schema.Column{Name: "email", Type: "text"}, regexp.MustCompile(`^[^@\s]+@[^@\s]+$`)},
+		{schema.Column{Name: "phone_number", Type: "character varying"}, regexp.MustCompile(`^\d{10}$`)},
+		{schema.Column{Name: "external_id", Type: "uuid"}, regexp.MustCompile(`^[0-9a-f-]{36}$`)},
+		{schema.Column{Name: "age", Type: "integer", Stats: &schema.ColumnStats{Min: "18", Max: "99"}}, regexp.MustCompile(`^([1-9][0-9])$`)},
+		{schema.Column{Name: "priority", Type: "integer", Stats: &schema.ColumnStats{Values: []string{"1", "2", "3"}}}, regexp.MustCompile(`^[123]$`)},
+		{schema.Column{Name: "balance", Type: "bigint", Stats: &schema.ColumnStats{Min: "-9223372036854775808", Max: "9223372036854775807"}}, regexp.MustCompile(`^-?\d{1,19}$`)},
+		{schema.Column{Name: "ratio", Type: "double precision", Stats: &schema.ColumnStats{Min: "-1e308", Max: "1e308"}}, regexp.MustCompile(`^-?\d+\.\d{2}$`)},
+		{schema.Column{Name: "created_on", Type: "date"}, regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)},
+		{schema.Column{Name: "mood", Type: "USER-DEFINED", EnumType: "public.mood", EnumValues: []string{"happy", "sad"}}, regexp.MustCompile(`^(happy|sad)$`)},
+	} {
+		tr, err := NewKeyedTransformer("synthesize", &vandalv1alpha1.TransformationParams{UseStatistics: true}, []byte("key"))
+		if err != nil {
+			t.Fatalf("NewKeyedTransformer() error = %v", err)
+		}
+		tr, err = forColumn(tr, "synthesize", "t", &tc.column)
+		if err != nil {
+			t.Fatalf("forColumn(%s) error = %v", tc.column.Name, err)
+		}
+		for _, in := range []string{"a", "b", "c"} {
+			if got, _ := tr.Transform(in); !tc.want.MatchString(got) {
+				t.Errorf("synthesize %s = %q, want a match of %s", tc.column.Name, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestSynthesizeLeavesOutTextStatistics(t *testing.T) {
+	column := schema.Column{Name: "email", Type: "text", Stats: &schema.ColumnStats{Values: []string{"alice@example.com", "bob@example.com"}}}
+	tr, err := NewKeyedTransformer("synthesize", &vandalv1alpha1.TransformationParams{UseStatistics: true}, []byte("key"))
+	if err != nil {
+		t.Fatalf("NewKeyedTransformer() error = %v", err)
+	}
+	tr, err = forColumn(tr, "synthesize", "t", &column)
+	if err != nil {
+		t.Fatalf("forColumn() error = %v", err)
+	}
+	for _, in := range []string{"a", "b", "c", "d"} {
+		if got, _ := tr.Transform(in); got == "alice@example.com" || got == "bob@example.com" {
+			t.Errorf("synthesize email = %q, a value of the source", got)
+		}
+	}
+}
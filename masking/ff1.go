@@ -0,0 +1,180 @@
+package masking
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// ff1 implements the FF1 format-preserving encryption mode of NIST SP 800-38G
+// on numeral strings, i.e. slices of digits in the given radix.
+type ff1 struct {
+	block cipher.Block
+	radix int
+}
+
+// newFF1 creates an FF1 cipher with an AES key of 16, 24 or 32 bytes.
+func newFF1(key []byte, radix int) (*ff1, error) {
+	if radix < 2 || radix > 1<<16 {
+		return nil, fmt.Errorf("invalid FF1 radix %d", radix)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ff1{block: block, radix: radix}, nil
+}
+
+// ff1MinDomain is the smallest number of possible numeral strings NIST SP
+// 800-38G allows FF1 to encrypt, as smaller domains can be enumerated.
+const ff1MinDomain = 1000000
+
+// minLength returns the shortest numeral string the cipher accepts, whose
+// domain has at least ff1MinDomain values: 6 digits or 5 letters.
+func (f *ff1) minLength() int {
+	n, v := 1, f.radix
+	for v < ff1MinDomain {
+		v *= f.radix
+		n++
+	}
+	return n
+}
+
+// Encrypt encrypts the numeral string x with the given tweak.
+func (f *ff1) Encrypt(x []int, tweak []byte) ([]int, error) {
+	return f.cipher(x, tweak, true)
+}
+
+// Decrypt decrypts the numeral string x with the given tweak.
+func (f *ff1) Decrypt(x []int, tweak []byte) ([]int, error) {
+	return f.cipher(x, tweak, false)
+}
+
+func (f *ff1) cipher(x []int, tweak []byte, encrypt bool) ([]int, error) {
+	n := len(x)
+	if n < f.minLength() {
+		return nil, fmt.Errorf("FF1 input of length %d is shorter than %d", n, f.minLength())
+	}
+	for _, d := range x {
+		if d < 0 || d >= f.radix {
+			return nil, fmt.Errorf("FF1 numeral %d out of range for radix %d", d, f.radix)
+		}
+	}
+
+	u := n / 2
+	v := n - u
+	a := append([]int(nil), x[:u]...)
+	b := append([]int(nil), x[u:]...)
+
+	radix := big.NewInt(int64(f.radix))
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+
+	// b is the byte length of the largest value of v numerals.
+	byteLen := (new(big.Int).Sub(modV, big.NewInt(1)).BitLen() + 7) / 8
+	d := 4*((byteLen+3)/4) + 4
+
+	p := make([]byte, 16)
+	p[0], p[1], p[2] = 1, 2, 1
+	p[3], p[4], p[5] = byte(f.radix>>16), byte(f.radix>>8), byte(f.radix)
+	p[6] = 10
+	p[7] = byte(u)
+	binary.BigEndian.PutUint32(p[8:12], uint32(n))
+	binary.BigEndian.PutUint32(p[12:16], uint32(len(tweak)))
+
+	padLen := (16 - (len(tweak)+byteLen+1)%16) % 16
+	q := make([]byte, len(tweak)+padLen+1+byteLen)
+	copy(q, tweak)
+
+	for step := 0; step < 10; step++ {
+		i := step
+		if !encrypt {
+			i = 9 - step
+		}
+
+		// The round function is applied to B when encrypting and to A when
+		// decrypting, the half that is carried over unchanged.
+		in := b
+		if !encrypt {
+			in = a
+		}
+		q[len(tweak)+padLen] = byte(i)
+		num := numeralsToInt(in, radix)
+		numBytes := num.Bytes()
+		for k := len(tweak) + padLen + 1; k < len(q); k++ {
+			q[k] = 0
+		}
+		copy(q[len(q)-len(numBytes):], numBytes)
+
+		y := new(big.Int).SetBytes(f.expand(f.prf(append(append([]byte(nil), p...), q...)), d))
+
+		m, mod := u, modU
+		if i%2 == 1 {
+			m, mod = v, modV
+		}
+
+		if encrypt {
+			c := numeralsToInt(a, radix)
+			c.Add(c, y).Mod(c, mod)
+			a, b = b, intToNumerals(c, radix, m)
+		} else {
+			c := numeralsToInt(b, radix)
+			c.Sub(c, y).Mod(c, mod)
+			b, a = a, intToNumerals(c, radix, m)
+		}
+	}
+
+	return append(a, b...), nil
+}
+
+// prf is the CBC-MAC of data, whose length is a multiple of the block size.
+func (f *ff1) prf(data []byte) []byte {
+	y := make([]byte, aes.BlockSize)
+	for i := 0; i < len(data); i += aes.BlockSize {
+		for j := 0; j < aes.BlockSize; j++ {
+			y[j] ^= data[i+j]
+		}
+		f.block.Encrypt(y, y)
+	}
+	return y
+}
+
+// expand extends the block r to d bytes as step 6.iii of FF1 describes.
+func (f *ff1) expand(r []byte, d int) []byte {
+	s := append([]byte(nil), r...)
+	for j := 1; len(s) < d; j++ {
+		block := make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(block[8:], uint64(j))
+		for k := range block {
+			block[k] ^= r[k]
+		}
+		f.block.Encrypt(block, block)
+		s = append(s, block...)
+	}
+	return s[:d]
+}
+
+// numeralsToInt returns the value of a numeral string, most significant first.
+func numeralsToInt(x []int, radix *big.Int) *big.Int {
+	n := new(big.Int)
+	for _, d := range x {
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	return n
+}
+
+// intToNumerals returns the m-numeral representation of n, most significant
+// first.
+func intToNumerals(n *big.Int, radix *big.Int, m int) []int {
+	x := make([]int, m)
+	n = new(big.Int).Set(n)
+	d := new(big.Int)
+	for i := m - 1; i >= 0; i-- {
+		n.DivMod(n, radix, d)
+		x[i] = int(d.Int64())
+	}
+	return x
+}
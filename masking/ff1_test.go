@@ -0,0 +1,116 @@
+package masking
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Sample vectors from NIST's FF1 examples.
+func TestFF1Samples(t *testing.T) {
+	key, _ := hex.DecodeString("2B7E151628AED2A6ABF7158809CF4F3C")
+	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+	for _, tc := range []struct {
+		radix      int
+		tweak      string
+		plaintext  string
+		ciphertext string
+	}{
+		{10, "", "0123456789", "2433477484"},
+		{10, "39383736353433323130", "0123456789", "6124200773"},
+		{36, "3737373770717273373737", "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+	} {
+		c, err := newFF1(key, tc.radix)
+		if err != nil {
+			t.Fatalf("newFF1() error = %v", err)
+		}
+		tweak, _ := hex.DecodeString(tc.tweak)
+
+		var x []int
+		for _, ch := range tc.plaintext {
+			x = append(x, strings.IndexRune(alphabet, ch))
+		}
+		y, err := c.Encrypt(x, tweak)
+		if err != nil {
+			t.Fatalf("Encrypt() error = %v", err)
+		}
+		var got strings.Builder
+		for _, n := range y {
+			got.WriteByte(alphabet[n])
+		}
+		if got.String() != tc.ciphertext {
+			t.Errorf("Encrypt(%s) = %s, want %s", tc.plaintext, got.String(), tc.ciphertext)
+		}
+
+		z, err := c.Decrypt(y, tweak)
+		if err != nil {
+			t.Fatalf("Decrypt() error = %v", err)
+		}
+		for i := range x {
+			if z[i] != x[i] {
+				t.Errorf("Decrypt(Encrypt(%s)) = %v", tc.plaintext, z)
+				break
+			}
+		}
+	}
+}
+
+func TestFPEPreservesFormat(t *testing.T) {
+	f, err := NewFPE([]byte("secret"))
+	if err != nil {
+		t.Fatalf("NewFPE() error = %v", err)
+	}
+	for _, v := range []string{"+1 (555) 010-9999", "123-45-6789", "DE89 3704 0044 0532 0130 00"} {
+		enc, err := f.Encrypt(v)
+		if err != nil {
+			t.Fatalf("Encrypt(%q) error = %v", v, err)
+		}
+		if enc == v || len(enc) != len(v) {
+			t.Errorf("Encrypt(%q) = %q", v, enc)
+		}
+		for i := range v {
+			if _, digit := fpeNumeral(fpeDigits, v[i]); digit {
+				if _, ok := fpeNumeral(fpeDigits, enc[i]); !ok {
+					t.Errorf("Encrypt(%q) = %q changed the class of position %d", v, enc, i)
+				}
+			} else if (v[i] == ' ' || v[i] == '-') && enc[i] != v[i] {
+				t.Errorf("Encrypt(%q) = %q moved a separator", v, enc)
+			}
+		}
+		dec, err := f.Decrypt(enc)
+		if err != nil || dec != v {
+			t.Errorf("Decrypt(%q) = %q, %v, want %q", enc, dec, err, v)
+		}
+	}
+}
+
+func TestFPEMasksShortRuns(t *testing.T) {
+	f, err := NewFPE([]byte("secret"))
+	if err != nil {
+		t.Fatalf("NewFPE() error = %v", err)
+	}
+	changed := 0
+	for i := 0; i < 100; i++ {
+		v := fmt.Sprintf("%02d-AB", i)
+		enc, err := f.Encrypt(v)
+		if err != nil {
+			t.Fatalf("Encrypt(%q) error = %v", v, err)
+		}
+		if len(enc) != len(v) || enc[2] != '-' {
+			t.Errorf("Encrypt(%q) = %q changed the format", v, enc)
+		}
+		if enc[:2] != v[:2] {
+			changed++
+		}
+		dec, err := f.Decrypt(enc)
+		if err != nil || dec != v {
+			t.Errorf("Decrypt(%q) = %q, %v, want %q", enc, dec, err, v)
+		}
+	}
+	// A random permutation of 100 values has about one fixed point.
+	if changed < 90 {
+		t.Errorf("Encrypt changed the digits of %d of 100 values", changed)
+	}
+}
@@ -0,0 +1,264 @@
+package masking
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Character classes encrypted by FPE, each in its own FF1 domain.
+const (
+	fpeDigits = iota
+	fpeLower
+	fpeUpper
+)
+
+// FPE is a format-preserving cipher for values such as phone numbers, account
+// numbers, SSNs and IBANs. Digits, lower case and upper case ASCII letters are
+// encrypted within their class with FF1, all other characters stay in place,
+// so the output has the length, character classes and layout of the input.
+// Anyone holding the masking key can reverse it with Decrypt.
+//
+// FF1 only encrypts domains of at least 1,000,000 values, so runs of fewer
+// than 6 digits or 5 letters of a class are instead substituted through a
+// keyed permutation of all the runs of their length. They are never left as
+// they are, but as their domain is small, anyone who can observe the masked
+// value of chosen inputs can map them back.
+type FPE struct {
+	ciphers [3]*ff1
+	// substitution generates the permutations of short runs.
+	substitution cipher.Block
+
+	mu           sync.Mutex
+	permutations map[[2]int]*fpePermutation
+}
+
+// fpePermutation is a keyed permutation of the numeral strings of one length,
+// indexed by their value.
+type fpePermutation struct {
+	forward, inverse []int32
+}
+
+// NewFPE creates a format-preserving cipher from a masking key. The AES key is
+// derived from the masking key, so the same secret can be used for
+// deterministic masking.
+func NewFPE(key []byte) (*FPE, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("format-preserving encryption requires a masking key")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("vandal-fpe"))
+	aesKey := mac.Sum(nil)
+	mac.Reset()
+	mac.Write([]byte("vandal-fpe-substitution"))
+	substitution, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FPE{substitution: substitution}
+	for class, radix := range []int{fpeDigits: 10, fpeLower: 26, fpeUpper: 26} {
+		c, err := newFF1(aesKey, radix)
+		if err != nil {
+			return nil, err
+		}
+		f.ciphers[class] = c
+	}
+	return f, nil
+}
+
+// Encrypt encrypts value, preserving its format.
+func (f *FPE) Encrypt(value string) (string, error) {
+	return f.apply(value, (*ff1).Encrypt, false)
+}
+
+// Decrypt reverses Encrypt.
+func (f *FPE) Decrypt(value string) (string, error) {
+	return f.apply(value, (*ff1).Decrypt, true)
+}
+
+// apply runs fn over the characters of every class of value and puts the
+// results back at their original positions. Classes with fewer characters than
+// FF1 accepts are substituted instead, or substituted back if decrypt is set.
+func (f *FPE) apply(value string, fn func(*ff1, []int, []byte) ([]int, error), decrypt bool) (string, error) {
+	out := []byte(value)
+	for class, c := range f.ciphers {
+		var positions, numerals []int
+		for i := 0; i < len(out); i++ {
+			if n, ok := fpeNumeral(class, out[i]); ok {
+				positions = append(positions, i)
+				numerals = append(numerals, n)
+			}
+		}
+		if len(numerals) == 0 {
+			continue
+		}
+
+		var result []int
+		if len(numerals) < c.minLength() {
+			result = f.substitute(class, numerals, decrypt)
+		} else {
+			var err error
+			if result, err = fn(c, numerals, []byte{byte(class)}); err != nil {
+				return "", err
+			}
+		}
+		for k, i := range positions {
+			out[i] = fpeChar(class, result[k])
+		}
+	}
+	return string(out), nil
+}
+
+// substitute maps a numeral string of a class too short for FF1 through the
+// permutation of the strings of its length, or through its inverse if decrypt
+// is set.
+func (f *FPE) substitute(class int, numerals []int, decrypt bool) []int {
+	radix := f.ciphers[class].radix
+	p := f.permutation(class, len(numerals))
+	v := 0
+	for _, n := range numerals {
+		v = v*radix + n
+	}
+	if decrypt {
+		v = int(p.inverse[v])
+	} else {
+		v = int(p.forward[v])
+	}
+	out := make([]int, len(numerals))
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = v % radix
+		v /= radix
+	}
+	return out
+}
+
+// permutation returns the permutation of the numeral strings of a class and
+// length, shuffling them on first use with a keystream of the substitution
+// key. Lengths are below the minimum of FF1, so there are fewer than
+// ff1MinDomain strings.
+func (f *FPE) permutation(class, length int) *fpePermutation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := [2]int{class, length}
+	if p, ok := f.permutations[key]; ok {
+		return p
+	}
+
+	size := 1
+	for i := 0; i < length; i++ {
+		size *= f.ciphers[class].radix
+	}
+	forward := make([]int32, size)
+	for i := range forward {
+		forward[i] = int32(i)
+	}
+	iv := make([]byte, aes.BlockSize)
+	iv[0], iv[1] = byte(class), byte(length)
+	stream := cipher.NewCTR(f.substitution, iv)
+	var buf [4]byte
+	// Fisher-Yates, drawing every index uniformly by rejection sampling.
+	for i := size - 1; i > 0; i-- {
+		bound := uint32(i + 1)
+		limit := math.MaxUint32 - math.MaxUint32%bound
+		for {
+			buf = [4]byte{}
+			stream.XORKeyStream(buf[:], buf[:])
+			if r := binary.BigEndian.Uint32(buf[:]); r < limit {
+				j := r % bound
+				forward[i], forward[j] = forward[j], forward[i]
+				break
+			}
+		}
+	}
+	inverse := make([]int32, size)
+	for i, v := range forward {
+		inverse[v] = int32(i)
+	}
+
+	p := &fpePermutation{forward: forward, inverse: inverse}
+	if f.permutations == nil {
+		f.permutations = make(map[[2]int]*fpePermutation)
+	}
+	f.permutations[key] = p
+	return p
+}
+
+// fpeNumeral returns the numeral of ch within a character class.
+func fpeNumeral(class int, ch byte) (int, bool) {
+	switch {
+	case class == fpeDigits && ch >= '0' && ch <= '9':
+		return int(ch - '0'), true
+	case class == fpeLower && ch >= 'a' && ch <= 'z':
+		return int(ch - 'a'), true
+	case class == fpeUpper && ch >= 'A' && ch <= 'Z':
+		return int(ch - 'A'), true
+	}
+	return 0, false
+}
+
+// fpeChar is the inverse of fpeNumeral.
+func fpeChar(class int, n int) byte {
+	switch class {
+	case fpeDigits:
+		return byte('0' + n)
+	case fpeLower:
+		return byte('a' + n)
+	default:
+		return byte('A' + n)
+	}
+}
+
+// fpeTransformer implements the Transformer interface for format-preserving
+// encryption.
+type fpeTransformer struct {
+	fpe *FPE
+	// max is the largest value of the integer column the transformer masks,
+	// or 0 if it does not mask one.
+	max uint64
+}
+
+// Transform implements the Transformer interface. Values of integer columns
+// are encrypted again until the result is an integer of the column, with no
+// leading zero and in its range. This cycle walking keeps the mapping
+// one-to-one, and holders of the key reverse it by decrypting until the
+// result is such an integer.
+func (t *fpeTransformer) Transform(value string) (string, error) {
+	if t.max == 0 {
+		return t.fpe.Encrypt(value)
+	}
+	if !t.fitsInteger(value) {
+		return "", fmt.Errorf("value %q is not an integer in the range of its column", value)
+	}
+	for {
+		encrypted, err := t.fpe.Encrypt(value)
+		if err != nil {
+			return "", err
+		}
+		if t.fitsInteger(encrypted) {
+			return encrypted, nil
+		}
+		value = encrypted
+	}
+}
+
+// fitsInteger reports whether value is the text of an integer of the column,
+// without leading zeros.
+func (t *fpeTransformer) fitsInteger(value string) bool {
+	limit := t.max
+	if strings.HasPrefix(value, "-") {
+		value, limit = value[1:], t.max+1
+	}
+	if value == "" || (len(value) > 1 && value[0] == '0') {
+		return false
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	return err == nil && n <= limit
+}
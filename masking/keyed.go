@@ -0,0 +1,66 @@
+package masking
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/brianvoe/gofakeit/v6"
+)
+
+// keyedFaker hands out fakers to generate fake data for a value. Without a key
+// every value gets random fake data. With a key the faker is seeded from an
+// HMAC of the value, so identical values get identical fake data across
+// tables, clones and runs.
+type keyedFaker struct {
+	key    []byte
+	random *gofakeit.Faker
+}
+
+// newKeyedFaker creates a keyedFaker. A nil key gives random fake data.
+func newKeyedFaker(key []byte) *keyedFaker {
+	if len(key) == 0 {
+		return &keyedFaker{random: gofakeit.New(0)}
+	}
+	return &keyedFaker{key: key}
+}
+
+// For returns the faker to generate fake data for value from.
+func (f *keyedFaker) For(value string) *gofakeit.Faker {
+	if f.key == nil {
+		return f.random
+	}
+	return gofakeit.NewCustom(&splitMix64{state: keyedSeed(f.key, value)})
+}
+
+// keyedSeed derives a 64-bit seed from an HMAC of value with key.
+func keyedSeed(key []byte, value string) uint64 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// splitMix64 is a small rand.Source64. It is cheap to create, which matters as
+// keyed fakers need a new source for every value.
+type splitMix64 struct {
+	state uint64
+}
+
+// Uint64 implements rand.Source64.
+func (s *splitMix64) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Int63 implements rand.Source.
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// Seed implements rand.Source.
+func (s *splitMix64) Seed(seed int64) {
+	s.state = uint64(seed)
+}
@@ -1,9 +1,13 @@
 package masking
 
 import (
+	"bufio"
+	"fmt"
 	"io"
+	"strings"
 
 	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/pkg/copytext"
 	"github.com/Oridak771/Vandal/schema"
 )
 
@@ -19,13 +23,215 @@ func NewMasker() Masker {
 	return &defaultMasker{}
 }
 
-// defaultMasker is a basic implementation of the Masker interface.
-type defaultMasker struct{}
+// NewKeyedMasker creates a new masker whose transformations are derived from an
+// HMAC of the original values with key, so identical values are masked
+// identically across tables, clones and runs.
+func NewKeyedMasker(key []byte) Masker {
+	return &defaultMasker{key: key}
+}
+
+// defaultMasker is a streaming implementation of the Masker interface. It
+// understands plain-format dumps: the rows of every "COPY ... FROM stdin"
+// block are masked one at a time, everything else is passed through as is.
+// Masking a column also masks the foreign keys referencing it the same way.
+type defaultMasker struct {
+	key []byte
+}
 
 // Mask implements the Masker interface.
 func (m *defaultMasker) Mask(in io.Reader, rules []vandalv1alpha1.MaskingRule, schema *schema.Schema) (io.Reader, error) {
-	// This is a placeholder implementation.
-	// In a real implementation, this would be a streaming pipeline
-	// that applies the masking rules to the input stream based on the schema.
-	return in, nil
+	transformers, err := m.ruleTransformers(rules, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(maskStream(in, pw, transformers, schema))
+	}()
+	return pr, nil
+}
+
+// ruleTransformers maps table names to the transformers of their columns.
+type ruleTransformers map[string]map[string]Transformer
+
+// ruleTransformers creates a transformer for every masking rule and, given a
+// schema, for every foreign key referencing a masked column. Given a schema,
+// the transformers are adapted to the types of the columns they mask, and a
+// rule naming a table the schema does not have is an error, as the table it
+// was meant for would be copied unmasked.
+func (m *defaultMasker) ruleTransformers(rules []vandalv1alpha1.MaskingRule, s *schema.Schema) (ruleTransformers, error) {
+	transformers := make(ruleTransformers)
+	transformations := make(map[columnRef]string)
+	for _, rule := range rules {
+		t, err := NewKeyedTransformer(rule.Transformation, rule.Params, m.key)
+		if err != nil {
+			return nil, fmt.Errorf("rule for %s.%s: %w", rule.Table, rule.Column, err)
+		}
+		table := tableKey(s, rule.Table)
+		if s != nil {
+			tbl := s.Table(table)
+			if tbl == nil {
+				return nil, fmt.Errorf("masking rule references unknown table %s", rule.Table)
+			}
+			if column := tbl.Column(rule.Column); column != nil {
+				if t, err = forColumn(t, rule.Transformation, table, column); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if transformers[table] == nil {
+			transformers[table] = make(map[string]Transformer)
+		}
+		transformers[table][rule.Column] = t
+		transformations[columnRef{Table: table, Column: rule.Column}] = rule.Transformation
+	}
+
+	if s != nil {
+		if err := m.propagateKeys(transformers, transformations, s); err != nil {
+			return nil, err
+		}
+	}
+	return transformers, nil
+}
+
+// tableKey returns the name the transformers of a table are keyed by: its
+// qualified name if s has the table, or name as given otherwise. Rules may
+// name a table either qualified with its schema or unqualified.
+func tableKey(s *schema.Schema, name string) string {
+	if s != nil {
+		if table := s.Table(name); table != nil {
+			return table.QualifiedName()
+		}
+	}
+	return name
+}
+
+// forTable returns the column transformers for a table, given the possibly
+// empty schema qualifier of its name.
+func (rt ruleTransformers) forTable(s *schema.Schema, schemaName, table string) map[string]Transformer {
+	name := schema.QualifiedName(schemaName, table)
+	if t, ok := rt[tableKey(s, name)]; ok {
+		return t
+	}
+	if t, ok := rt[name]; ok {
+		return t
+	}
+	return rt[table]
+}
+
+// maskStream copies a dump from in to out, masking the rows of every COPY block
+// that has masking rules.
+func maskStream(in io.Reader, out io.Writer, transformers ruleTransformers, s *schema.Schema) error {
+	r := bufio.NewReaderSize(in, 64*1024)
+	w := bufio.NewWriterSize(out, 64*1024)
+
+	inCopy := false
+	var columns []Transformer
+	for {
+		line, readErr := r.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		if line != "" {
+			if inCopy {
+				row := strings.TrimSuffix(line, "\n")
+				if row == copytext.Terminator {
+					inCopy = false
+					columns = nil
+				} else if columns != nil {
+					masked, err := maskRow(row, columns)
+					if err != nil {
+						return err
+					}
+					line = masked + "\n"
+				}
+			} else {
+				header, ok, err := copytext.ParseHeader(line)
+				if err != nil {
+					return err
+				}
+				if ok {
+					inCopy = true
+					columns, err = columnTransformers(header, transformers.forTable(s, header.Schema, header.Table), s)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			if _, err := w.WriteString(line); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if inCopy {
+		return fmt.Errorf("unexpected end of input inside COPY block")
+	}
+	return w.Flush()
+}
+
+// columnTransformers returns the transformer of every column of a COPY block
+// by position, or nil if none of its columns is masked.
+func columnTransformers(header *copytext.Header, rules map[string]Transformer, s *schema.Schema) ([]Transformer, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	var table *schema.Table
+	if s != nil {
+		table = s.Table(schema.QualifiedName(header.Schema, header.Table))
+	}
+
+	names := header.Columns
+	if len(names) == 0 {
+		if table == nil {
+			return nil, fmt.Errorf("COPY statement for table %s has no column list and the table is not in the schema", header.Table)
+		}
+		for _, c := range table.Columns {
+			names = append(names, c.Name)
+		}
+	}
+
+	if table != nil {
+		for column := range rules {
+			if table.Column(column) == nil {
+				return nil, fmt.Errorf("masking rule references unknown column %s.%s", header.Table, column)
+			}
+		}
+	}
+
+	columns := make([]Transformer, len(names))
+	for i, name := range names {
+		columns[i] = rules[name]
+	}
+	return columns, nil
+}
+
+// maskRow applies the column transformers to a single COPY text row. NULL
+// values are left untouched, and the "null" transformation produces NULL.
+func maskRow(row string, columns []Transformer) (string, error) {
+	fields := copytext.SplitRow(row)
+	if len(fields) != len(columns) {
+		return "", fmt.Errorf("COPY row has %d fields, expected %d", len(fields), len(columns))
+	}
+	for i, t := range columns {
+		if t == nil || fields[i] == nil {
+			continue
+		}
+		if _, ok := t.(*nullTransformer); ok {
+			fields[i] = nil
+			continue
+		}
+		v, err := t.Transform(*fields[i])
+		if err != nil {
+			return "", err
+		}
+		fields[i] = &v
+	}
+	return copytext.JoinRow(fields), nil
 }
@@ -0,0 +1,229 @@
+package masking
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/schema"
+)
+
+func TestMaskCopyBlock(t *testing.T) {
+	dump := strings.Join([]string{
+		"SET client_encoding = 'UTF8';",
+		"COPY public.users (id, email, note) FROM stdin;",
+		"1\talice@example.com\tline\\none",
+		"2\t\\N\t\\N",
+		"\\.",
+		"COPY public.orders (id, total) FROM stdin;",
+		"1\t9.99",
+		"\\.",
+		"",
+	}, "\n")
+
+	s := &schema.Schema{Tables: []schema.Table{
+		{Name: "users", Columns: []schema.Column{{Name: "id"}, {Name: "email"}, {Name: "note"}}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{
+		{Table: "users", Column: "email", Transformation: "redact"},
+		{Table: "users", Column: "note", Transformation: "redact"},
+	}
+
+	out, err := NewMasker().Mask(strings.NewReader(dump), rules, s)
+	if err != nil {
+		t.Fatalf("Mask() error = %v", err)
+	}
+	got, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatalf("reading masked stream: %v", err)
+	}
+
+	want := strings.Join([]string{
+		"SET client_encoding = 'UTF8';",
+		"COPY public.users (id, email, note) FROM stdin;",
+		"1\tREDACTED\tREDACTED",
+		"2\t\\N\t\\N",
+		"\\.",
+		"COPY public.orders (id, total) FROM stdin;",
+		"1\t9.99",
+		"\\.",
+		"",
+	}, "\n")
+	if string(got) != want {
+		t.Errorf("Mask() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMaskUnknownColumn(t *testing.T) {
+	dump := "COPY users (id) FROM stdin;\n1\n\\.\n"
+	s := &schema.Schema{Tables: []schema.Table{{Name: "users", Columns: []schema.Column{{Name: "id"}}}}}
+	rules := []vandalv1alpha1.MaskingRule{{Table: "users", Column: "email", Transformation: "redact"}}
+
+	out, err := NewMasker().Mask(strings.NewReader(dump), rules, s)
+	if err != nil {
+		t.Fatalf("Mask() error = %v", err)
+	}
+	if _, err := io.ReadAll(out); err == nil {
+		t.Error("expected an error for a rule on an unknown column")
+	}
+}
+
+func TestMaskRejectsUnknownTable(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{{Schema: "public", Name: "users", Columns: []schema.Column{{Name: "email"}}}}}
+	for _, table := range []string{"user", "sales.users"} {
+		rules := []vandalv1alpha1.MaskingRule{{Table: table, Column: "email", Transformation: "redact"}}
+		if _, err := NewMasker().Mask(strings.NewReader(""), rules, s); err == nil {
+			t.Errorf("expected an error for a rule on unknown table %s", table)
+		}
+	}
+}
+
+func TestMaskPropagatesToForeignKeys(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{
+		{Name: "users", Columns: []schema.Column{{Name: "email", IsPrimaryKey: true}}},
+		{Name: "orders", Columns: []schema.Column{
+			{Name: "id", IsPrimaryKey: true},
+			{Name: "user_email", IsForeignKey: true, ForeignKeyTable: "users", ForeignKeyColumn: "email"},
+		}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{{Table: "users", Column: "email", Transformation: "name"}}
+
+	m := NewKeyedMasker([]byte("secret"))
+	mask := func(dump string) string {
+		out, err := m.Mask(strings.NewReader(dump), rules, s)
+		if err != nil {
+			t.Fatalf("Mask() error = %v", err)
+		}
+		got, err := io.ReadAll(out)
+		if err != nil {
+			t.Fatalf("reading masked stream: %v", err)
+		}
+		return string(got)
+	}
+
+	users := strings.Split(mask("COPY users (email) FROM stdin;\nalice@example.com\n\\.\n"), "\n")
+	orders := strings.Split(mask("COPY orders (id, user_email) FROM stdin;\n1\talice@example.com\n\\.\n"), "\n")
+	if users[1] == "alice@example.com" {
+		t.Fatalf("primary key was not masked")
+	}
+	if want := "1\t" + users[1]; orders[1] != want {
+		t.Errorf("foreign key masked as %q, want %q", orders[1], want)
+	}
+}
+
+func TestMaskRejectsNonDeterministicReferencedKey(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{
+		{Name: "users", Columns: []schema.Column{{Name: "email", IsPrimaryKey: true}}},
+		{Name: "orders", Columns: []schema.Column{
+			{Name: "id", IsPrimaryKey: true},
+			{Name: "user_email", IsForeignKey: true, ForeignKeyTable: "users", ForeignKeyColumn: "email"},
+		}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{{Table: "users", Column: "email", Transformation: "name"}}
+	if _, err := NewMasker().Mask(strings.NewReader(""), rules, s); err == nil {
+		t.Error("expected an error for an unkeyed name transformation on a referenced key")
+	}
+}
+
+func TestMaskRejectsCollapsingPrimaryKey(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{
+		{Name: "users", Columns: []schema.Column{{Name: "email", IsPrimaryKey: true}}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{{Table: "users", Column: "email", Transformation: "redact"}}
+	if _, err := NewMasker().Mask(strings.NewReader(""), rules, s); err == nil {
+		t.Error("expected an error for redacting a primary key")
+	}
+}
+
+func TestMaskRejectsHashOnIntegerPrimaryKey(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{
+		{Name: "users", Columns: []schema.Column{{Name: "id", Type: "integer", IsPrimaryKey: true}}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{{Table: "users", Column: "id", Transformation: "hash"}}
+	if _, err := NewMasker().Mask(strings.NewReader(""), rules, s); err == nil {
+		t.Error("expected an error for hashing an integer primary key")
+	}
+	rules[0].Transformation = "fpe"
+	if _, err := NewKeyedMasker([]byte("key")).Mask(strings.NewReader(""), rules, s); err != nil {
+		t.Errorf("Mask() error = %v for fpe on an integer primary key", err)
+	}
+}
+
+func TestMaskRejectsCollapsingUniqueColumn(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{{
+		Name:        "users",
+		Columns:     []schema.Column{{Name: "id", IsPrimaryKey: true}, {Name: "email", Type: "text"}},
+		Constraints: []schema.Constraint{{Name: "users_email_key", Type: schema.ConstraintUnique, Columns: []string{"email"}}},
+	}}}
+	rules := []vandalv1alpha1.MaskingRule{{Table: "users", Column: "email", Transformation: "redact"}}
+	if _, err := NewMasker().Mask(strings.NewReader(""), rules, s); err == nil {
+		t.Error("expected an error for redacting a unique column")
+	}
+}
+
+func TestMaskNullWritesSQLNull(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{
+		{Name: "users", Columns: []schema.Column{{Name: "id", Type: "integer"}, {Name: "phone", Type: "text", IsNullable: true}}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{{Table: "users", Column: "phone", Transformation: "null"}}
+
+	out, err := NewMasker().Mask(strings.NewReader("COPY users (id, phone) FROM stdin;\n1\t555-1234\n\\.\n"), rules, s)
+	if err != nil {
+		t.Fatalf("Mask() error = %v", err)
+	}
+	got, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatalf("reading masked stream: %v", err)
+	}
+	if want := "COPY users (id, phone) FROM stdin;\n1\t\\N\n\\.\n"; string(got) != want {
+		t.Errorf("Mask() = %q, want %q", got, want)
+	}
+}
+
+func TestUnclassifiedColumns(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{
+		{Name: "users", Columns: []schema.Column{{Name: "id", IsPrimaryKey: true}, {Name: "email"}, {Name: "created_at"}}},
+		{Name: "orders", Columns: []schema.Column{
+			{Name: "user_id", IsForeignKey: true, ForeignKeyTable: "users", ForeignKeyColumn: "id"},
+		}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{
+		{Table: "users", Column: "id", Transformation: "hash"},
+		{Table: "users", Column: "email", Transformation: "synthesize"},
+	}
+
+	got := UnclassifiedColumns(s, rules)
+	if len(got) != 1 || got[0] != "users.created_at" {
+		t.Errorf("UnclassifiedColumns() = %v, want [users.created_at]", got)
+	}
+
+	rules = append(rules, vandalv1alpha1.MaskingRule{Table: "users", Column: "created_at", Transformation: "passthrough"})
+	if got := UnclassifiedColumns(s, rules); len(got) != 0 {
+		t.Errorf("UnclassifiedColumns() = %v, want none", got)
+	}
+}
+
+func TestMaskQualifiedTables(t *testing.T) {
+	s := &schema.Schema{Tables: []schema.Table{
+		{Schema: "public", Name: "users", Columns: []schema.Column{{Name: "email", Type: "text"}}},
+		{Schema: "Archive", Name: "users", Columns: []schema.Column{{Name: "email", Type: "text"}}},
+	}}
+	rules := []vandalv1alpha1.MaskingRule{{Table: "users", Column: "email", Transformation: "redact"}}
+
+	in := "COPY public.users (email) FROM stdin;\na@example.com\n\\.\n" +
+		"COPY \"Archive\".users (email) FROM stdin;\nb@example.com\n\\.\n"
+	out, err := NewMasker().Mask(strings.NewReader(in), rules, s)
+	if err != nil {
+		t.Fatalf("Mask() error = %v", err)
+	}
+	got, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatalf("reading masked stream: %v", err)
+	}
+	want := "COPY public.users (email) FROM stdin;\nREDACTED\n\\.\n" +
+		"COPY \"Archive\".users (email) FROM stdin;\nb@example.com\n\\.\n"
+	if string(got) != want {
+		t.Errorf("Mask() = %q, want %q", got, want)
+	}
+}
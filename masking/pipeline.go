@@ -2,63 +2,355 @@ package masking
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
 
 	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/schema"
 	"github.com/Oridak771/Vandal/storage"
 	"golang.org/x/sync/errgroup"
 )
 
+// maxParallelTables bounds the tables copied at once.
+const maxParallelTables = 4
+
+// MinConns is the smallest connection pool of a database the pipeline can
+// mask in place. Every table being copied holds a connection of the pool to
+// dump it and another to restore it, so with a smaller pool every copy can
+// wait for a connection held by another and the pipeline never finishes.
+const MinConns = 2 * maxParallelTables
+
 // Pipeline defines the interface for a masking pipeline.
 type Pipeline interface {
 	// Run executes the masking pipeline.
 	Run(ctx context.Context) error
 }
 
-// NewPipeline creates a new masking pipeline.
-func NewPipeline(db storage.Database, masker Masker, rules []vandalv1alpha1.MaskingRule) Pipeline {
+// Sink defines the interface for the destination of a masking pipeline.
+// A storage.Database is a Sink.
+type Sink interface {
+	// Restore restores a dump of masked data.
+	Restore(ctx context.Context, in io.Reader) error
+}
+
+// NewPipeline creates a new masking pipeline that dumps the tables of source
+// selected by spec, masks them with the rules of spec and restores them into
+// sink. With the allowlist default action, the pipeline fails before copying
+// any data if a column of source has no rule. A subset restricts the copied
+// rows; source must then be a storage.SQLDatabase.
+func NewPipeline(source storage.Database, sink Sink, masker Masker, spec vandalv1alpha1.DataProfileSpec) Pipeline {
 	return &pipeline{
-		db:     db,
-		masker: masker,
-		rules:  rules,
+		source:        source,
+		sink:          sink,
+		masker:        masker,
+		rules:         spec.Masking.Rules,
+		defaultAction: spec.Masking.DefaultAction,
+		subset:        spec.Subset,
+		tables:        TableFilter(spec.Tables),
+	}
+}
+
+// TableFilter returns the schema.Filter of a table selection, or nil to select
+// every table.
+func TableFilter(sel *vandalv1alpha1.TableSelection) *schema.Filter {
+	if sel == nil {
+		return nil
+	}
+	return &schema.Filter{
+		IncludeSchemas: sel.IncludeSchemas,
+		ExcludeSchemas: sel.ExcludeSchemas,
+		IncludeTables:  sel.Include,
+		ExcludeTables:  sel.Exclude,
+		StructureOnly:  sel.StructureOnly,
 	}
 }
 
 // pipeline is a basic implementation of the Pipeline interface.
 type pipeline struct {
-	db     storage.Database
-	masker Masker
-	rules  []vandalv1alpha1.MaskingRule
+	source        storage.Database
+	sink          Sink
+	masker        Masker
+	rules         []vandalv1alpha1.MaskingRule
+	defaultAction string
+	subset        *vandalv1alpha1.SubsetSpec
+	tables        *schema.Filter
 }
 
 // Run implements the Pipeline interface.
 func (p *pipeline) Run(ctx context.Context) error {
+	if err := p.tables.Validate(); err != nil {
+		return fmt.Errorf("table selection: %w", err)
+	}
+
 	// 1. Get the database schema.
-	schema, err := p.db.GetSchema(ctx)
+	all, err := p.source.GetSchema(ctx)
 	if err != nil {
 		return err
 	}
+	schema, data := all.Select(p.tables), all.WithData(p.tables)
+
+	// Rules are checked against every table of the source, including the
+	// ones that are not selected, before any data is copied: a rule naming a
+	// table that does not exist fails the pipeline rather than leave the
+	// table it was meant for unmasked.
+	if _, err := p.masker.Mask(strings.NewReader(""), p.rules, all); err != nil {
+		return err
+	}
+
+	if p.defaultAction == vandalv1alpha1.MaskingDefaultActionAllowlist {
+		if columns := UnclassifiedColumns(data, p.rules); len(columns) > 0 {
+			return &UnclassifiedColumnsError{Columns: columns}
+		}
+	}
+
+	// A database masked in place already holds every table, so the tables
+	// that are not selected are removed from it instead of not being copied.
+	inPlace := p.sink == Sink(p.source)
+	if inPlace && p.tables != nil {
+		if err := p.removeUnselected(ctx, all); err != nil {
+			return err
+		}
+	}
+
+	if p.subset != nil {
+		if err := p.runSubset(ctx, all, schema, data); err != nil {
+			return err
+		}
+		return p.refresh(ctx, data)
+	}
 
 	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(maxParallelTables)
 
 	for _, table := range schema.Tables {
 		table := table // https://golang.org/doc/faq#closures_and_goroutines
+		structureOnly := p.tables.IsStructureOnly(&table)
+		if structureOnly && inPlace {
+			continue
+		}
 		g.Go(func() error {
-			// 1. Create a dump of the table.
-			dumpReader, err := p.db.DumpTable(ctx, table.Name)
+			// The dump is cancelled once the table is restored, or failed
+			// to be.
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			// 1. Create a dump of the table, or of its definition only.
+			dump := p.source.DumpTable
+			if structureOnly {
+				dump = p.source.DumpTableSchema
+			}
+			dumpReader, err := dump(ctx, &table)
 			if err != nil {
 				return err
 			}
+			defer closeReader(dumpReader)
 
 			// 2. Mask the data.
-			maskedReader, err := p.masker.Mask(dumpReader, p.rules, schema)
+			maskedReader, err := p.masker.Mask(dumpReader, p.rules, all)
 			if err != nil {
 				return err
 			}
+			defer closeReader(maskedReader)
 
 			// 3. Restore the masked data.
-			return p.db.Restore(ctx, maskedReader)
+			return p.sink.Restore(ctx, maskedReader)
 		})
 	}
 
-	return g.Wait()
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return p.refresh(ctx, data)
+}
+
+// refresh brings the objects derived from the copied rows up to date in the
+// sink, if it can be queried with SQL. Sequences owned by copied columns are
+// moved to the largest value of their column, so that new rows do not collide
+// with masked keys, and materialized views are refreshed from the masked rows.
+// Objects missing from the sink are skipped.
+func (p *pipeline) refresh(ctx context.Context, data *schema.Schema) error {
+	sink, ok := p.sink.(storage.SQLDatabase)
+	if !ok {
+		return nil
+	}
+	db, err := sink.DB(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range data.Sequences {
+		table := data.Table(seq.OwnerTable)
+		if table == nil || table.QualifiedName() != seq.OwnerTable || table.Column(seq.OwnerColumn) == nil {
+			continue
+		}
+		column := pq.QuoteIdentifier(seq.OwnerColumn)
+		query := fmt.Sprintf("SELECT setval(to_regclass($1), max(%s)) FROM %s HAVING to_regclass($1) IS NOT NULL AND max(%s) IS NOT NULL",
+			column, table.QuotedName(), column)
+		if _, err := db.ExecContext(ctx, query, seq.QuotedName()); err != nil {
+			return fmt.Errorf("resetting sequence %s: %w", seq.QualifiedName(), err)
+		}
+	}
+
+	for _, view := range data.Views {
+		if !view.Materialized {
+			continue
+		}
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", view.QuotedName()).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "REFRESH MATERIALIZED VIEW "+view.QuotedName()); err != nil {
+			return fmt.Errorf("refreshing materialized view %s: %w", view.QualifiedName(), err)
+		}
+	}
+	return nil
+}
+
+// removeUnselected drops the tables of s that are not selected and empties
+// the structure-only ones. Structure-only tables are emptied together, so
+// they may reference each other, but not be referenced by a table that keeps
+// its rows.
+func (p *pipeline) removeUnselected(ctx context.Context, s *schema.Schema) error {
+	source, ok := p.source.(storage.SQLDatabase)
+	if !ok {
+		return fmt.Errorf("the database does not support removing tables that are not selected")
+	}
+	db, err := source.DB(ctx)
+	if err != nil {
+		return err
+	}
+
+	var truncate []string
+	for i := range s.Tables {
+		table := &s.Tables[i]
+		switch {
+		case !p.tables.Includes(table):
+			if _, err := db.ExecContext(ctx, "DROP TABLE IF EXISTS "+table.QuotedName()+" CASCADE"); err != nil {
+				return fmt.Errorf("dropping excluded table %s: %w", table.QualifiedName(), err)
+			}
+		case p.tables.IsStructureOnly(table):
+			truncate = append(truncate, table.QuotedName())
+		}
+	}
+	if len(truncate) > 0 {
+		if _, err := db.ExecContext(ctx, "TRUNCATE "+strings.Join(truncate, ", ")); err != nil {
+			return fmt.Errorf("emptying structure-only tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// runSubset creates the selected tables in the sink, then copies the rows of
+// the subset of every table with data. The rows are selected and dumped in a
+// single read-only transaction on source, so tables are copied one at a time.
+// Their dumps hold data only, so the definitions are restored first; tables
+// that already exist in the sink are kept. all is the schema the rows are
+// masked with.
+func (p *pipeline) runSubset(ctx context.Context, all, selected, s *schema.Schema) error {
+	source, ok := p.source.(storage.SQLDatabase)
+	if !ok {
+		return fmt.Errorf("the source database does not support subsetting")
+	}
+	for i := range selected.Tables {
+		table := &selected.Tables[i]
+		definition, err := p.source.DumpTableSchema(ctx, table)
+		if err != nil {
+			return err
+		}
+		err = p.sink.Restore(ctx, definition)
+		closeReader(definition)
+		if err != nil {
+			return fmt.Errorf("creating %s: %w", table.QualifiedName(), err)
+		}
+	}
+
+	db, err := source.DB(ctx)
+	if err != nil {
+		return err
+	}
+	sub, err := selectSubset(ctx, db, s, p.subset)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	for i := range s.Tables {
+		table := &s.Tables[i]
+		if sub.Rows(table.QualifiedName()) == 0 {
+			continue
+		}
+		if err := p.copyTable(ctx, sub.DumpTable(ctx, table), all); err != nil {
+			return fmt.Errorf("copying subset of %s: %w", table.QualifiedName(), err)
+		}
+	}
+	return nil
+}
+
+// copyTable masks a dump and restores it into the sink, closing the dump.
+func (p *pipeline) copyTable(ctx context.Context, dump io.ReadCloser, s *schema.Schema) error {
+	defer dump.Close()
+	masked, err := p.masker.Mask(dump, p.rules, s)
+	if err != nil {
+		return err
+	}
+	defer closeReader(masked)
+	return p.sink.Restore(ctx, masked)
+}
+
+// closeReader closes a dump or masked dump once it was restored. They are
+// written by goroutines that block until they are read to the end, which a
+// sink failing to restore them does not do.
+func closeReader(r io.Reader) {
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// NewWriterSink creates a Sink that appends every masked dump to w. Dumps are
+// written one at a time, so w receives a single well-formed dump.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+// writerSink is an implementation of the Sink interface writing to an io.Writer.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Restore implements the Sink interface.
+func (s *writerSink) Restore(ctx context.Context, in io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.Copy(s.w, in)
+	return err
+}
+
+// NewFileSink creates a Sink that writes every masked dump to the file at path.
+// The file must be closed with Close once the pipeline has finished.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{Sink: NewWriterSink(f), file: f}, nil
+}
+
+// FileSink is a Sink writing to a file.
+type FileSink struct {
+	Sink
+	file *os.File
+}
+
+// Close closes the underlying file.
+func (s *FileSink) Close() error {
+	return s.file.Close()
 }
@@ -0,0 +1,131 @@
+package masking
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/schema"
+	"github.com/Oridak771/Vandal/storage"
+)
+
+// testPostgres returns the PostgreSQL database named by the libpq connection
+// string in VANDAL_TEST_POSTGRES, which tests may freely modify, or skips the
+// test if it is unset.
+func testPostgres(t *testing.T) (storage.Database, *sql.DB) {
+	t.Helper()
+	dsn := os.Getenv("VANDAL_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("VANDAL_TEST_POSTGRES is not set")
+	}
+	cfg, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("parsing VANDAL_TEST_POSTGRES: %v", err)
+	}
+	database := storage.NewPostgresDatabase(cfg.Host, strconv.Itoa(int(cfg.Port)), cfg.User, cfg.Password, cfg.Database, storage.Options{})
+	t.Cleanup(func() { database.Close() })
+	db, err := database.(storage.SQLDatabase).DB(context.Background())
+	if err != nil {
+		t.Fatalf("DB() error = %v", err)
+	}
+	return database, db
+}
+
+func TestPipelineMasksLargeTableInPlace(t *testing.T) {
+	database, db := testPostgres(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Far more rows than the buffers between dumping and restoring hold, so
+	// that the table is restored while it is still being dumped.
+	for _, stmt := range []string{
+		"DROP TABLE IF EXISTS vandal_in_place",
+		"CREATE TABLE vandal_in_place (id integer PRIMARY KEY, email text NOT NULL)",
+		"INSERT INTO vandal_in_place SELECT i, 'user' || i || '@example.com' FROM generate_series(1, 20000) i",
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS vandal_in_place") })
+
+	spec := vandalv1alpha1.DataProfileSpec{Masking: vandalv1alpha1.MaskingSpec{Rules: []vandalv1alpha1.MaskingRule{
+		{Table: "vandal_in_place", Column: "email", Transformation: "redact"},
+	}}}
+	if err := NewPipeline(database, database, NewMasker(), spec).Run(ctx); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	var rows, unmasked int
+	if err := db.QueryRowContext(ctx, "SELECT count(*), count(*) FILTER (WHERE email <> 'REDACTED') FROM vandal_in_place").Scan(&rows, &unmasked); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 20000 || unmasked != 0 {
+		t.Errorf("table has %d rows, %d of them unmasked, want 20000 masked rows", rows, unmasked)
+	}
+}
+
+// streamingDatabase is a source whose tables dump endless rows, written by a
+// goroutine until the dump is closed or its context cancelled.
+type streamingDatabase struct {
+	storage.Database
+	schema  *schema.Schema
+	writers chan error
+}
+
+func (d *streamingDatabase) GetSchema(ctx context.Context) (*schema.Schema, error) {
+	return d.schema, nil
+}
+
+func (d *streamingDatabase) DumpTable(ctx context.Context, table *schema.Table) (io.Reader, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := fmt.Fprintf(pw, "COPY %s (id) FROM stdin;\n", table.QuotedName())
+		for i := 0; err == nil; i++ {
+			_, err = fmt.Fprintf(pw, "%d\n", i)
+		}
+		pw.CloseWithError(err)
+		d.writers <- err
+	}()
+	return pr, nil
+}
+
+// failingSink reads the start of every dump, then fails to restore it.
+type failingSink struct{}
+
+func (failingSink) Restore(ctx context.Context, in io.Reader) error {
+	if _, err := io.ReadFull(in, make([]byte, 64)); err != nil {
+		return err
+	}
+	return errors.New("restore failed")
+}
+
+func TestPipelineStopsDumpingWhenRestoreFails(t *testing.T) {
+	source := &streamingDatabase{
+		schema: &schema.Schema{Tables: []schema.Table{
+			{Schema: "public", Name: "users", Columns: []schema.Column{{Name: "id", Type: "integer"}}},
+			{Schema: "public", Name: "orders", Columns: []schema.Column{{Name: "id", Type: "integer"}}},
+		}},
+		writers: make(chan error, 2),
+	}
+	if err := NewPipeline(source, failingSink{}, NewMasker(), vandalv1alpha1.DataProfileSpec{}).Run(context.Background()); err == nil {
+		t.Fatal("Run() error = nil, want the error of the sink")
+	}
+
+	// The error group stops after the first failure, so the second table
+	// may not have been dumped at all.
+	select {
+	case <-source.writers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the dump of the table is still being written after Run returned")
+	}
+}
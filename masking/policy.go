@@ -0,0 +1,57 @@
+package masking
+
+import (
+	"fmt"
+	"strings"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/schema"
+)
+
+// UnclassifiedColumnsError is returned by a pipeline with the allowlist default
+// action when the source has columns no masking rule covers.
+type UnclassifiedColumnsError struct {
+	// Columns are the uncovered columns, as schema.table.column.
+	Columns []string
+}
+
+func (e *UnclassifiedColumnsError) Error() string {
+	return fmt.Sprintf("default action is allowlist but %d columns have no masking rule, mark them with a transformation or \"passthrough\": %s",
+		len(e.Columns), strings.Join(e.Columns, ", "))
+}
+
+// UnclassifiedColumns returns the columns of s, as schema.table.column, that no
+// rule covers. Foreign keys referencing a covered column, directly or through
+// other foreign keys, are covered by its rule as they are masked the same way.
+func UnclassifiedColumns(s *schema.Schema, rules []vandalv1alpha1.MaskingRule) []string {
+	covered := make(map[columnRef]bool)
+	var queue []columnRef
+	for _, rule := range rules {
+		ref := columnRef{Table: tableKey(s, rule.Table), Column: rule.Column}
+		covered[ref] = true
+		queue = append(queue, ref)
+	}
+
+	refs := referencingColumns(s)
+	for len(queue) > 0 {
+		ref := queue[0]
+		queue = queue[1:]
+		for _, next := range refs[ref] {
+			if !covered[next] {
+				covered[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	var columns []string
+	for _, table := range s.Tables {
+		for _, column := range table.Columns {
+			ref := columnRef{Table: table.QualifiedName(), Column: column.Name}
+			if !covered[ref] {
+				columns = append(columns, ref.String())
+			}
+		}
+	}
+	return columns
+}
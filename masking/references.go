@@ -0,0 +1,147 @@
+package masking
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Oridak771/Vandal/schema"
+)
+
+// columnRef identifies a column of a table.
+type columnRef struct {
+	Table  string
+	Column string
+}
+
+func (c columnRef) String() string {
+	return c.Table + "." + c.Column
+}
+
+// collapsingRules are transformations that map many inputs to the same output.
+// They cannot be applied to primary keys or unique columns without breaking
+// uniqueness.
+var collapsingRules = map[string]bool{
+	"redact":     true,
+	"null":       true,
+	"synthesize": true,
+	"creditCard": true,
+	"truncate":   true,
+}
+
+// collapses reports whether a transformation maps many values of a column to
+// the same one. Hashes of integer columns are reduced to the range of the
+// column, so they collide too; fpe masks such columns one-to-one.
+func collapses(transformation string, column *schema.Column) bool {
+	if transformation == "hash" {
+		return column != nil && classifyType(column.Type) == classInteger
+	}
+	return collapsingRules[transformation]
+}
+
+// isDeterministic reports whether t always maps identical inputs to identical
+// outputs.
+func isDeterministic(t Transformer) bool {
+	switch t := t.(type) {
+	case *nameTransformer:
+		return t.faker.key != nil
+	case *addressTransformer:
+		return t.faker.key != nil
+	case *dateTimeTransformer:
+		return t.faker.key != nil
+	case *dateShiftTransformer:
+		return t.faker.key != nil
+	case *synthesizeTransformer:
+		return t.faker.key != nil
+	case *truncateTransformer:
+		return isDeterministic(t.Transformer)
+	}
+	return true
+}
+
+// referencingColumns returns, for every column referenced by a foreign key,
+// the foreign key columns referencing it. Tables are named by tableKey.
+func referencingColumns(s *schema.Schema) map[columnRef][]columnRef {
+	refs := make(map[columnRef][]columnRef)
+	for _, table := range s.Tables {
+		for _, column := range table.Columns {
+			if !column.IsForeignKey || column.ForeignKeyTable == "" {
+				continue
+			}
+			target := columnRef{Table: tableKey(s, column.ForeignKeyQualifiedTable()), Column: column.ForeignKeyColumn}
+			refs[target] = append(refs[target], columnRef{Table: table.QualifiedName(), Column: column.Name})
+		}
+	}
+	return refs
+}
+
+// propagateKeys applies the transformer of every masked column to all foreign
+// key columns referencing it, directly or through other foreign keys, so that
+// masked rows keep referencing each other. transformations holds the
+// transformation name of every explicitly masked column.
+func (m *defaultMasker) propagateKeys(transformers ruleTransformers, transformations map[columnRef]string, s *schema.Schema) error {
+	refs := referencingColumns(s)
+
+	// Masked columns that themselves reference a masked column take the
+	// transformer of the column they reference, so those are handled first.
+	sources := make([]columnRef, 0, len(transformations))
+	downstream := make(map[columnRef]bool)
+	for source := range transformations {
+		sources = append(sources, source)
+		for _, ref := range refs[source] {
+			downstream[ref] = true
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if downstream[sources[i]] != downstream[sources[j]] {
+			return !downstream[sources[i]]
+		}
+		return sources[i].String() < sources[j].String()
+	})
+
+	assigned := make(map[columnRef]bool)
+	for _, source := range sources {
+		transformation := transformations[source]
+		if table := s.Table(source.Table); table != nil {
+			column := table.Column(source.Column)
+			if column != nil && column.IsPrimaryKey && collapses(transformation, column) {
+				return fmt.Errorf("transformation %q cannot be applied to primary key %s, it would make its values collide", transformation, source)
+			}
+			if table.IsUnique(source.Column) && collapses(transformation, column) {
+				return fmt.Errorf("transformation %q cannot be applied to unique column %s, it would make its values collide", transformation, source)
+			}
+		}
+		if len(refs[source]) == 0 || assigned[source] {
+			continue
+		}
+
+		// Rows of different tables are masked independently, so only a
+		// transformer mapping a value to the same output wherever it meets it
+		// keeps them referencing each other.
+		t := transformers[source.Table][source.Column]
+		if !isDeterministic(t) {
+			return fmt.Errorf("transformation %q of %s is not deterministic without a masking key, so the foreign keys referencing it would not match; set keySecretRef or use hash or fpe", transformation, source)
+		}
+
+		queue := append([]columnRef(nil), refs[source]...)
+		visited := map[columnRef]bool{source: true}
+		for len(queue) > 0 {
+			ref := queue[0]
+			queue = queue[1:]
+			if visited[ref] {
+				continue
+			}
+			visited[ref] = true
+
+			if other, ok := transformations[ref]; ok && other != transformation {
+				return fmt.Errorf("column %s references %s but is masked with %q instead of %q", ref, source, other, transformation)
+			}
+			if transformers[ref.Table] == nil {
+				transformers[ref.Table] = make(map[string]Transformer)
+			}
+			transformers[ref.Table][ref.Column] = t
+			assigned[ref] = true
+			queue = append(queue, refs[ref]...)
+		}
+	}
+	return nil
+}
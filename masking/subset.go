@@ -0,0 +1,286 @@
+package masking
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/pkg/copytext"
+	"github.com/Oridak771/Vandal/schema"
+)
+
+// subsetChunkSize is the number of rows looked up per query.
+const subsetChunkSize = 10000
+
+// subset is the set of rows of every table selected by a SubsetSpec, keyed by
+// qualified table name. Rows are identified by their ctid, which is stable
+// within the read-only transaction the subset is selected and dumped in.
+type subset struct {
+	// mu serializes the use of tx, which runs one query at a time.
+	mu   sync.Mutex
+	tx   *sql.Tx
+	rows map[string][]string
+}
+
+// foreignKey is a single-column foreign key from Column of Table to RefColumn
+// of RefTable. Tables are named by their qualified names.
+type foreignKey struct {
+	Table, Column       string
+	RefTable, RefColumn string
+}
+
+// foreignKeys returns the foreign keys of s between tables of s.
+func foreignKeys(s *schema.Schema) []foreignKey {
+	var fks []foreignKey
+	for _, table := range s.Tables {
+		for _, column := range table.Columns {
+			if !column.IsForeignKey || column.ForeignKeyTable == "" {
+				continue
+			}
+			if ref := s.Table(column.ForeignKeyQualifiedTable()); ref != nil {
+				fks = append(fks, foreignKey{table.QualifiedName(), column.Name, ref.QualifiedName(), column.ForeignKeyColumn})
+			}
+		}
+	}
+	return fks
+}
+
+// subsetFrontier are rows newly added to a subset whose foreign keys have not
+// been followed yet. Rows selected directly or by following references
+// downwards also pull in the rows referencing them, if requested; rows added
+// because they are referenced do not.
+type subsetFrontier struct {
+	table string
+	ctids []string
+	down  bool
+}
+
+// selectSubset selects the rows of spec in db and every row they reference,
+// recursively. The returned subset holds a read-only transaction open until
+// Close is called.
+func selectSubset(ctx context.Context, db *sql.DB, s *schema.Schema, spec *vandalv1alpha1.SubsetSpec) (*subset, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	sub := &subset{tx: tx, rows: make(map[string][]string)}
+
+	selected := make(map[string]map[string]bool)
+	selectedDown := make(map[string]map[string]bool)
+	add := func(table string, ctids []string, down bool) []string {
+		if selected[table] == nil {
+			selected[table] = make(map[string]bool)
+			selectedDown[table] = make(map[string]bool)
+		}
+		var added []string
+		for _, ctid := range ctids {
+			if down && !selectedDown[table][ctid] {
+				selectedDown[table][ctid] = true
+				added = append(added, ctid)
+			} else if !down && !selected[table][ctid] {
+				added = append(added, ctid)
+			}
+			selected[table][ctid] = true
+		}
+		return added
+	}
+
+	var queue []subsetFrontier
+	for _, ts := range spec.Tables {
+		table := s.Table(ts.Table)
+		if table == nil {
+			sub.Close()
+			return nil, fmt.Errorf("subset table %s is not in the schema", ts.Table)
+		}
+		query := "SELECT ctid::text FROM " + table.QuotedName()
+		if ts.Percent > 0 && ts.Percent < 100 {
+			query += fmt.Sprintf(" TABLESAMPLE BERNOULLI (%d)", ts.Percent)
+		}
+		if ts.Where != "" {
+			query += " WHERE (" + ts.Where + ")"
+		}
+		ctids, err := sub.queryStrings(ctx, query)
+		if err != nil {
+			sub.Close()
+			return nil, fmt.Errorf("selecting rows of %s: %w", ts.Table, err)
+		}
+		name := table.QualifiedName()
+		queue = append(queue, subsetFrontier{name, add(name, ctids, true), true})
+	}
+
+	fks := foreignKeys(s)
+	quoted := func(table string) string {
+		return s.Table(table).QuotedName()
+	}
+	for len(queue) > 0 {
+		f := queue[0]
+		queue = queue[1:]
+		if len(f.ctids) == 0 {
+			continue
+		}
+
+		for _, fk := range fks {
+			if fk.Table == f.table {
+				query := fmt.Sprintf("SELECT p.ctid::text FROM %s p WHERE p.%s IN (SELECT c.%s FROM %s c WHERE c.ctid = ANY($1::tid[]))",
+					quoted(fk.RefTable), pq.QuoteIdentifier(fk.RefColumn), pq.QuoteIdentifier(fk.Column), quoted(fk.Table))
+				ctids, err := sub.queryChunked(ctx, query, f.ctids)
+				if err != nil {
+					sub.Close()
+					return nil, fmt.Errorf("following %s.%s: %w", fk.Table, fk.Column, err)
+				}
+				queue = append(queue, subsetFrontier{fk.RefTable, add(fk.RefTable, ctids, false), false})
+			}
+			if spec.FollowReferencing && f.down && fk.RefTable == f.table {
+				query := fmt.Sprintf("SELECT c.ctid::text FROM %s c WHERE c.%s IN (SELECT p.%s FROM %s p WHERE p.ctid = ANY($1::tid[]))",
+					quoted(fk.Table), pq.QuoteIdentifier(fk.Column), pq.QuoteIdentifier(fk.RefColumn), quoted(fk.RefTable))
+				ctids, err := sub.queryChunked(ctx, query, f.ctids)
+				if err != nil {
+					sub.Close()
+					return nil, fmt.Errorf("following references to %s.%s: %w", fk.RefTable, fk.RefColumn, err)
+				}
+				queue = append(queue, subsetFrontier{fk.Table, add(fk.Table, ctids, true), true})
+			}
+		}
+	}
+
+	for table, ctids := range selected {
+		for ctid := range ctids {
+			sub.rows[table] = append(sub.rows[table], ctid)
+		}
+		sort.Strings(sub.rows[table])
+	}
+	return sub, nil
+}
+
+// queryStrings runs a query returning a single text column.
+func (s *subset) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rows, err := s.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// queryChunked runs a query taking an array of ctids as $1 for chunks of
+// ctids, and returns the concatenated results.
+func (s *subset) queryChunked(ctx context.Context, query string, ctids []string) ([]string, error) {
+	var values []string
+	for start := 0; start < len(ctids); start += subsetChunkSize {
+		end := start + subsetChunkSize
+		if end > len(ctids) {
+			end = len(ctids)
+		}
+		chunk, err := s.queryStrings(ctx, query, pq.Array(ctids[start:end]))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, chunk...)
+	}
+	return values, nil
+}
+
+// Rows returns the number of rows of a table, given by qualified name, in the
+// subset.
+func (s *subset) Rows(table string) int {
+	return len(s.rows[table])
+}
+
+// DumpTable returns the rows of a table in the subset as a plain-format COPY
+// block, as pg_dump writes them. Tables are dumped one at a time; the caller
+// must read the dump to the end or close it before dumping the next table.
+func (s *subset) DumpTable(ctx context.Context, table *schema.Table) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.writeTable(ctx, pw, table))
+	}()
+	return pr
+}
+
+func (s *subset) writeTable(ctx context.Context, out io.Writer, table *schema.Table) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, len(table.Columns))
+	selects := make([]string, len(table.Columns))
+	for i, c := range table.Columns {
+		names[i] = pq.QuoteIdentifier(c.Name)
+		selects[i] = names[i] + "::text"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE ctid = ANY($1::tid[]) ORDER BY ctid",
+		strings.Join(selects, ", "), table.QuotedName())
+
+	w := bufio.NewWriterSize(out, 64*1024)
+	fmt.Fprintf(w, "COPY %s (%s) FROM stdin;\n", table.QuotedName(), strings.Join(names, ", "))
+
+	values := make([]sql.NullString, len(table.Columns))
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	fields := make([]*string, len(values))
+
+	ctids := s.rows[table.QualifiedName()]
+	for start := 0; start < len(ctids); start += subsetChunkSize {
+		end := start + subsetChunkSize
+		if end > len(ctids) {
+			end = len(ctids)
+		}
+		rows, err := s.tx.QueryContext(ctx, query, pq.Array(ctids[start:end]))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+			for i := range values {
+				fields[i] = nil
+				if values[i].Valid {
+					fields[i] = &values[i].String
+				}
+			}
+			if _, err := w.WriteString(copytext.JoinRow(fields) + "\n"); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.WriteString(copytext.Terminator + "\n"); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Close ends the transaction of the subset.
+func (s *subset) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tx.Rollback()
+}
@@ -0,0 +1,174 @@
+package masking
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+
+	"github.com/Oridak771/Vandal/schema"
+)
+
+// synthesizeTransformer implements the Transformer interface for synthesizing
+// realistic values. Once adapted to a column by forColumn, it picks a
+// generator from the column name, e.g. emails for an "email" column, and
+// otherwise from the column type. With useStats set it draws from the column
+// statistics collected from the source where available: the range of numeric
+// and date columns, and the distinct values of numeric and boolean columns
+// with few of them. Those of text columns are left out, as they are values of
+// the source, such as its most common names or emails.
+type synthesizeTransformer struct {
+	faker    *keyedFaker
+	useStats bool
+
+	column *schema.Column
+	class  typeClass
+}
+
+// Transform implements the Transformer interface.
+func (t *synthesizeTransformer) Transform(value string) (string, error) {
+	f := t.faker.For(value)
+	if t.column == nil {
+		return f.Word(), nil
+	}
+
+	var stats *schema.ColumnStats
+	if t.useStats {
+		stats = t.column.Stats
+	}
+	if stats != nil && len(stats.Values) > 0 && (t.class == classInteger || t.class == classNumeric || t.class == classBoolean) {
+		return f.RandomString(stats.Values), nil
+	}
+
+	switch t.class {
+	case classInteger:
+		min, max := statsRange(stats, 1, 1000000)
+		return strconv.FormatInt(integerInRange(f, min, max, integerMax(t.column.Type)), 10), nil
+	case classNumeric:
+		min, max := statsRange(stats, 0, 1000)
+		// Interpolated rather than offset by max-min, which overflows for
+		// the widest ranges.
+		u := f.Float64Range(0, 1)
+		return strconv.FormatFloat(min*(1-u)+max*u, 'f', 2, 64), nil
+	case classDate, classTimestamp, classTimestampTZ:
+		return t.synthesizeTime(f, stats), nil
+	case classUUID:
+		return f.UUID(), nil
+	case classBoolean:
+		if f.Bool() {
+			return "t", nil
+		}
+		return "f", nil
+	case classEnum:
+		return f.RandomString(t.column.EnumValues), nil
+	}
+
+	if generate := nameGenerator(t.column.Name); generate != nil {
+		return generate(f), nil
+	}
+	return f.Word(), nil
+}
+
+// synthesizeTime returns a date or timestamp in the format of the column,
+// within the range of the column statistics or a fixed ten year range.
+func (t *synthesizeTransformer) synthesizeTime(f *gofakeit.Faker, stats *schema.ColumnStats) string {
+	end := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := end.AddDate(-10, 0, 0)
+	if stats != nil {
+		min, _, minOK := parseDate(stats.Min)
+		max, _, maxOK := parseDate(stats.Max)
+		if minOK && maxOK && !max.Before(min) {
+			start, end = min, max
+		}
+	}
+
+	d := f.DateRange(start, end).UTC()
+	switch t.class {
+	case classDate:
+		return d.Format("2006-01-02")
+	case classTimestamp:
+		return d.Format("2006-01-02 15:04:05")
+	}
+	return d.Format(time.RFC3339)
+}
+
+// statsRange returns the numeric range of a column from its statistics, or
+// the given default range.
+func statsRange(stats *schema.ColumnStats, min, max float64) (float64, float64) {
+	if stats == nil {
+		return min, max
+	}
+	lo, errLo := strconv.ParseFloat(stats.Min, 64)
+	hi, errHi := strconv.ParseFloat(stats.Max, 64)
+	if errLo != nil || errHi != nil || hi < lo {
+		return min, max
+	}
+	return lo, hi
+}
+
+// integerInRange returns an integer between min and max, both clamped to the
+// range of a column whose largest value is limit.
+func integerInRange(f *gofakeit.Faker, min, max float64, limit uint64) int64 {
+	clamp := func(v float64) int64 {
+		// float64(limit) rounds up to 2^63 for bigint columns, which does
+		// not convert to an int64.
+		switch {
+		case v >= float64(limit):
+			return int64(limit)
+		case v <= -float64(limit):
+			return -int64(limit)
+		}
+		return int64(v)
+	}
+	lo, hi := clamp(min), clamp(max)
+	// At most 2^64-2, as limit is below 2^63.
+	span := uint64(hi) - uint64(lo)
+	return lo + int64(f.Uint64()%(span+1))
+}
+
+// nameGenerators map words found in column names to generators of matching
+// values. They are tried in order, so more specific words come first.
+var nameGenerators = []struct {
+	words    []string
+	generate func(*gofakeit.Faker) string
+}{
+	{[]string{"email", "mail"}, (*gofakeit.Faker).Email},
+	{[]string{"phone", "mobile", "fax", "tel"}, (*gofakeit.Faker).Phone},
+	{[]string{"uuid", "guid"}, (*gofakeit.Faker).UUID},
+	{[]string{"firstname", "first_name", "given_name"}, (*gofakeit.Faker).FirstName},
+	{[]string{"lastname", "last_name", "surname", "family_name"}, (*gofakeit.Faker).LastName},
+	{[]string{"username", "user_name", "login"}, (*gofakeit.Faker).Username},
+	{[]string{"company", "organization", "employer"}, (*gofakeit.Faker).Company},
+	{[]string{"name"}, (*gofakeit.Faker).Name},
+	{[]string{"street", "address"}, (*gofakeit.Faker).Street},
+	{[]string{"city", "town"}, (*gofakeit.Faker).City},
+	{[]string{"state", "province", "region"}, (*gofakeit.Faker).State},
+	{[]string{"country"}, (*gofakeit.Faker).Country},
+	{[]string{"zip", "postal", "postcode"}, (*gofakeit.Faker).Zip},
+	{[]string{"url", "website", "homepage"}, (*gofakeit.Faker).URL},
+	{[]string{"ip_address", "ipaddress", "ip"}, (*gofakeit.Faker).IPv4Address},
+	{[]string{"description", "comment", "note", "bio"}, func(f *gofakeit.Faker) string { return f.Sentence(8) }},
+}
+
+// nameGenerator returns the generator for a column name, or nil if none of
+// the words of nameGenerators occurs in it. Words of up to three letters, such
+// as "ip", only match whole words of the name.
+func nameGenerator(column string) func(*gofakeit.Faker) string {
+	name := strings.ToLower(column)
+	parts := strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == ' ' })
+	for _, g := range nameGenerators {
+		for _, word := range g.words {
+			if len(word) <= 3 {
+				for _, part := range parts {
+					if part == word {
+						return g.generate
+					}
+				}
+			} else if strings.Contains(name, word) {
+				return g.generate
+			}
+		}
+	}
+	return nil
+}
@@ -1,11 +1,14 @@
 package masking
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"strconv"
 	"time"
 
-	"github.com/brianvoe/gofakeit/v6"
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
 )
 
 // Transformer defines the interface for a data transformer.
@@ -14,56 +17,183 @@ type Transformer interface {
 	Transform(value string) (string, error)
 }
 
-// NewTransformer creates a new transformer for the given rule.
-func NewTransformer(rule string) (Transformer, error) {
-	switch rule {
+// NewTransformer creates a new transformer for the given transformation and
+// its parameters, which may be nil.
+func NewTransformer(transformation string, params *vandalv1alpha1.TransformationParams) (Transformer, error) {
+	return NewKeyedTransformer(transformation, params, nil)
+}
+
+// NewKeyedTransformer creates a new transformer for the given transformation
+// that derives its output from an HMAC of the input with key, so identical
+// inputs always map to identical outputs. A nil key gives the same random
+// output as NewTransformer.
+func NewKeyedTransformer(transformation string, params *vandalv1alpha1.TransformationParams, key []byte) (Transformer, error) {
+	if params == nil {
+		params = &vandalv1alpha1.TransformationParams{}
+	}
+	if err := validateParams(transformation, params); err != nil {
+		return nil, err
+	}
+
+	t, err := newTransformer(transformation, params, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := t.(*nullTransformer); !ok && params.MaxLength > 0 {
+		t = &truncateTransformer{Transformer: t, maxLength: int(params.MaxLength)}
+	}
+	return t, nil
+}
+
+func newTransformer(transformation string, params *vandalv1alpha1.TransformationParams, key []byte) (Transformer, error) {
+	switch transformation {
 	case "hash":
-		return &hashTransformer{}, nil
+		return &hashTransformer{key: key, salt: []byte(params.Salt)}, nil
 	case "redact":
-		return &redactTransformer{}, nil
+		return newRedactTransformer(params), nil
 	case "synthesize":
-		return &synthesizeTransformer{}, nil
+		return &synthesizeTransformer{faker: newKeyedFaker(key), useStats: params.UseStatistics}, nil
 	case "creditCard":
 		return &creditCardTransformer{}, nil
 	case "name":
-		return &nameTransformer{}, nil
+		return &nameTransformer{faker: newKeyedFaker(key)}, nil
 	case "address":
-		return &addressTransformer{}, nil
+		return &addressTransformer{faker: newKeyedFaker(key)}, nil
 	case "dateTime":
-		return &dateTimeTransformer{}, nil
+		return &dateTimeTransformer{faker: newKeyedFaker(key)}, nil
+	case "dateShift":
+		return &dateShiftTransformer{faker: newKeyedFaker(key), shiftDays: int(params.ShiftDays)}, nil
+	case "truncate", "passthrough":
+		return identityTransformer{}, nil
 	case "null":
 		return &nullTransformer{}, nil
+	case "fpe":
+		fpe, err := NewFPE(key)
+		if err != nil {
+			return nil, err
+		}
+		return &fpeTransformer{fpe: fpe}, nil
 	default:
-		return nil, fmt.Errorf("unknown transformation rule: %s", rule)
+		return nil, fmt.Errorf("unknown transformation rule: %s", transformation)
+	}
+}
+
+// validateParams checks that params only sets parameters the transformation
+// accepts, and all the parameters it requires. MaxLength is accepted by every
+// transformation.
+func validateParams(transformation string, params *vandalv1alpha1.TransformationParams) error {
+	set := map[string]bool{
+		"salt":          params.Salt != "",
+		"keepFirst":     params.KeepFirst != 0,
+		"keepLast":      params.KeepLast != 0,
+		"maskChar":      params.MaskChar != "",
+		"shiftDays":     params.ShiftDays != 0,
+		"useStatistics": params.UseStatistics,
+	}
+	accepted := map[string][]string{
+		"hash":       {"salt"},
+		"redact":     {"keepFirst", "keepLast", "maskChar"},
+		"dateShift":  {"shiftDays"},
+		"synthesize": {"useStatistics"},
+	}
+	for name, ok := range set {
+		if !ok {
+			continue
+		}
+		found := false
+		for _, a := range accepted[transformation] {
+			found = found || a == name
+		}
+		if !found {
+			return fmt.Errorf("parameter %s is not supported by transformation %s", name, transformation)
+		}
+	}
+
+	switch {
+	case params.KeepFirst < 0 || params.KeepLast < 0 || params.ShiftDays < 0 || params.MaxLength < 0:
+		return fmt.Errorf("parameters of transformation %s must not be negative", transformation)
+	case len([]rune(params.MaskChar)) > 1:
+		return fmt.Errorf("parameter maskChar must be a single character")
+	case transformation == "dateShift" && params.ShiftDays == 0:
+		return fmt.Errorf("transformation dateShift requires parameter shiftDays")
+	case transformation == "truncate" && params.MaxLength == 0:
+		return fmt.Errorf("transformation truncate requires parameter maxLength")
 	}
+	return nil
+}
+
+// hashTransformer implements the Transformer interface for hashing. With a key
+// it computes an HMAC, which cannot be reversed by hashing guessed inputs.
+type hashTransformer struct {
+	key  []byte
+	salt []byte
+
+	// format and max shape the digest for the column type, see forColumn.
+	format hashFormat
+	max    uint64
 }
 
-// hashTransformer implements the Transformer interface for hashing.
-type hashTransformer struct{}
+// hashFormat is the representation of a digest.
+type hashFormat int
+
+const (
+	hashHex hashFormat = iota
+	hashInteger
+	hashUUID
+)
 
 // Transform implements the Transformer interface.
 func (t *hashTransformer) Transform(value string) (string, error) {
 	h := sha256.New()
+	if t.key != nil {
+		h = hmac.New(sha256.New, t.key)
+	}
+	h.Write(t.salt)
 	h.Write([]byte(value))
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
-}
+	sum := h.Sum(nil)
 
-// redactTransformer implements the Transformer interface for redacting.
-type redactTransformer struct{}
+	switch t.format {
+	case hashInteger:
+		return strconv.FormatUint(binary.BigEndian.Uint64(sum)%t.max+1, 10), nil
+	case hashUUID:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16]), nil
+	}
+	return fmt.Sprintf("%x", sum), nil
+}
 
-// Transform implements the Transformer interface.
-func (t *redactTransformer) Transform(value string) (string, error) {
-	return "REDACTED", nil
+// redactTransformer implements the Transformer interface for redacting. By
+// default it replaces the whole value; with keepFirst, keepLast or maskChar
+// set it masks every character except the kept ones instead.
+type redactTransformer struct {
+	partial   bool
+	keepFirst int
+	keepLast  int
+	maskChar  rune
 }
 
-// synthesizeTransformer implements the Transformer interface for synthesizing.
-type synthesizeTransformer struct{}
+func newRedactTransformer(params *vandalv1alpha1.TransformationParams) *redactTransformer {
+	t := &redactTransformer{
+		partial:   params.KeepFirst > 0 || params.KeepLast > 0 || params.MaskChar != "",
+		keepFirst: int(params.KeepFirst),
+		keepLast:  int(params.KeepLast),
+		maskChar:  '*',
+	}
+	if params.MaskChar != "" {
+		t.maskChar = []rune(params.MaskChar)[0]
+	}
+	return t
+}
 
 // Transform implements the Transformer interface.
-func (t *synthesizeTransformer) Transform(value string) (string, error) {
-	// This is a placeholder implementation.
-	// In a real implementation, this would generate synthetic data.
-	return "SYNTHESIZED", nil
+func (t *redactTransformer) Transform(value string) (string, error) {
+	if !t.partial {
+		return "REDACTED", nil
+	}
+	runes := []rune(value)
+	for i := t.keepFirst; i < len(runes)-t.keepLast; i++ {
+		runes[i] = t.maskChar
+	}
+	return string(runes), nil
 }
 
 // creditCardTransformer implements the Transformer interface for credit card numbers.
@@ -78,30 +208,108 @@ func (t *creditCardTransformer) Transform(value string) (string, error) {
 }
 
 // nameTransformer implements the Transformer interface for names.
-type nameTransformer struct{}
+type nameTransformer struct {
+	faker *keyedFaker
+}
 
 // Transform implements the Transformer interface.
 func (t *nameTransformer) Transform(value string) (string, error) {
-	return gofakeit.Name(), nil
+	return t.faker.For(value).Name(), nil
 }
 
 // addressTransformer implements the Transformer interface for addresses.
-type addressTransformer struct{}
+type addressTransformer struct {
+	faker *keyedFaker
+}
 
 // Transform implements the Transformer interface.
 func (t *addressTransformer) Transform(value string) (string, error) {
-	return gofakeit.Address().Address, nil
+	return t.faker.For(value).Address().Address, nil
 }
 
 // dateTimeTransformer implements the Transformer interface for date/time values.
-type dateTimeTransformer struct{}
+type dateTimeTransformer struct {
+	faker *keyedFaker
+	// layout is the output format, RFC 3339 unless set for a column type.
+	layout string
+}
 
 // Transform implements the Transformer interface.
 func (t *dateTimeTransformer) Transform(value string) (string, error) {
-	return gofakeit.Date().Format(time.RFC3339), nil
+	layout := t.layout
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	return t.faker.For(value).Date().Format(layout), nil
+}
+
+// dateShiftTransformer implements the Transformer interface for moving dates
+// by up to shiftDays days in either direction, keeping their format.
+type dateShiftTransformer struct {
+	faker     *keyedFaker
+	shiftDays int
+}
+
+// dateLayouts are the date and timestamp formats understood by parseDate,
+// covering PostgreSQL's text output and RFC 3339.
+var dateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	time.RFC3339Nano,
+}
+
+// parseDate parses a date or timestamp, returning the layout it is in.
+func parseDate(value string) (time.Time, string, bool) {
+	for _, layout := range dateLayouts {
+		if d, err := time.Parse(layout, value); err == nil {
+			return d, layout, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// Transform implements the Transformer interface.
+func (t *dateShiftTransformer) Transform(value string) (string, error) {
+	d, layout, ok := parseDate(value)
+	if !ok {
+		return "", fmt.Errorf("dateShift: unrecognized date %q", value)
+	}
+	days := t.faker.For(value).Rand.Intn(2*t.shiftDays+1) - t.shiftDays
+	return d.AddDate(0, 0, days).Format(layout), nil
+}
+
+// truncateTransformer wraps a Transformer, truncating its output to maxLength
+// characters.
+type truncateTransformer struct {
+	Transformer
+	maxLength int
+}
+
+// Transform implements the Transformer interface.
+func (t *truncateTransformer) Transform(value string) (string, error) {
+	v, err := t.Transformer.Transform(value)
+	if err != nil {
+		return "", err
+	}
+	if runes := []rune(v); len(runes) > t.maxLength {
+		v = string(runes[:t.maxLength])
+	}
+	return v, nil
+}
+
+// identityTransformer implements the Transformer interface, returning values
+// unchanged.
+type identityTransformer struct{}
+
+// Transform implements the Transformer interface.
+func (identityTransformer) Transform(value string) (string, error) {
+	return value, nil
 }
 
 // nullTransformer implements the Transformer interface for nullifying values.
+// The masker writes SQL NULL in place of its output.
 type nullTransformer struct{}
 
 // Transform implements the Transformer interface.
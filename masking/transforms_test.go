@@ -0,0 +1,83 @@
+package masking
+
+import (
+	"testing"
+	"time"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+)
+
+func TestKeyedTransformerIsDeterministic(t *testing.T) {
+	for _, rule := range []string{"hash", "name", "address", "dateTime"} {
+		a, err := NewKeyedTransformer(rule, nil, []byte("key"))
+		if err != nil {
+			t.Fatalf("NewKeyedTransformer(%q) error = %v", rule, err)
+		}
+		b, _ := NewKeyedTransformer(rule, nil, []byte("key"))
+		other, _ := NewKeyedTransformer(rule, nil, []byte("other key"))
+
+		x, _ := a.Transform("Alice Smith")
+		y, _ := b.Transform("Alice Smith")
+		z, _ := other.Transform("Alice Smith")
+		if x != y {
+			t.Errorf("%s: same key and input gave %q and %q", rule, x, y)
+		}
+		if x == z {
+			t.Errorf("%s: different keys gave the same output %q", rule, x)
+		}
+	}
+}
+
+func TestTransformerParams(t *testing.T) {
+	for _, tc := range []struct {
+		transformation string
+		params         vandalv1alpha1.TransformationParams
+		in, want       string
+	}{
+		{"redact", vandalv1alpha1.TransformationParams{KeepLast: 2}, "5551234", "*****34"},
+		{"redact", vandalv1alpha1.TransformationParams{KeepFirst: 1, MaskChar: "x"}, "secret", "sxxxxx"},
+		{"truncate", vandalv1alpha1.TransformationParams{MaxLength: 3}, "abcdef", "abc"},
+		{"hash", vandalv1alpha1.TransformationParams{MaxLength: 8}, "a", "ca978112"},
+	} {
+		tr, err := NewTransformer(tc.transformation, &tc.params)
+		if err != nil {
+			t.Fatalf("NewTransformer(%s) error = %v", tc.transformation, err)
+		}
+		if got, _ := tr.Transform(tc.in); got != tc.want {
+			t.Errorf("%s(%q) = %q, want %q", tc.transformation, tc.in, got, tc.want)
+		}
+	}
+
+	shift, err := NewTransformer("dateShift", &vandalv1alpha1.TransformationParams{ShiftDays: 30})
+	if err != nil {
+		t.Fatalf("NewTransformer(dateShift) error = %v", err)
+	}
+	got, err := shift.Transform("2024-03-01 10:00:00")
+	if err != nil {
+		t.Fatalf("dateShift error = %v", err)
+	}
+	d, err := time.Parse("2006-01-02 15:04:05", got)
+	if err != nil {
+		t.Fatalf("dateShift changed the format: %q", got)
+	}
+	if diff := d.Sub(time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)); diff < -30*24*time.Hour || diff > 30*24*time.Hour {
+		t.Errorf("dateShift moved the date by %v", diff)
+	}
+}
+
+func TestTransformerParamsValidation(t *testing.T) {
+	for _, tc := range []struct {
+		transformation string
+		params         vandalv1alpha1.TransformationParams
+	}{
+		{"redact", vandalv1alpha1.TransformationParams{Salt: "x"}},
+		{"hash", vandalv1alpha1.TransformationParams{ShiftDays: 3}},
+		{"dateShift", vandalv1alpha1.TransformationParams{}},
+		{"truncate", vandalv1alpha1.TransformationParams{}},
+		{"redact", vandalv1alpha1.TransformationParams{KeepLast: -1}},
+	} {
+		if _, err := NewTransformer(tc.transformation, &tc.params); err == nil {
+			t.Errorf("NewTransformer(%s, %+v) succeeded, want an error", tc.transformation, tc.params)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package client
 
 import (
-	"context"
 	"path/filepath"
 
 	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
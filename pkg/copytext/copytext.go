@@ -0,0 +1,254 @@
+// Package copytext reads and writes the text format of PostgreSQL COPY
+// statements, in which dumps are exchanged between databases and the masker.
+package copytext
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Null is the marker PostgreSQL uses for NULL in COPY text format.
+const Null = `\N`
+
+// Terminator marks the end of the data rows of a COPY block.
+const Terminator = `\.`
+
+// Header describes a "COPY ... FROM stdin;" statement.
+type Header struct {
+	// Schema is the schema qualifier of the table, if any.
+	Schema string
+	// Table is the unqualified table name.
+	Table string
+	// Columns is the column list of the statement, if any.
+	Columns []string
+}
+
+// ParseHeader parses a "COPY table (col, ...) FROM stdin;" line as written
+// by pg_dump. It returns false if the line is not a COPY FROM stdin statement.
+func ParseHeader(line string) (*Header, bool, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) < 5 || !strings.EqualFold(line[:5], "COPY ") {
+		return nil, false, nil
+	}
+	rest := strings.TrimSpace(line[5:])
+
+	names, rest, err := parseQualifiedName(rest)
+	if err != nil {
+		return nil, false, err
+	}
+	header := &Header{Table: names[len(names)-1]}
+	if len(names) > 1 {
+		header.Schema = names[len(names)-2]
+	}
+
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, "(") {
+		rest = rest[1:]
+		for {
+			var name string
+			name, rest, err = parseIdentifier(strings.TrimSpace(rest))
+			if err != nil {
+				return nil, false, err
+			}
+			header.Columns = append(header.Columns, name)
+			rest = strings.TrimSpace(rest)
+			if strings.HasPrefix(rest, ",") {
+				rest = rest[1:]
+				continue
+			}
+			if strings.HasPrefix(rest, ")") {
+				rest = strings.TrimSpace(rest[1:])
+				break
+			}
+			return nil, false, fmt.Errorf("malformed column list in COPY statement: %s", line)
+		}
+	}
+
+	upper := strings.ToUpper(rest)
+	if !strings.HasPrefix(upper, "FROM STDIN") {
+		return nil, false, nil
+	}
+	if strings.Contains(upper, "BINARY") || strings.Contains(upper, "CSV") {
+		return nil, false, fmt.Errorf("unsupported COPY format, only text format is supported: %s", line)
+	}
+	return header, true, nil
+}
+
+// parseQualifiedName parses a possibly schema-qualified, possibly quoted name
+// and returns its parts and the remainder of the input.
+func parseQualifiedName(s string) ([]string, string, error) {
+	var names []string
+	for {
+		name, rest, err := parseIdentifier(s)
+		if err != nil {
+			return nil, "", err
+		}
+		names = append(names, name)
+		if !strings.HasPrefix(rest, ".") {
+			return names, rest, nil
+		}
+		s = rest[1:]
+	}
+}
+
+// parseIdentifier parses a single SQL identifier. Quoted identifiers keep their
+// case, unquoted identifiers are folded to lower case as PostgreSQL does.
+func parseIdentifier(s string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '"' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '"' {
+				b.WriteByte('"')
+				i++
+				continue
+			}
+			return b.String(), s[i+1:], nil
+		}
+		return "", "", fmt.Errorf("unterminated quoted identifier: %s", s)
+	}
+
+	end := 0
+	for end < len(s) {
+		c := s[end]
+		if c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80 {
+			end++
+			continue
+		}
+		break
+	}
+	if end == 0 {
+		return "", "", fmt.Errorf("expected identifier at: %s", s)
+	}
+	return strings.ToLower(s[:end]), s[end:], nil
+}
+
+// SplitRow splits a COPY text row into its fields. NULL fields are
+// returned as nil, all other fields are unescaped.
+func SplitRow(line string) []*string {
+	raw := strings.Split(line, "\t")
+	fields := make([]*string, len(raw))
+	for i, f := range raw {
+		if f == Null {
+			continue
+		}
+		v := Unescape(f)
+		fields[i] = &v
+	}
+	return fields
+}
+
+// JoinRow is the inverse of SplitRow.
+func JoinRow(fields []*string) string {
+	var b strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte('\t')
+		}
+		if f == nil {
+			b.WriteString(Null)
+			continue
+		}
+		b.WriteString(Escape(*f))
+	}
+	return b.String()
+}
+
+// Unescape decodes the backslash escapes of the COPY text format.
+func Unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			v, n := 0, 0
+			for n < 2 && i+1 < len(s) && isHexDigit(s[i+1]) {
+				i++
+				v = v*16 + hexValue(s[i])
+				n++
+			}
+			if n == 0 {
+				b.WriteByte('x')
+				continue
+			}
+			b.WriteByte(byte(v))
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			v := int(c - '0')
+			for n := 1; n < 3 && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '7'; n++ {
+				i++
+				v = v*8 + int(s[i]-'0')
+			}
+			b.WriteByte(byte(v))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Escape encodes a value for the COPY text format.
+func Escape(s string) string {
+	if !strings.ContainsAny(s, "\\\b\f\n\r\t\v") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\v':
+			b.WriteString(`\v`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func hexValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	default:
+		return int(c-'A') + 10
+	}
+}
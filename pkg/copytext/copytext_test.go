@@ -0,0 +1,30 @@
+package copytext
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, v := range []string{"plain", "tab\there", "new\nline", `back\slash`, "\x01"} {
+		if got := Unescape(Escape(v)); got != v {
+			t.Errorf("round trip of %q = %q", v, got)
+		}
+	}
+	if got := Unescape(`\101\x42`); got != "AB" {
+		t.Errorf("Unescape() = %q, want %q", got, "AB")
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	h, ok, err := ParseHeader(`COPY "Sales"."Order Items" ("Id", qty) FROM stdin;` + "\n")
+	if err != nil || !ok {
+		t.Fatalf("ParseHeader() = %v, %v", ok, err)
+	}
+	if h.Schema != "Sales" || h.Table != "Order Items" || strings.Join(h.Columns, ",") != "Id,qty" {
+		t.Errorf("ParseHeader() = %+v", h)
+	}
+	if _, ok, _ := ParseHeader("CREATE TABLE users (id int);"); ok {
+		t.Error("ParseHeader() accepted a non-COPY statement")
+	}
+}
@@ -0,0 +1,221 @@
+// Package target resolves the target database of a DataProfile from the
+// secrets it references into a storage.Database.
+package target
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
+	"github.com/Oridak771/Vandal/storage"
+)
+
+// Keys of the credentials secret of a target.
+const (
+	KeyHost     = "host"
+	KeyPort     = "port"
+	KeyUser     = "user"
+	KeyPassword = "password"
+	KeyDBName   = "dbname"
+	// KeyDSN holds a connection string, in the URL or keyword and value
+	// format of libpq for PostgreSQL and the DSN format of Go's MySQL driver
+	// for MySQL. The other keys override its settings.
+	KeyDSN = "dsn"
+
+	// KeyCA is the key of the CA certificates in the secret named by
+	// DatabaseTLS.CASecretName.
+	KeyCA = "ca.crt"
+)
+
+// Connection holds the connection settings of a database.
+type Connection struct {
+	Engine   string
+	Host     string
+	Port     string
+	User     string
+	Password string
+	DBName   string
+	// TLS configures encrypted connections, which are not encrypted when
+	// nil.
+	TLS *storage.TLS
+}
+
+// Validate checks that the settings name a database.
+func (c *Connection) Validate() error {
+	if c.Host == "" || c.User == "" || c.DBName == "" {
+		return fmt.Errorf("host, user and dbname are required")
+	}
+	return nil
+}
+
+// Database returns the database of the connection.
+func (c *Connection) Database(opts storage.Options) (storage.Database, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	port := c.Port
+	if port == "" {
+		port = storage.DefaultPort(c.Engine)
+	}
+	opts.TLS = c.TLS
+	return storage.NewDatabase(c.Engine, c.Host, port, c.User, c.Password, c.DBName, opts)
+}
+
+// Resolver builds the target databases of DataProfiles from their secrets.
+type Resolver struct {
+	// Reader reads the secrets, from the namespace of the DataProfile.
+	Reader client.Reader
+	// Options configures the connections of the databases.
+	Options storage.Options
+}
+
+// Connection reads the connection settings of the target of a DataProfile
+// from its credentials secret and the secrets of its TLS configuration.
+func (r *Resolver) Connection(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) (*Connection, error) {
+	target := dataProfile.Spec.Target
+	var secret corev1.Secret
+	key := client.ObjectKey{Namespace: dataProfile.Namespace, Name: target.SecretName}
+	if err := r.Reader.Get(ctx, key, &secret); err != nil {
+		return nil, fmt.Errorf("reading credentials secret %s: %w", key.Name, err)
+	}
+
+	conn := &Connection{Engine: target.Engine}
+	if dsn := string(secret.Data[KeyDSN]); dsn != "" {
+		var err error
+		if conn, err = ParseDSN(target.Engine, dsn); err != nil {
+			return nil, fmt.Errorf("parsing %s of credentials secret %s: %w", KeyDSN, key.Name, err)
+		}
+	}
+	for k, field := range map[string]*string{
+		KeyHost:     &conn.Host,
+		KeyPort:     &conn.Port,
+		KeyUser:     &conn.User,
+		KeyPassword: &conn.Password,
+		KeyDBName:   &conn.DBName,
+	} {
+		if v := string(secret.Data[k]); v != "" {
+			*field = v
+		}
+	}
+	if err := conn.Validate(); err != nil {
+		return nil, fmt.Errorf("credentials secret %s: %w", key.Name, err)
+	}
+
+	if target.TLS != nil {
+		tls, err := r.tls(ctx, dataProfile.Namespace, target.TLS)
+		if err != nil {
+			return nil, err
+		}
+		conn.TLS = tls
+	}
+	return conn, nil
+}
+
+// Database returns the target database of a DataProfile.
+func (r *Resolver) Database(ctx context.Context, dataProfile *vandalv1alpha1.DataProfile) (storage.Database, error) {
+	conn, err := r.Connection(ctx, dataProfile)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Database(r.Options)
+}
+
+// tls reads the TLS settings of a target from the secrets they name.
+func (r *Resolver) tls(ctx context.Context, namespace string, spec *vandalv1alpha1.DatabaseTLS) (*storage.TLS, error) {
+	t := &storage.TLS{Mode: spec.Mode}
+	if t.Mode == "" {
+		t.Mode = storage.TLSModeVerifyFull
+	}
+	if spec.CASecretName != "" {
+		var secret corev1.Secret
+		key := client.ObjectKey{Namespace: namespace, Name: spec.CASecretName}
+		if err := r.Reader.Get(ctx, key, &secret); err != nil {
+			return nil, fmt.Errorf("reading CA secret %s: %w", key.Name, err)
+		}
+		if t.CA = secret.Data[KeyCA]; len(t.CA) == 0 {
+			return nil, fmt.Errorf("CA secret %s must contain %s", key.Name, KeyCA)
+		}
+	}
+	if spec.ClientCertSecretName != "" {
+		var secret corev1.Secret
+		key := client.ObjectKey{Namespace: namespace, Name: spec.ClientCertSecretName}
+		if err := r.Reader.Get(ctx, key, &secret); err != nil {
+			return nil, fmt.Errorf("reading client certificate secret %s: %w", key.Name, err)
+		}
+		t.Cert, t.Key = secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+		if len(t.Cert) == 0 || len(t.Key) == 0 {
+			return nil, fmt.Errorf("client certificate secret %s must contain %s and %s", key.Name, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		}
+	}
+	return t, nil
+}
+
+// sslmodeParam matches the sslmode setting of a PostgreSQL connection string
+// in either format.
+var sslmodeParam = regexp.MustCompile(`\bsslmode\s*=\s*'?([a-z-]+)`)
+
+// ParseDSN parses the connection string of a database of the given engine.
+// Its TLS mode is kept, but certificates must be given by the TLS
+// configuration of the target rather than by file.
+func ParseDSN(engine, dsn string) (*Connection, error) {
+	if engine == vandalv1alpha1.DatabaseEngineMySQL {
+		return parseMySQLDSN(dsn)
+	}
+
+	cfg, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Connection{
+		Engine:   engine,
+		Host:     cfg.Host,
+		Port:     strconv.Itoa(int(cfg.Port)),
+		User:     cfg.User,
+		Password: cfg.Password,
+		DBName:   cfg.Database,
+	}
+	if m := sslmodeParam.FindStringSubmatch(dsn); m != nil {
+		switch mode := m[1]; mode {
+		case storage.TLSModeDisable:
+		case storage.TLSModeRequire, storage.TLSModeVerifyCA, storage.TLSModeVerifyFull:
+			conn.TLS = &storage.TLS{Mode: mode}
+		default:
+			return nil, fmt.Errorf("unsupported sslmode %q", mode)
+		}
+	}
+	return conn, nil
+}
+
+func parseMySQLDSN(dsn string) (*Connection, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Connection{
+		Engine:   vandalv1alpha1.DatabaseEngineMySQL,
+		User:     cfg.User,
+		Password: cfg.Passwd,
+		DBName:   cfg.DBName,
+	}
+	if conn.Host, conn.Port, err = net.SplitHostPort(cfg.Addr); err != nil {
+		return nil, err
+	}
+	switch cfg.TLSConfig {
+	case "", "false":
+	case "true":
+		conn.TLS = &storage.TLS{Mode: storage.TLSModeVerifyFull}
+	case "skip-verify":
+		conn.TLS = &storage.TLS{Mode: storage.TLSModeRequire}
+	default:
+		return nil, fmt.Errorf("unsupported tls setting %q", cfg.TLSConfig)
+	}
+	return conn, nil
+}
@@ -0,0 +1,108 @@
+package schema
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ChangeKind is the kind of a difference between two schemas.
+type ChangeKind string
+
+const (
+	ChangeAdded   ChangeKind = "Added"
+	ChangeRemoved ChangeKind = "Removed"
+	ChangeRetyped ChangeKind = "Retyped"
+)
+
+// Change is a table or column that differs between two schemas.
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	// Table is the qualified name of the table.
+	Table string `json:"table"`
+	// Column is the name of the column, or empty if the whole table was added
+	// or removed.
+	Column string `json:"column,omitempty"`
+	// OldType and NewType are the types of a retyped column.
+	OldType string `json:"oldType,omitempty"`
+	NewType string `json:"newType,omitempty"`
+}
+
+// String describes the change, e.g. "column public.users.phone added".
+func (c Change) String() string {
+	if c.Column == "" {
+		return fmt.Sprintf("table %s %s", c.Table, strings.ToLower(string(c.Kind)))
+	}
+	if c.Kind == ChangeRetyped {
+		return fmt.Sprintf("column %s.%s retyped from %s to %s", c.Table, c.Column, c.OldType, c.NewType)
+	}
+	return fmt.Sprintf("column %s.%s %s", c.Table, c.Column, strings.ToLower(string(c.Kind)))
+}
+
+// Diff returns the tables and columns added to, removed from and retyped in
+// newer compared to older, sorted by table and column. Columns of added and
+// removed tables are not listed separately.
+func Diff(older, newer *Schema) []Change {
+	oldTables := tablesByName(older)
+	newTables := tablesByName(newer)
+
+	var changes []Change
+	for name, t := range newTables {
+		o, ok := oldTables[name]
+		if !ok {
+			changes = append(changes, Change{Kind: ChangeAdded, Table: name})
+			continue
+		}
+		for _, c := range t.Columns {
+			oc := o.Column(c.Name)
+			switch {
+			case oc == nil:
+				changes = append(changes, Change{Kind: ChangeAdded, Table: name, Column: c.Name})
+			case columnType(oc) != columnType(&c):
+				changes = append(changes, Change{Kind: ChangeRetyped, Table: name, Column: c.Name, OldType: columnType(oc), NewType: columnType(&c)})
+			}
+		}
+		for _, oc := range o.Columns {
+			if t.Column(oc.Name) == nil {
+				changes = append(changes, Change{Kind: ChangeRemoved, Table: name, Column: oc.Name})
+			}
+		}
+	}
+	for name := range oldTables {
+		if _, ok := newTables[name]; !ok {
+			changes = append(changes, Change{Kind: ChangeRemoved, Table: name})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Table != changes[j].Table {
+			return changes[i].Table < changes[j].Table
+		}
+		return changes[i].Column < changes[j].Column
+	})
+	return changes
+}
+
+// tablesByName indexes the tables of s by qualified name.
+func tablesByName(s *Schema) map[string]*Table {
+	tables := make(map[string]*Table)
+	if s == nil {
+		return tables
+	}
+	for i := range s.Tables {
+		tables[s.Tables[i].QualifiedName()] = &s.Tables[i]
+	}
+	return tables
+}
+
+// columnType returns the type of a column including its length, e.g.
+// "character varying(20)", or the enum type it has.
+func columnType(c *Column) string {
+	switch {
+	case c.EnumType != "":
+		return c.EnumType
+	case c.MaxLength > 0 && !strings.Contains(c.Type, "("):
+		return fmt.Sprintf("%s(%d)", c.Type, c.MaxLength)
+	}
+	return c.Type
+}
@@ -0,0 +1,76 @@
+package schema
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Marshal returns s as an indented JSON document. Tables and other objects
+// are sorted by qualified name and columns keep their order, so equal schemas
+// give identical documents. Column statistics are left out.
+func Marshal(s *Schema) ([]byte, error) {
+	return json.MarshalIndent(normalize(s), "", "  ")
+}
+
+// MarshalYAML returns s as a YAML document, with the same content as the JSON
+// document of Marshal.
+func MarshalYAML(s *Schema) ([]byte, error) {
+	return yaml.Marshal(normalize(s))
+}
+
+// Unmarshal parses a schema document written by Marshal or MarshalYAML.
+func Unmarshal(data []byte) (*Schema, error) {
+	var s Schema
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Fingerprint returns a digest of the document of s, as "sha256:<hex>". Two
+// schemas have the same fingerprint if and only if their documents are equal.
+func Fingerprint(s *Schema) (string, error) {
+	data, err := json.Marshal(normalize(s))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// normalize returns a copy of s with its objects in a stable order.
+func normalize(s *Schema) *Schema {
+	n := &Schema{
+		Tables:    append([]Table(nil), s.Tables...),
+		Sequences: append([]Sequence(nil), s.Sequences...),
+		Enums:     append([]Enum(nil), s.Enums...),
+		Views:     append([]View(nil), s.Views...),
+	}
+	sort.SliceStable(n.Tables, func(i, j int) bool {
+		return n.Tables[i].QualifiedName() < n.Tables[j].QualifiedName()
+	})
+	for i := range n.Tables {
+		t := &n.Tables[i]
+		t.Indexes = append([]Index(nil), t.Indexes...)
+		sort.SliceStable(t.Indexes, func(i, j int) bool { return t.Indexes[i].Name < t.Indexes[j].Name })
+		t.Constraints = append([]Constraint(nil), t.Constraints...)
+		sort.SliceStable(t.Constraints, func(i, j int) bool { return t.Constraints[i].Name < t.Constraints[j].Name })
+	}
+	sort.SliceStable(n.Sequences, func(i, j int) bool {
+		return n.Sequences[i].QualifiedName() < n.Sequences[j].QualifiedName()
+	})
+	sort.SliceStable(n.Enums, func(i, j int) bool {
+		return QualifiedName(n.Enums[i].Schema, n.Enums[i].Name) < QualifiedName(n.Enums[j].Schema, n.Enums[j].Name)
+	})
+	sort.SliceStable(n.Views, func(i, j int) bool {
+		return n.Views[i].QualifiedName() < n.Views[j].QualifiedName()
+	})
+	if n.Tables == nil {
+		n.Tables = []Table{}
+	}
+	return n
+}
@@ -0,0 +1,91 @@
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	s := &Schema{Tables: []Table{
+		{Schema: "public", Name: "users", Columns: []Column{
+			{Name: "id", Type: "integer", IsPrimaryKey: true},
+			{Name: "email", Type: "text", IsNullable: true, Stats: &ColumnStats{Values: []string{"a@example.com"}}},
+		}},
+		{Schema: "public", Name: "orders", Columns: []Column{
+			{Name: "user_id", Type: "integer", IsForeignKey: true, ForeignKeySchema: "public", ForeignKeyTable: "users", ForeignKeyColumn: "id"},
+		}},
+	}}
+
+	data, err := Marshal(s)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if strings.Contains(string(data), "a@example.com") {
+		t.Errorf("Marshal() = %s, want column statistics left out", data)
+	}
+	yamlData, err := MarshalYAML(s)
+	if err != nil {
+		t.Fatalf("MarshalYAML() error = %v", err)
+	}
+	for _, doc := range [][]byte{data, yamlData} {
+		parsed, err := Unmarshal(doc)
+		if err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		if got, want := parsed.Table("orders").Columns[0].ForeignKeyTable, "users"; got != want {
+			t.Errorf("Unmarshal() foreign key table = %q, want %q", got, want)
+		}
+		if diff := Diff(s, parsed); len(diff) != 0 {
+			t.Errorf("Diff() after round trip = %v, want none", diff)
+		}
+	}
+
+	reordered := &Schema{Tables: []Table{s.Tables[1], s.Tables[0]}}
+	a, err := Fingerprint(s)
+	if err != nil {
+		t.Fatalf("Fingerprint() error = %v", err)
+	}
+	b, _ := Fingerprint(reordered)
+	if a != b {
+		t.Errorf("Fingerprint() differs for reordered tables: %s != %s", a, b)
+	}
+	reordered.Tables[0].Columns[0].Type = "bigint"
+	if c, _ := Fingerprint(reordered); c == a {
+		t.Errorf("Fingerprint() did not change with a column type")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	older := &Schema{Tables: []Table{
+		{Schema: "public", Name: "users", Columns: []Column{
+			{Name: "id", Type: "integer"},
+			{Name: "name", Type: "character varying", MaxLength: 50},
+			{Name: "fax", Type: "text"},
+		}},
+		{Schema: "public", Name: "legacy", Columns: []Column{{Name: "id", Type: "integer"}}},
+	}}
+	newer := &Schema{Tables: []Table{
+		{Schema: "public", Name: "users", Columns: []Column{
+			{Name: "id", Type: "bigint"},
+			{Name: "name", Type: "character varying", MaxLength: 50},
+			{Name: "phone", Type: "text"},
+		}},
+		{Schema: "audit", Name: "events", Columns: []Column{{Name: "id", Type: "integer"}}},
+	}}
+
+	var got []string
+	for _, c := range Diff(older, newer) {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"table audit.events added",
+		"table public.legacy removed",
+		"column public.users.fax removed",
+		"column public.users.id retyped from integer to bigint",
+		"column public.users.phone added",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff() = %q, want %q", got, want)
+	}
+}
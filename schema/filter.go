@@ -0,0 +1,123 @@
+package schema
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Filter selects the tables of a database by name. Patterns use shell glob
+// syntax: * matches any sequence of characters and ? any single character.
+// Schema patterns match schema names. Table patterns match table names or,
+// when they contain a dot, schema-qualified table names such as "audit.*".
+type Filter struct {
+	// IncludeSchemas are the schemas to select tables from. All schemas are
+	// selected if empty.
+	IncludeSchemas []string
+	// ExcludeSchemas are schemas whose tables are never selected.
+	ExcludeSchemas []string
+	// IncludeTables are the tables to select. All tables are selected if
+	// empty.
+	IncludeTables []string
+	// ExcludeTables are tables that are never selected.
+	ExcludeTables []string
+	// StructureOnly are selected tables whose definition is kept but whose
+	// rows are not.
+	StructureOnly []string
+}
+
+// Validate checks that every pattern of f is well-formed.
+func (f *Filter) Validate() error {
+	if f == nil {
+		return nil
+	}
+	lists := [][]string{f.IncludeSchemas, f.ExcludeSchemas, f.IncludeTables, f.ExcludeTables, f.StructureOnly}
+	for _, patterns := range lists {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Includes reports whether f selects a table. A nil Filter selects every
+// table.
+func (f *Filter) Includes(t *Table) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.IncludeSchemas) > 0 && !matchAny(f.IncludeSchemas, t.Schema) {
+		return false
+	}
+	if matchAny(f.ExcludeSchemas, t.Schema) {
+		return false
+	}
+	if len(f.IncludeTables) > 0 && !matchTable(f.IncludeTables, t) {
+		return false
+	}
+	return !matchTable(f.ExcludeTables, t)
+}
+
+// IsStructureOnly reports whether f selects only the definition of a table,
+// without its rows.
+func (f *Filter) IsStructureOnly(t *Table) bool {
+	return f != nil && matchTable(f.StructureOnly, t)
+}
+
+// Select returns a schema with the tables of s that f selects, in order, and
+// the other objects of s.
+func (s *Schema) Select(f *Filter) *Schema {
+	if f == nil {
+		return s
+	}
+	selected := &Schema{Sequences: s.Sequences, Enums: s.Enums, Views: s.Views}
+	for _, t := range s.Tables {
+		if f.Includes(&t) {
+			selected.Tables = append(selected.Tables, t)
+		}
+	}
+	return selected
+}
+
+// WithData returns a schema with the tables of s whose rows f selects, that
+// is the selected tables that are not structure-only, and the other objects
+// of s.
+func (s *Schema) WithData(f *Filter) *Schema {
+	if f == nil {
+		return s
+	}
+	selected := &Schema{Sequences: s.Sequences, Enums: s.Enums, Views: s.Views}
+	for _, t := range s.Tables {
+		if f.Includes(&t) && !f.IsStructureOnly(&t) {
+			selected.Tables = append(selected.Tables, t)
+		}
+	}
+	return selected
+}
+
+// matchTable reports whether any of patterns matches a table. Patterns with a
+// dot are matched against the schema-qualified name of the table.
+func matchTable(patterns []string, t *Table) bool {
+	for _, p := range patterns {
+		name := t.Name
+		if strings.Contains(p, ".") {
+			name = t.Schema + "." + t.Name
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether any of patterns matches name.
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
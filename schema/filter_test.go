@@ -0,0 +1,47 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterSelect(t *testing.T) {
+	s := &Schema{Tables: []Table{
+		{Schema: "public", Name: "users"},
+		{Schema: "public", Name: "orders"},
+		{Schema: "public", Name: "orders_archive"},
+		{Schema: "audit", Name: "events"},
+		{Schema: "tmp", Name: "scratch"},
+	}}
+	f := &Filter{
+		ExcludeSchemas: []string{"tmp"},
+		ExcludeTables:  []string{"*_archive"},
+		StructureOnly:  []string{"audit.*"},
+	}
+
+	names := func(s *Schema) []string {
+		var names []string
+		for _, t := range s.Tables {
+			names = append(names, t.Schema+"."+t.Name)
+		}
+		return names
+	}
+	if got, want := names(s.Select(f)), []string{"public.users", "public.orders", "audit.events"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Select() = %q, want %q", got, want)
+	}
+	if got, want := names(s.WithData(f)), []string{"public.users", "public.orders"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WithData() = %q, want %q", got, want)
+	}
+
+	f = &Filter{IncludeSchemas: []string{"public"}, IncludeTables: []string{"users", "audit.events"}}
+	if got, want := names(s.Select(f)), []string{"public.users"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Select() with includes = %q, want %q", got, want)
+	}
+
+	if got := s.Select(nil); got != s {
+		t.Errorf("Select(nil) did not return the schema unchanged")
+	}
+	if err := (&Filter{ExcludeTables: []string{"[a-"}}).Validate(); err == nil {
+		t.Errorf("Validate() accepted a malformed pattern")
+	}
+}
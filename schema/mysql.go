@@ -0,0 +1,225 @@
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// LoadMySQL reads the schema of the MySQL or MariaDB database db is connected
+// to from information_schema. Tables belong to the schema named after the
+// database. Column types are the data types reported by MySQL, e.g. "varchar"
+// with MaxLength set; columns of an ENUM type carry its values in EnumValues.
+// MySQL has no sequences and no materialized views, and its statistics are not
+// read.
+func LoadMySQL(ctx context.Context, db *sql.DB) (*Schema, error) {
+	tables, err := getMySQLTables(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("reading tables: %w", err)
+	}
+	s := &Schema{Tables: tables}
+	index := make(tableIndex, len(s.Tables))
+	for i := range s.Tables {
+		index[tableRef{s.Tables[i].Schema, s.Tables[i].Name}] = &s.Tables[i]
+	}
+
+	if err := getMySQLKeys(ctx, db, index); err != nil {
+		return nil, fmt.Errorf("reading constraints: %w", err)
+	}
+	if err := getMySQLIndexes(ctx, db, index); err != nil {
+		return nil, fmt.Errorf("reading indexes: %w", err)
+	}
+	if s.Views, err = getMySQLViews(ctx, db); err != nil {
+		return nil, fmt.Errorf("reading views: %w", err)
+	}
+	return s, nil
+}
+
+// getMySQLTables returns the base tables of the current database with their
+// columns, in order.
+func getMySQLTables(ctx context.Context, db *sql.DB) ([]Table, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.TABLE_SCHEMA, t.TABLE_NAME, c.COLUMN_NAME, c.DATA_TYPE, c.COLUMN_TYPE, c.CHARACTER_MAXIMUM_LENGTH, c.IS_NULLABLE
+		FROM information_schema.TABLES t
+		LEFT JOIN information_schema.COLUMNS c ON c.TABLE_SCHEMA = t.TABLE_SCHEMA AND c.TABLE_NAME = t.TABLE_NAME
+		WHERE t.TABLE_SCHEMA = DATABASE() AND t.TABLE_TYPE = 'BASE TABLE'
+		ORDER BY t.TABLE_NAME, c.ORDINAL_POSITION`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []Table
+	for rows.Next() {
+		var schemaName, tableName string
+		var name, dataType, columnType, nullable sql.NullString
+		var maxLength sql.NullInt64
+		if err := rows.Scan(&schemaName, &tableName, &name, &dataType, &columnType, &maxLength, &nullable); err != nil {
+			return nil, err
+		}
+		if n := len(tables); n == 0 || tables[n-1].Schema != schemaName || tables[n-1].Name != tableName {
+			tables = append(tables, Table{Schema: schemaName, Name: tableName})
+		}
+		// Tables without columns have a single row with NULL column fields.
+		if !name.Valid {
+			continue
+		}
+		column := Column{
+			Name:       name.String,
+			Type:       strings.ToLower(dataType.String),
+			IsNullable: nullable.String == "YES",
+		}
+		switch column.Type {
+		case "char", "varchar":
+			column.MaxLength = int(maxLength.Int64)
+		case "enum":
+			column.EnumValues = parseMySQLEnum(columnType.String)
+		}
+		table := &tables[len(tables)-1]
+		table.Columns = append(table.Columns, column)
+	}
+	return tables, rows.Err()
+}
+
+// getMySQLKeys sets the primary key and unique constraints of tables and the
+// foreign keys of their columns.
+func getMySQLKeys(ctx context.Context, db *sql.DB, tables tableIndex) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT k.TABLE_SCHEMA, k.TABLE_NAME, k.CONSTRAINT_NAME, tc.CONSTRAINT_TYPE, k.COLUMN_NAME,
+			k.REFERENCED_TABLE_SCHEMA, k.REFERENCED_TABLE_NAME, k.REFERENCED_COLUMN_NAME
+		FROM information_schema.KEY_COLUMN_USAGE k
+		JOIN information_schema.TABLE_CONSTRAINTS tc ON tc.CONSTRAINT_SCHEMA = k.CONSTRAINT_SCHEMA
+			AND tc.TABLE_NAME = k.TABLE_NAME AND tc.CONSTRAINT_NAME = k.CONSTRAINT_NAME
+		WHERE k.TABLE_SCHEMA = DATABASE()
+		ORDER BY k.TABLE_NAME, k.CONSTRAINT_NAME, k.ORDINAL_POSITION`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName, name, constraintType, columnName string
+		var refSchema, refTable, refColumn sql.NullString
+		if err := rows.Scan(&schemaName, &tableName, &name, &constraintType, &columnName, &refSchema, &refTable, &refColumn); err != nil {
+			return err
+		}
+		table := tables[tableRef{schemaName, tableName}]
+		if table == nil {
+			continue
+		}
+		column := table.Column(columnName)
+
+		switch ConstraintType(constraintType) {
+		case ConstraintPrimaryKey, ConstraintUnique:
+			if n := len(table.Constraints); n > 0 && table.Constraints[n-1].Name == name {
+				table.Constraints[n-1].Columns = append(table.Constraints[n-1].Columns, columnName)
+			} else {
+				table.Constraints = append(table.Constraints, Constraint{Name: name, Type: ConstraintType(constraintType), Columns: []string{columnName}})
+			}
+			if column != nil && constraintType == string(ConstraintPrimaryKey) {
+				column.IsPrimaryKey = true
+			}
+		case "FOREIGN KEY":
+			if column != nil && !column.IsForeignKey && refTable.Valid {
+				column.IsForeignKey = true
+				column.ForeignKeySchema, column.ForeignKeyTable, column.ForeignKeyColumn = refSchema.String, refTable.String, refColumn.String
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// getMySQLIndexes sets the indexes of tables. Functional key parts are left
+// out of the columns of an index.
+func getMySQLIndexes(ctx context.Context, db *sql.DB, tables tableIndex) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, NON_UNIQUE, COLUMN_NAME
+		FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE()
+		ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName, name string
+		var nonUnique int
+		var columnName sql.NullString
+		if err := rows.Scan(&schemaName, &tableName, &name, &nonUnique, &columnName); err != nil {
+			return err
+		}
+		table := tables[tableRef{schemaName, tableName}]
+		if table == nil {
+			continue
+		}
+		if n := len(table.Indexes); n == 0 || table.Indexes[n-1].Name != name {
+			table.Indexes = append(table.Indexes, Index{Name: name, IsUnique: nonUnique == 0, IsPrimary: name == "PRIMARY"})
+		}
+		if columnName.Valid {
+			index := &table.Indexes[len(table.Indexes)-1]
+			index.Columns = append(index.Columns, columnName.String)
+		}
+	}
+	return rows.Err()
+}
+
+// getMySQLViews returns the views of the current database.
+func getMySQLViews(ctx context.Context, db *sql.DB) ([]View, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT TABLE_SCHEMA, TABLE_NAME, VIEW_DEFINITION
+		FROM information_schema.VIEWS
+		WHERE TABLE_SCHEMA = DATABASE()
+		ORDER BY TABLE_NAME`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views []View
+	for rows.Next() {
+		var view View
+		var definition sql.NullString
+		if err := rows.Scan(&view.Schema, &view.Name, &definition); err != nil {
+			return nil, err
+		}
+		view.Definition = definition.String
+		views = append(views, view)
+	}
+	return views, rows.Err()
+}
+
+// parseMySQLEnum parses the values of a MySQL column type such as
+// enum('small','large'). Quotes within values are doubled.
+func parseMySQLEnum(columnType string) []string {
+	open, end := strings.IndexByte(columnType, '('), strings.LastIndexByte(columnType, ')')
+	if open < 0 || end < open {
+		return nil
+	}
+	body := columnType[open+1 : end]
+
+	var values []string
+	var value strings.Builder
+	inQuotes := false
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\'' && inQuotes && i+1 < len(body) && body[i+1] == '\'':
+			value.WriteByte('\'')
+			i++
+		case c == '\'':
+			if inQuotes {
+				values = append(values, value.String())
+				value.Reset()
+			}
+			inQuotes = !inQuotes
+		case c == '\\' && inQuotes && i+1 < len(body):
+			i++
+			value.WriteByte(body[i])
+		case inQuotes:
+			value.WriteByte(c)
+		}
+	}
+	return values
+}
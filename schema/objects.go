@@ -0,0 +1,117 @@
+package schema
+
+// Index is an index of a table.
+type Index struct {
+	Name string `json:"name"`
+	// Columns are the indexed columns, in order. Expressions are left out.
+	Columns   []string `json:"columns,omitempty"`
+	IsUnique  bool     `json:"unique,omitempty"`
+	IsPrimary bool     `json:"primary,omitempty"`
+	// Definition is the CREATE INDEX statement of the index.
+	Definition string `json:"definition,omitempty"`
+}
+
+// ConstraintType is the kind of a table constraint.
+type ConstraintType string
+
+const (
+	ConstraintPrimaryKey ConstraintType = "PRIMARY KEY"
+	ConstraintUnique     ConstraintType = "UNIQUE"
+	ConstraintCheck      ConstraintType = "CHECK"
+	ConstraintExclusion  ConstraintType = "EXCLUDE"
+)
+
+// Constraint is a primary key, unique, check or exclusion constraint of a
+// table. Foreign keys are described by the columns they constrain.
+type Constraint struct {
+	Name string         `json:"name"`
+	Type ConstraintType `json:"type"`
+	// Columns are the constrained columns, in order.
+	Columns []string `json:"columns,omitempty"`
+	// Definition is the constraint as written in a table definition, e.g.
+	// "CHECK ((price > 0))".
+	Definition string `json:"definition,omitempty"`
+}
+
+// Sequence is a sequence, such as the one generating the values of a serial
+// column.
+type Sequence struct {
+	Schema string `json:"schema,omitempty"`
+	Name   string `json:"name"`
+	// OwnerTable and OwnerColumn are the qualified name of the table and the
+	// column the sequence belongs to, if any.
+	OwnerTable  string `json:"ownerTable,omitempty"`
+	OwnerColumn string `json:"ownerColumn,omitempty"`
+}
+
+// Enum is an enumerated type.
+type Enum struct {
+	Schema string `json:"schema,omitempty"`
+	Name   string `json:"name"`
+	// Values are the labels of the type, in sort order.
+	Values []string `json:"values"`
+}
+
+// View is a view or a materialized view.
+type View struct {
+	Schema       string `json:"schema,omitempty"`
+	Name         string `json:"name"`
+	Materialized bool   `json:"materialized,omitempty"`
+	// Definition is the SELECT statement of the view.
+	Definition string `json:"definition,omitempty"`
+}
+
+// IsUnique reports whether the values of a column are unique on their own,
+// because a primary key, unique constraint or unique index covers the column
+// alone.
+func (t *Table) IsUnique(column string) bool {
+	for _, c := range t.Constraints {
+		if (c.Type == ConstraintUnique || c.Type == ConstraintPrimaryKey) && len(c.Columns) == 1 && c.Columns[0] == column {
+			return true
+		}
+	}
+	for _, i := range t.Indexes {
+		if i.IsUnique && len(i.Columns) == 1 && i.Columns[0] == column {
+			return true
+		}
+	}
+	return false
+}
+
+// QualifiedName returns the name of the sequence qualified with its schema.
+func (s *Sequence) QualifiedName() string {
+	return QualifiedName(s.Schema, s.Name)
+}
+
+// QuotedName returns the name of the sequence qualified with its schema and
+// quoted for SQL.
+func (s *Sequence) QuotedName() string {
+	return QuoteName(s.Schema, s.Name)
+}
+
+// QualifiedName returns the name of the view qualified with its schema.
+func (v *View) QualifiedName() string {
+	return QualifiedName(v.Schema, v.Name)
+}
+
+// QuotedName returns the name of the view qualified with its schema and
+// quoted for SQL.
+func (v *View) QuotedName() string {
+	return QuoteName(v.Schema, v.Name)
+}
+
+// Enum returns the enumerated type with the given, possibly schema-qualified,
+// name, or nil if the schema has no such type.
+func (s *Schema) Enum(name string) *Enum {
+	for i := range s.Enums {
+		if QualifiedName(s.Enums[i].Schema, s.Enums[i].Name) == name {
+			return &s.Enums[i]
+		}
+	}
+	for i := range s.Enums {
+		if s.Enums[i].Name == name {
+			return &s.Enums[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,444 @@
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// userSchemas restricts a query on pg_namespace n to the schemas holding user
+// objects.
+const userSchemas = `n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%' AND n.nspname NOT LIKE 'pg_temp%'`
+
+// tableRef identifies a table by schema and name.
+type tableRef struct {
+	schema, name string
+}
+
+// tableIndex maps tables to their entry in a schema, so that catalog rows can
+// be attached to their table without scanning the table list.
+type tableIndex map[tableRef]*Table
+
+// GetSchema fetches the schema of a PostgreSQL database, connecting without
+// TLS.
+//
+// Deprecated: use Load with a connection pool of storage.NewPostgresDatabase,
+// which honours the TLS and connection options of the target.
+func GetSchema(ctx context.Context, host, port, user, password, dbname string) (*Schema, error) {
+	db, err := open(host, port, user, password, dbname)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return Load(ctx, db)
+}
+
+// Load reads the schema of the PostgreSQL database db is connected to. The
+// catalog is read with one query per kind of object, whatever the number of
+// tables.
+func Load(ctx context.Context, db *sql.DB) (*Schema, error) {
+	tables, err := getTables(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("reading tables: %w", err)
+	}
+	s := &Schema{Tables: tables}
+	index := make(tableIndex, len(s.Tables))
+	for i := range s.Tables {
+		index[tableRef{s.Tables[i].Schema, s.Tables[i].Name}] = &s.Tables[i]
+	}
+
+	if err := getForeignKeys(ctx, db, index); err != nil {
+		return nil, fmt.Errorf("reading foreign keys: %w", err)
+	}
+	if err := getIndexes(ctx, db, index); err != nil {
+		return nil, fmt.Errorf("reading indexes: %w", err)
+	}
+	if err := getConstraints(ctx, db, index); err != nil {
+		return nil, fmt.Errorf("reading constraints: %w", err)
+	}
+	if s.Sequences, err = getSequences(ctx, db); err != nil {
+		return nil, fmt.Errorf("reading sequences: %w", err)
+	}
+	if s.Enums, err = getEnums(ctx, db); err != nil {
+		return nil, fmt.Errorf("reading enum types: %w", err)
+	}
+	if s.Views, err = getViews(ctx, db); err != nil {
+		return nil, fmt.Errorf("reading views: %w", err)
+	}
+	enums := make(map[string]*Enum, len(s.Enums))
+	for i := range s.Enums {
+		enums[QualifiedName(s.Enums[i].Schema, s.Enums[i].Name)] = &s.Enums[i]
+	}
+	for i := range s.Tables {
+		for j := range s.Tables[i].Columns {
+			column := &s.Tables[i].Columns[j]
+			if enum := enums[column.EnumType]; enum != nil {
+				column.EnumValues = enum.Values
+			} else {
+				column.EnumType = ""
+			}
+		}
+	}
+
+	if err := getStats(ctx, db, index); err != nil {
+		return nil, fmt.Errorf("reading statistics: %w", err)
+	}
+	return s, nil
+}
+
+// open opens a connection pool to a PostgreSQL database, without TLS.
+func open(host, port, user, password, dbname string) (*sql.DB, error) {
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbname)
+	return sql.Open("postgres", connStr)
+}
+
+// getTables returns the tables of a database with their columns, in order.
+// Columns of a domain type are reported with the base type of the domain.
+func getTables(ctx context.Context, db *sql.DB) ([]Table, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, c.relname, a.attname,
+			CASE WHEN t.typtype = 'd' THEN format_type(t.typbasetype, t.typtypmod) ELSE format_type(a.atttypid, a.atttypmod) END,
+			CASE WHEN a.atttypid IN ('varchar'::regtype, 'bpchar'::regtype) AND a.atttypmod > 4 THEN a.atttypmod - 4 END,
+			NOT a.attnotnull, t.typtype::text, tn.nspname, t.typname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum > 0 AND NOT a.attisdropped
+		LEFT JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_namespace tn ON tn.oid = t.typnamespace
+		WHERE c.relkind IN ('r', 'p') AND `+userSchemas+`
+		ORDER BY n.nspname, c.relname, a.attnum`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []Table
+	for rows.Next() {
+		var schemaName, tableName string
+		var name, sqlType, typeKind, typeSchema, typeName sql.NullString
+		var maxLength sql.NullInt64
+		var nullable sql.NullBool
+		if err := rows.Scan(&schemaName, &tableName, &name, &sqlType, &maxLength, &nullable, &typeKind, &typeSchema, &typeName); err != nil {
+			return nil, err
+		}
+		if n := len(tables); n == 0 || tables[n-1].Schema != schemaName || tables[n-1].Name != tableName {
+			tables = append(tables, Table{Schema: schemaName, Name: tableName})
+		}
+		// Tables without columns have a single row with NULL column fields.
+		if !name.Valid {
+			continue
+		}
+		column := Column{
+			Name:       name.String,
+			Type:       sqlType.String,
+			MaxLength:  int(maxLength.Int64),
+			IsNullable: nullable.Bool,
+		}
+		// Enum types are resolved to their values once those are known.
+		if typeKind.String == "e" {
+			column.EnumType = QualifiedName(typeSchema.String, typeName.String)
+		}
+		table := &tables[len(tables)-1]
+		table.Columns = append(table.Columns, column)
+	}
+	return tables, rows.Err()
+}
+
+// getForeignKeys sets the foreign keys of the columns of tables. Each column of
+// a multi-column foreign key references the matching column of the referenced
+// key; a column in several foreign keys is given the first one by name.
+func getForeignKeys(ctx context.Context, db *sql.DB, tables tableIndex) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, t.relname, a.attname, rn.nspname, r.relname, ra.attname
+		FROM pg_constraint c
+		JOIN pg_class t ON t.oid = c.conrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		JOIN pg_class r ON r.oid = c.confrelid
+		JOIN pg_namespace rn ON rn.oid = r.relnamespace
+		CROSS JOIN LATERAL unnest(c.conkey, c.confkey) AS k(attnum, refattnum)
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+		JOIN pg_attribute ra ON ra.attrelid = c.confrelid AND ra.attnum = k.refattnum
+		WHERE c.contype = 'f' AND `+userSchemas+`
+		ORDER BY n.nspname, t.relname, c.conname`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName, columnName, refSchema, refTable, refColumn string
+		if err := rows.Scan(&schemaName, &tableName, &columnName, &refSchema, &refTable, &refColumn); err != nil {
+			return err
+		}
+		table := tables[tableRef{schemaName, tableName}]
+		if table == nil {
+			continue
+		}
+		if column := table.Column(columnName); column != nil && !column.IsForeignKey {
+			column.IsForeignKey = true
+			column.ForeignKeySchema, column.ForeignKeyTable, column.ForeignKeyColumn = refSchema, refTable, refColumn
+		}
+	}
+	return rows.Err()
+}
+
+// getIndexes sets the indexes of tables.
+func getIndexes(ctx context.Context, db *sql.DB, tables tableIndex) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, t.relname, i.relname, ix.indisunique, ix.indisprimary, pg_get_indexdef(ix.indexrelid),
+			ARRAY(SELECT a.attname FROM unnest(ix.indkey) WITH ORDINALITY k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = ix.indrelid AND a.attnum = k.attnum ORDER BY k.ord)::text
+		FROM pg_index ix
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE `+userSchemas+`
+		ORDER BY n.nspname, t.relname, i.relname`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName, columns string
+		var index Index
+		if err := rows.Scan(&schemaName, &tableName, &index.Name, &index.IsUnique, &index.IsPrimary, &index.Definition, &columns); err != nil {
+			return err
+		}
+		index.Columns = parseArray(columns)
+		if table := tables[tableRef{schemaName, tableName}]; table != nil {
+			table.Indexes = append(table.Indexes, index)
+		}
+	}
+	return rows.Err()
+}
+
+// constraintTypes maps pg_constraint.contype to constraint types.
+var constraintTypes = map[string]ConstraintType{
+	"p": ConstraintPrimaryKey,
+	"u": ConstraintUnique,
+	"c": ConstraintCheck,
+	"x": ConstraintExclusion,
+}
+
+// getConstraints sets the primary key, unique, check and exclusion
+// constraints of tables, and marks the columns of primary keys.
+func getConstraints(ctx context.Context, db *sql.DB, tables tableIndex) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, t.relname, c.conname, c.contype::text, pg_get_constraintdef(c.oid),
+			ARRAY(SELECT a.attname FROM unnest(c.conkey) WITH ORDINALITY k(attnum, ord)
+				JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum ORDER BY k.ord)::text
+		FROM pg_constraint c
+		JOIN pg_class t ON t.oid = c.conrelid
+		JOIN pg_namespace n ON n.oid = t.relnamespace
+		WHERE c.contype IN ('p', 'u', 'c', 'x') AND `+userSchemas+`
+		ORDER BY n.nspname, t.relname, c.conname`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName, contype, columns string
+		var constraint Constraint
+		if err := rows.Scan(&schemaName, &tableName, &constraint.Name, &contype, &constraint.Definition, &columns); err != nil {
+			return err
+		}
+		constraint.Type = constraintTypes[contype]
+		constraint.Columns = parseArray(columns)
+		table := tables[tableRef{schemaName, tableName}]
+		if table == nil {
+			continue
+		}
+		table.Constraints = append(table.Constraints, constraint)
+		if constraint.Type == ConstraintPrimaryKey {
+			for _, name := range constraint.Columns {
+				if column := table.Column(name); column != nil {
+					column.IsPrimaryKey = true
+				}
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// getSequences returns the sequences of a database and the columns owning
+// them.
+func getSequences(ctx context.Context, db *sql.DB) ([]Sequence, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, s.relname, tn.nspname, t.relname, a.attname
+		FROM pg_class s
+		JOIN pg_namespace n ON n.oid = s.relnamespace
+		LEFT JOIN pg_depend d ON d.classid = 'pg_class'::regclass AND d.objid = s.oid
+			AND d.refclassid = 'pg_class'::regclass AND d.deptype IN ('a', 'i')
+		LEFT JOIN pg_class t ON t.oid = d.refobjid
+		LEFT JOIN pg_namespace tn ON tn.oid = t.relnamespace
+		LEFT JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE s.relkind = 'S' AND `+userSchemas+`
+		ORDER BY n.nspname, s.relname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sequences []Sequence
+	for rows.Next() {
+		var seq Sequence
+		var ownerSchema, ownerTable, ownerColumn sql.NullString
+		if err := rows.Scan(&seq.Schema, &seq.Name, &ownerSchema, &ownerTable, &ownerColumn); err != nil {
+			return nil, err
+		}
+		if ownerTable.Valid {
+			seq.OwnerTable, seq.OwnerColumn = QualifiedName(ownerSchema.String, ownerTable.String), ownerColumn.String
+		}
+		sequences = append(sequences, seq)
+	}
+	return sequences, rows.Err()
+}
+
+// getEnums returns the enumerated types of a database.
+func getEnums(ctx context.Context, db *sql.DB) ([]Enum, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, t.typname, array_agg(e.enumlabel ORDER BY e.enumsortorder)::text
+		FROM pg_type t
+		JOIN pg_enum e ON e.enumtypid = t.oid
+		JOIN pg_namespace n ON n.oid = t.typnamespace
+		WHERE `+userSchemas+`
+		GROUP BY n.nspname, t.typname
+		ORDER BY n.nspname, t.typname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var enums []Enum
+	for rows.Next() {
+		var enum Enum
+		var values string
+		if err := rows.Scan(&enum.Schema, &enum.Name, &values); err != nil {
+			return nil, err
+		}
+		enum.Values = parseArray(values)
+		enums = append(enums, enum)
+	}
+	return enums, rows.Err()
+}
+
+// getViews returns the views and materialized views of a database.
+func getViews(ctx context.Context, db *sql.DB) ([]View, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.nspname, c.relname, c.relkind = 'm', pg_get_viewdef(c.oid)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('v', 'm') AND `+userSchemas+`
+		ORDER BY n.nspname, c.relname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views []View
+	for rows.Next() {
+		var view View
+		var definition sql.NullString
+		if err := rows.Scan(&view.Schema, &view.Name, &view.Materialized, &definition); err != nil {
+			return nil, err
+		}
+		view.Definition = definition.String
+		views = append(views, view)
+	}
+	return views, rows.Err()
+}
+
+// getStats sets the statistics of the columns of tables from pg_stats.
+func getStats(ctx context.Context, db *sql.DB, tables tableIndex) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT schemaname, tablename, attname, null_frac, n_distinct, most_common_vals::text, histogram_bounds::text
+		FROM pg_catalog.pg_stats
+		WHERE schemaname NOT IN ('pg_catalog', 'information_schema')`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName, columnName string
+		var nullFraction, distinct sql.NullFloat64
+		var commonValues, histogram sql.NullString
+		if err := rows.Scan(&schemaName, &tableName, &columnName, &nullFraction, &distinct, &commonValues, &histogram); err != nil {
+			return err
+		}
+		table := tables[tableRef{schemaName, tableName}]
+		if table == nil {
+			continue
+		}
+		column := table.Column(columnName)
+		if column == nil {
+			continue
+		}
+
+		stats := &ColumnStats{NullFraction: nullFraction.Float64}
+		// A positive n_distinct is the number of distinct values; when the most
+		// common values cover all of them the column is enumerable.
+		values := parseArray(commonValues.String)
+		if n := distinct.Float64; n > 0 && n <= maxEnumValues && len(values) == int(n) {
+			stats.Values = values
+		}
+		if bounds := parseArray(histogram.String); len(bounds) > 0 {
+			stats.Min, stats.Max = bounds[0], bounds[len(bounds)-1]
+		}
+		column.Stats = stats
+	}
+	return rows.Err()
+}
+
+// SampleValues returns up to limit values of every column of a PostgreSQL
+// table, keyed by column name, connecting without TLS. NULL values are left
+// out.
+//
+// Deprecated: use Sample with a connection pool of
+// storage.NewPostgresDatabase, which honours the TLS and connection options of
+// the target.
+func SampleValues(ctx context.Context, host, port, user, password, dbname string, table *Table, limit int) (map[string][]string, error) {
+	db, err := open(host, port, user, password, dbname)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	return Sample(ctx, db, fmt.Sprintf("SELECT * FROM %s LIMIT %d", table.QuotedName(), limit))
+}
+
+// Sample returns the values of every column of the rows of a query, keyed by
+// column name. NULL values are left out.
+func Sample(ctx context.Context, db *sql.DB, query string) (map[string][]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	samples := make(map[string][]string, len(columns))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if v.Valid {
+				samples[columns[i]] = append(samples[columns[i]], v.String)
+			}
+		}
+	}
+	return samples, rows.Err()
+}
@@ -0,0 +1,112 @@
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// loadFixture loads a SQL fixture of testdata into the PostgreSQL database
+// named by the libpq connection string in VANDAL_TEST_POSTGRES, or skips the
+// test if it is unset.
+func loadFixture(t *testing.T, name string) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("VANDAL_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("VANDAL_TEST_POSTGRES is not set")
+	}
+	fixture, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(string(fixture)); err != nil {
+		t.Fatalf("loading %s: %v", name, err)
+	}
+	return db
+}
+
+func TestLoadPostgres(t *testing.T) {
+	db := loadFixture(t, "postgres.sql")
+	t.Cleanup(func() { db.Exec("DROP SCHEMA IF EXISTS vandal_fixture CASCADE") })
+
+	s, err := Load(context.Background(), db)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	// Partitioned tables are loaded with their partitions, which inherit
+	// their columns and foreign keys.
+	for _, name := range []string{"vandal_fixture.shipments", "vandal_fixture.shipments_2024"} {
+		table := s.Table(name)
+		if table == nil {
+			t.Errorf("Table(%q) = nil, want the table", name)
+			continue
+		}
+		var columns []string
+		for _, c := range table.Columns {
+			columns = append(columns, c.Name)
+		}
+		if want := []string{"id", "shipped_on", "region", "code", "status", "contact"}; !reflect.DeepEqual(columns, want) {
+			t.Errorf("%s columns = %q, want %q", name, columns, want)
+		}
+
+		// Every column of a composite foreign key references the matching
+		// column of the referenced key.
+		for _, ref := range []struct{ column, refColumn string }{{"region", "region"}, {"code", "code"}} {
+			c := table.Column(ref.column)
+			if !c.IsForeignKey || c.ForeignKeySchema != "vandal_fixture" || c.ForeignKeyTable != "warehouses" || c.ForeignKeyColumn != ref.refColumn {
+				t.Errorf("%s.%s foreign key = %v %s.%s.%s, want vandal_fixture.warehouses.%s",
+					name, c.Name, c.IsForeignKey, c.ForeignKeySchema, c.ForeignKeyTable, c.ForeignKeyColumn, ref.refColumn)
+			}
+		}
+		for _, column := range []string{"id", "shipped_on"} {
+			if !table.Column(column).IsPrimaryKey {
+				t.Errorf("%s.%s is not a primary key column", name, column)
+			}
+		}
+
+		status := table.Column("status")
+		if status.EnumType != "vandal_fixture.status" || !reflect.DeepEqual(status.EnumValues, []string{"pending", "on hold", "shipped"}) {
+			t.Errorf("%s.status enum = %s %q, want vandal_fixture.status with its labels", name, status.EnumType, status.EnumValues)
+		}
+		// Columns of a domain type have the base type of the domain.
+		if contact := table.Column("contact"); contact.Type != "character varying(120)" || contact.EnumType != "" {
+			t.Errorf("%s.contact type = %q, enum %q, want character varying(120)", name, contact.Type, contact.EnumType)
+		}
+	}
+
+	warehouses := s.Table("vandal_fixture.warehouses")
+	if warehouses == nil {
+		t.Fatal(`Table("vandal_fixture.warehouses") = nil, want the table`)
+	}
+	if name := warehouses.Column("name"); name.Type != "character varying(40)" || name.MaxLength != 40 || !name.IsNullable {
+		t.Errorf("warehouses.name = %+v, want a nullable character varying(40)", name)
+	}
+
+	// The statistics of an analyzed table list the values of columns with
+	// few of them, and the range of the others.
+	region := warehouses.Column("region").Stats
+	if region == nil {
+		t.Fatal("warehouses.region has no statistics")
+	}
+	values := append([]string(nil), region.Values...)
+	sort.Strings(values)
+	if !reflect.DeepEqual(values, []string{"north", "south", "west"}) {
+		t.Errorf("warehouses.region values = %q, want north, south and west", region.Values)
+	}
+	code := warehouses.Column("code").Stats
+	if code == nil {
+		t.Fatal("warehouses.code has no statistics")
+	}
+	if code.Values != nil || code.Min != "1" || code.Max != "30" || code.NullFraction != 0 {
+		t.Errorf("warehouses.code stats = %+v, want the range 1 to 30 and no values", code)
+	}
+}
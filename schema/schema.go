@@ -1,94 +1,177 @@
 package schema
 
 import (
-	"database/sql"
-	"fmt"
+	"strings"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // Schema defines the structure of a database schema.
 type Schema struct {
-	Tables []Table
+	Tables    []Table    `json:"tables"`
+	Sequences []Sequence `json:"sequences,omitempty"`
+	Enums     []Enum     `json:"enums,omitempty"`
+	Views     []View     `json:"views,omitempty"`
 }
 
 // Table defines the structure of a database table.
 type Table struct {
-	Name    string
-	Columns []Column
+	// Schema is the schema the table belongs to, e.g. "public".
+	Schema      string       `json:"schema,omitempty"`
+	Name        string       `json:"name"`
+	Columns     []Column     `json:"columns"`
+	Indexes     []Index      `json:"indexes,omitempty"`
+	Constraints []Constraint `json:"constraints,omitempty"`
 }
 
 // Column defines the structure of a database column.
 type Column struct {
-	Name    string
-	Type    string
-	IsNullable bool
-	IsPrimaryKey bool
-	IsForeignKey bool
-	ForeignKeyTable string
-	ForeignKeyColumn string
+	Name             string `json:"name"`
+	Type             string `json:"type"`
+	MaxLength        int    `json:"maxLength,omitempty"`
+	IsNullable       bool   `json:"nullable,omitempty"`
+	IsPrimaryKey     bool   `json:"primaryKey,omitempty"`
+	IsForeignKey     bool   `json:"foreignKey,omitempty"`
+	ForeignKeySchema string `json:"foreignKeySchema,omitempty"`
+	ForeignKeyTable  string `json:"foreignKeyTable,omitempty"`
+	ForeignKeyColumn string `json:"foreignKeyColumn,omitempty"`
+	// EnumType is the qualified name of the enumerated type of the column, if
+	// it has one, and EnumValues are its labels.
+	EnumType   string   `json:"enumType,omitempty"`
+	EnumValues []string `json:"enumValues,omitempty"`
+	// Stats are not serialized, as they hold values of the database and
+	// change whenever it is analyzed.
+	Stats *ColumnStats `json:"-"`
 }
 
-// GetSchema fetches the schema of a PostgreSQL database.
-func GetSchema(host, port, user, password, dbname string) (*Schema, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, password, dbname)
+// ColumnStats summarizes the values of a column from the statistics the
+// database collects for its query planner. They are only available for
+// analyzed tables.
+type ColumnStats struct {
+	// NullFraction is the fraction of rows where the column is NULL.
+	NullFraction float64
+	// Values are the distinct values of a column that has only a few, such as
+	// a status column. It is empty for columns with many distinct values.
+	Values []string
+	// Min and Max are the lowest and highest values of the column in their
+	// text form, if known.
+	Min string
+	Max string
+}
 
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
+// maxEnumValues is the largest number of distinct values a column can have
+// for ColumnStats to list them.
+const maxEnumValues = 20
 
-	// Get tables
-	rows, err := db.Query("SELECT tablename FROM pg_catalog.pg_tables WHERE schemaname != 'pg_catalog' AND schemaname != 'information_schema'")
-	if err != nil {
-		return nil, err
+// defaultSchema is the schema unqualified names are looked up in first.
+const defaultSchema = "public"
+
+// Table returns the table with the given name, or nil if the schema has no
+// such table. The name may be qualified with a schema, as "schema.table". An
+// unqualified name refers to the table of that name in the public schema or,
+// if there is none, in the first schema that has one.
+func (s *Schema) Table(name string) *Table {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		for j := range s.Tables {
+			if s.Tables[j].Schema == name[:i] && s.Tables[j].Name == name[i+1:] {
+				return &s.Tables[j]
+			}
+		}
 	}
-	defer rows.Close()
 
-	var tables []Table
-	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			return nil, err
+	var found *Table
+	for i := range s.Tables {
+		t := &s.Tables[i]
+		if t.Name != name {
+			continue
+		}
+		if t.Schema == defaultSchema {
+			return t
+		}
+		if found == nil {
+			found = t
 		}
-		tables = append(tables, Table{Name: tableName})
 	}
+	return found
+}
+
+// QualifiedName returns the name of a table qualified with its schema, as
+// "schema.table". Names are not quoted; use QuoteName in SQL.
+func QualifiedName(schemaName, table string) string {
+	if schemaName == "" {
+		return table
+	}
+	return schemaName + "." + table
+}
+
+// QuoteName returns the name of a table qualified with its schema and quoted
+// for use in SQL statements, e.g. "public"."Users".
+func QuoteName(schemaName, table string) string {
+	if schemaName == "" {
+		return pq.QuoteIdentifier(table)
+	}
+	return pq.QuoteIdentifier(schemaName) + "." + pq.QuoteIdentifier(table)
+}
 
-	// Get columns for each table
-	for i, table := range tables {
-		rows, err := db.Query(`
-			SELECT
-				c.column_name,
-				c.data_type,
-				c.is_nullable,
-				(SELECT COUNT(*) FROM information_schema.table_constraints tc JOIN information_schema.key_column_usage kcu ON tc.constraint_name = kcu.constraint_name WHERE tc.table_name = c.table_name AND kcu.column_name = c.column_name AND tc.constraint_type = 'PRIMARY KEY') > 0 AS is_primary_key,
-				(SELECT COUNT(*) FROM information_schema.table_constraints tc JOIN information_schema.key_column_usage kcu ON tc.constraint_name = kcu.constraint_name WHERE tc.table_name = c.table_name AND kcu.column_name = c.column_name AND tc.constraint_type = 'FOREIGN KEY') > 0 AS is_foreign_key,
-				(SELECT ccu.table_name FROM information_schema.referential_constraints rc JOIN information_schema.key_column_usage kcu ON rc.constraint_name = kcu.constraint_name JOIN information_schema.constraint_column_usage ccu ON rc.unique_constraint_name = ccu.constraint_name WHERE kcu.table_name = c.table_name AND kcu.column_name = c.column_name) AS foreign_key_table,
-				(SELECT ccu.column_name FROM information_schema.referential_constraints rc JOIN information_schema.key_column_usage kcu ON rc.constraint_name = kcu.constraint_name JOIN information_schema.constraint_column_usage ccu ON rc.unique_constraint_name = ccu.constraint_name WHERE kcu.table_name = c.table_name AND kcu.column_name = c.column_name) AS foreign_key_column
-			FROM
-				information_schema.columns c
-			WHERE
-				c.table_name = $1
-		`, table.Name)
-		if err != nil {
-			return nil, err
+// QualifiedName returns the name of the table qualified with its schema.
+func (t *Table) QualifiedName() string {
+	return QualifiedName(t.Schema, t.Name)
+}
+
+// QuotedName returns the name of the table qualified with its schema and
+// quoted for SQL.
+func (t *Table) QuotedName() string {
+	return QuoteName(t.Schema, t.Name)
+}
+
+// ForeignKeyQualifiedTable returns the name of the table a foreign key column
+// references, qualified with its schema.
+func (c *Column) ForeignKeyQualifiedTable() string {
+	return QualifiedName(c.ForeignKeySchema, c.ForeignKeyTable)
+}
+
+// Column returns the column with the given name, or nil if the table has no
+// such column.
+func (t *Table) Column(name string) *Column {
+	for i := range t.Columns {
+		if t.Columns[i].Name == name {
+			return &t.Columns[i]
 		}
-		defer rows.Close()
-
-		var columns []Column
-		for rows.Next() {
-			var column Column
-			var isNullable string
-			if err := rows.Scan(&column.Name, &column.Type, &isNullable, &column.IsPrimaryKey, &column.IsForeignKey, &column.ForeignKeyTable, &column.ForeignKeyColumn); err != nil {
-				return nil, err
+	}
+	return nil
+}
+
+// parseArray parses the elements of a one-dimensional PostgreSQL array
+// literal such as {a,"b c",NULL}. NULL elements are skipped.
+func parseArray(literal string) []string {
+	if len(literal) < 2 || literal[0] != '{' || literal[len(literal)-1] != '}' {
+		return nil
+	}
+	body := literal[1 : len(literal)-1]
+
+	var elements []string
+	var element []byte
+	quoted, inQuotes := false, false
+	for i := 0; i <= len(body); i++ {
+		if i == len(body) || (body[i] == ',' && !inQuotes) {
+			if quoted || string(element) != "NULL" {
+				elements = append(elements, string(element))
 			}
-			column.IsNullable = (isNullable == "YES")
-			columns = append(columns, column)
+			element, quoted = element[:0], false
+			continue
+		}
+		switch c := body[i]; {
+		case c == '"':
+			inQuotes, quoted = !inQuotes, true
+		case c == '\\' && i+1 < len(body):
+			i++
+			element = append(element, body[i])
+		default:
+			element = append(element, c)
 		}
-		tables[i].Columns = columns
 	}
-
-	return &Schema{Tables: tables}, nil
+	if len(body) == 0 {
+		return nil
+	}
+	return elements
 }
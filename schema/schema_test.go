@@ -0,0 +1,58 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArray(t *testing.T) {
+	for literal, want := range map[string][]string{
+		`{active,inactive}`:           {"active", "inactive"},
+		`{"on hold",NULL,"NULL"}`:     {"on hold", "NULL"},
+		`{"a \"quoted\" value",x\,y}`: {`a "quoted" value`, "x,y"},
+		`{}`:                          nil,
+		``:                            nil,
+	} {
+		if got := parseArray(literal); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseArray(%q) = %q, want %q", literal, got, want)
+		}
+	}
+}
+
+func TestParseMySQLEnum(t *testing.T) {
+	for columnType, want := range map[string][]string{
+		`enum('small','medium','large')`: {"small", "medium", "large"},
+		`enum('it''s','a,b','')`:         {"it's", "a,b", ""},
+		`varchar(20)`:                    nil,
+	} {
+		if got := parseMySQLEnum(columnType); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseMySQLEnum(%q) = %q, want %q", columnType, got, want)
+		}
+	}
+}
+
+func TestSchemaTable(t *testing.T) {
+	s := &Schema{Tables: []Table{
+		{Schema: "sales", Name: "users"},
+		{Schema: "public", Name: "users"},
+		{Schema: "sales", Name: "Orders"},
+	}}
+	for name, want := range map[string]string{
+		"users":        `"public"."users"`,
+		"sales.users":  `"sales"."users"`,
+		"Orders":       `"sales"."Orders"`,
+		"public.users": `"public"."users"`,
+	} {
+		table := s.Table(name)
+		if table == nil {
+			t.Errorf("Table(%q) = nil, want %s", name, want)
+			continue
+		}
+		if got := table.QuotedName(); got != want {
+			t.Errorf("Table(%q) = %s, want %s", name, got, want)
+		}
+	}
+	if table := s.Table("public.Orders"); table != nil {
+		t.Errorf("Table(%q) = %s, want nil", "public.Orders", table.QualifiedName())
+	}
+}
@@ -0,0 +1,38 @@
+-- Fixture of TestLoadPostgres, loaded into the database named by
+-- VANDAL_TEST_POSTGRES.
+DROP SCHEMA IF EXISTS vandal_fixture CASCADE;
+CREATE SCHEMA vandal_fixture;
+
+CREATE TYPE vandal_fixture.status AS ENUM ('pending', 'on hold', 'shipped');
+CREATE DOMAIN vandal_fixture.email AS varchar(120);
+
+CREATE TABLE vandal_fixture.warehouses (
+    region text NOT NULL,
+    code integer NOT NULL,
+    name varchar(40),
+    PRIMARY KEY (region, code)
+);
+
+-- A partitioned table with a composite foreign key, which its partitions
+-- inherit.
+CREATE TABLE vandal_fixture.shipments (
+    id bigint NOT NULL,
+    shipped_on date NOT NULL,
+    region text,
+    code integer,
+    status vandal_fixture.status,
+    contact vandal_fixture.email,
+    PRIMARY KEY (id, shipped_on),
+    CONSTRAINT shipments_warehouse_fkey FOREIGN KEY (region, code) REFERENCES vandal_fixture.warehouses (region, code)
+) PARTITION BY RANGE (shipped_on);
+CREATE TABLE vandal_fixture.shipments_2024 PARTITION OF vandal_fixture.shipments
+    FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');
+
+INSERT INTO vandal_fixture.warehouses
+    SELECT (ARRAY['north', 'south', 'west'])[i % 3 + 1], i, 'warehouse ' || i
+    FROM generate_series(1, 30) i;
+INSERT INTO vandal_fixture.shipments
+    SELECT i, date '2024-01-01' + i, region, code, 'pending', 'clerk@example.com'
+    FROM generate_series(1, 30) i
+    JOIN vandal_fixture.warehouses ON code = i;
+ANALYZE vandal_fixture.warehouses;
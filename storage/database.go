@@ -2,19 +2,63 @@ package storage
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"io"
 
+	vandalv1alpha1 "github.com/Oridak771/Vandal/apis/v1alpha1"
 	"github.com/Oridak771/Vandal/schema"
 )
 
 // Database defines the interface for a database.
 type Database interface {
-	// Connect connects to the database.
+	// Connect opens the connection pool of the database and checks that the
+	// database can be reached. Other methods open the pool on first use too.
 	Connect(ctx context.Context) error
 	// GetSchema returns the schema of the database.
 	GetSchema(ctx context.Context) (*schema.Schema, error)
 	// DumpTable creates a dump of a single table.
-	DumpTable(ctx context.Context, tableName string) (io.Reader, error)
+	DumpTable(ctx context.Context, table *schema.Table) (io.Reader, error)
+	// DumpTableSchema creates a dump of the definition of a single table,
+	// without its rows.
+	DumpTableSchema(ctx context.Context, table *schema.Table) (io.Reader, error)
 	// Restore restores a dump of a database.
 	Restore(ctx context.Context, in io.Reader) error
+	// Close releases the connections of the database. The database can still
+	// be used afterwards, opening a new pool.
+	Close() error
+}
+
+// SQLDatabase is implemented by databases that can be queried with SQL, which
+// subsetting needs to select rows.
+type SQLDatabase interface {
+	// DB returns a connection pool to the database.
+	DB(ctx context.Context) (*sql.DB, error)
+}
+
+// Sampler is implemented by databases that can read sample values of their
+// columns, which discovery classifies.
+type Sampler interface {
+	// SampleValues returns up to limit values of every column of a table,
+	// keyed by column name. NULL values are left out.
+	SampleValues(ctx context.Context, table *schema.Table, limit int) (map[string][]string, error)
+}
+
+// NewDatabase creates a database of the given engine, PostgreSQL if empty.
+func NewDatabase(engine, host, port, user, password, dbname string, opts Options) (Database, error) {
+	switch engine {
+	case "", vandalv1alpha1.DatabaseEnginePostgres:
+		return NewPostgresDatabase(host, port, user, password, dbname, opts), nil
+	case vandalv1alpha1.DatabaseEngineMySQL:
+		return NewMySQLDatabase(host, port, user, password, dbname, opts), nil
+	}
+	return nil, fmt.Errorf("unsupported database engine %q", engine)
+}
+
+// DefaultPort returns the port a database engine listens on by default.
+func DefaultPort(engine string) string {
+	if engine == vandalv1alpha1.DatabaseEngineMySQL {
+		return "3306"
+	}
+	return "5432"
 }
@@ -66,9 +66,9 @@ func (p *ebsProvider) CleanupSnapshots(ctx context.Context, dataProfile *vandalv
 		}
 	}
 
-	// 3. Sort snapshots by creation time
+	// 3. Sort snapshots by creation time, newest first
 	sort.Slice(snapshots, func(i, j int) bool {
-		return snapshots[i].CreationTimestamp.Before(&snapshots[j].CreationTimestamp)
+		return snapshots[j].CreationTimestamp.Before(&snapshots[i].CreationTimestamp)
 	})
 
 	// 4. Delete old snapshots
@@ -1,52 +1,361 @@
 package storage
 
 import (
+	"bufio"
 	"context"
+	"database/sql"
+	"fmt"
 	"io"
+	"net"
+	"strings"
+	"sync"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+
+	"github.com/Oridak771/Vandal/pkg/copytext"
 	"github.com/Oridak771/Vandal/schema"
 )
 
+// mysqlMaxPlaceholders bounds the number of values of a single INSERT
+// statement, below the 65535 placeholders MySQL accepts.
+const mysqlMaxPlaceholders = 60000
+
+// mysqlMaxBatchRows bounds the number of rows of a single INSERT statement.
+const mysqlMaxBatchRows = 1000
+
 // NewMySQLDatabase creates a new MySQL database.
-func NewMySQLDatabase(host, port, user, password, dbname string) Database {
+func NewMySQLDatabase(host, port, user, password, dbname string, opts Options) Database {
 	return &mysqlDatabase{
 		host:     host,
 		port:     port,
 		user:     user,
 		password: password,
 		dbname:   dbname,
+		opts:     opts.withDefaults(),
 	}
 }
 
-// mysqlDatabase is a basic implementation of the Database interface for MySQL.
+// mysqlDatabase is an implementation of the Database interface for MySQL and
+// MariaDB. Tables are dumped in the plain COPY text format pg_dump writes, so
+// that the masker handles dumps of both engines alike: each dump is the CREATE
+// TABLE statement of the table followed by a "COPY ... FROM stdin;" block of
+// its rows.
+//
+// mysqlDatabase does not implement SQLDatabase, whose users issue PostgreSQL
+// statements.
 type mysqlDatabase struct {
 	host     string
 	port     string
 	user     string
 	password string
 	dbname   string
+	opts     Options
+
+	mu sync.Mutex
+	db *sql.DB
 }
 
-// Connect implements the Database interface.
+// Connect implements the Database interface. It opens the connection pool and
+// checks that the database can be reached, retrying as configured.
 func (d *mysqlDatabase) Connect(ctx context.Context) error {
-	// To be implemented
-	return nil
+	db, err := d.pool(ctx)
+	if err != nil {
+		return err
+	}
+	return connect(ctx, d.opts, db.PingContext)
+}
+
+// pool returns a connection pool to the database, opened on first use.
+func (d *mysqlDatabase) pool(ctx context.Context) (*sql.DB, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.db == nil {
+		cfg := mysql.NewConfig()
+		cfg.User = d.user
+		cfg.Passwd = d.password
+		cfg.Net = "tcp"
+		cfg.Addr = net.JoinHostPort(d.host, d.port)
+		cfg.DBName = d.dbname
+		cfg.Timeout = d.opts.ConnectTimeout
+		tlsConfig, err := d.opts.TLS.config(d.host)
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = tlsConfig
+		connector, err := mysql.NewConnector(cfg)
+		if err != nil {
+			return nil, err
+		}
+		db := sql.OpenDB(connector)
+		db.SetMaxOpenConns(d.opts.MaxConns)
+		db.SetConnMaxIdleTime(d.opts.MaxConnIdleTime)
+		d.db = db
+	}
+	return d.db, nil
+}
+
+// Close implements the Database interface. It closes the connection pool of
+// the database, if it was opened.
+func (d *mysqlDatabase) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.db == nil {
+		return nil
+	}
+	err := d.db.Close()
+	d.db = nil
+	return err
 }
 
 // GetSchema implements the Database interface.
 func (d *mysqlDatabase) GetSchema(ctx context.Context) (*schema.Schema, error) {
-	// To be implemented
-	return nil, nil
+	db, err := d.pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return schema.LoadMySQL(ctx, db)
+}
+
+// SampleValues implements the Sampler interface.
+func (d *mysqlDatabase) SampleValues(ctx context.Context, table *schema.Table, limit int) (map[string][]string, error) {
+	db, err := d.pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return schema.Sample(ctx, db, fmt.Sprintf("SELECT * FROM %s LIMIT %d", quoteMySQLName(table.Schema, table.Name), limit))
 }
 
 // DumpTable implements the Database interface.
-func (d *mysqlDatabase) DumpTable(ctx context.Context, tableName string) (io.Reader, error) {
-	// To be implemented
-	return nil, nil
+func (d *mysqlDatabase) DumpTable(ctx context.Context, table *schema.Table) (io.Reader, error) {
+	return d.dump(ctx, table, true)
+}
+
+// DumpTableSchema implements the Database interface.
+func (d *mysqlDatabase) DumpTableSchema(ctx context.Context, table *schema.Table) (io.Reader, error) {
+	return d.dump(ctx, table, false)
+}
+
+// dump returns the CREATE TABLE statement of a table followed, if rows is
+// set, by a COPY block of its rows. An error while dumping is returned by the
+// reader once the output is consumed.
+func (d *mysqlDatabase) dump(ctx context.Context, table *schema.Table, rows bool) (io.Reader, error) {
+	db, err := d.pool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeMySQLTable(ctx, db, pw, table, rows))
+	}()
+	return pr, nil
+}
+
+func writeMySQLTable(ctx context.Context, db *sql.DB, out io.Writer, table *schema.Table, withRows bool) error {
+	name := quoteMySQLName(table.Schema, table.Name)
+	var tableName, create string
+	if err := db.QueryRowContext(ctx, "SHOW CREATE TABLE "+name).Scan(&tableName, &create); err != nil {
+		return fmt.Errorf("reading definition of %s: %w", table.QualifiedName(), err)
+	}
+	// The table is created in the database restored into, whatever its name.
+	create = strings.Replace(create, "CREATE TABLE ", "CREATE TABLE IF NOT EXISTS ", 1)
+
+	w := bufio.NewWriterSize(out, 64*1024)
+	if _, err := w.WriteString(create + ";\n"); err != nil {
+		return err
+	}
+	if !withRows {
+		return w.Flush()
+	}
+
+	names := make([]string, len(table.Columns))
+	selects := make([]string, len(table.Columns))
+	for i, c := range table.Columns {
+		names[i] = pq.QuoteIdentifier(c.Name)
+		selects[i] = quoteMySQL(c.Name)
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s", strings.Join(selects, ", "), name))
+	if err != nil {
+		return fmt.Errorf("reading rows of %s: %w", table.QualifiedName(), err)
+	}
+	defer rows.Close()
+
+	fmt.Fprintf(w, "COPY %s (%s) FROM stdin;\n", table.QuotedName(), strings.Join(names, ", "))
+	values := make([]sql.NullString, len(table.Columns))
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	fields := make([]*string, len(values))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i := range values {
+			fields[i] = nil
+			if values[i].Valid {
+				fields[i] = &values[i].String
+			}
+		}
+		if _, err := w.WriteString(copytext.JoinRow(fields) + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(copytext.Terminator + "\n"); err != nil {
+		return err
+	}
+	return w.Flush()
 }
 
-// Restore implements the Database interface.
+// Restore implements the Database interface. It runs the SQL statements of a
+// dump and loads its COPY blocks. The rows of a COPY block replace the rows of
+// its table, so that a database masked in place keeps only masked rows. Tables
+// are looked up in the database restored into, whatever schema the COPY block
+// names. Foreign keys are not checked while restoring, as tables are restored
+// in any order.
 func (d *mysqlDatabase) Restore(ctx context.Context, in io.Reader) error {
-	// To be implemented
-	return nil
+	db, err := d.pool(ctx)
+	if err != nil {
+		return err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0"); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(in, 64*1024)
+	var stmt strings.Builder
+	for {
+		line, readErr := r.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case stmt.Len() == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")):
+		case stmt.Len() == 0 && strings.HasPrefix(strings.ToUpper(trimmed), "COPY "):
+			header, ok, err := copytext.ParseHeader(line)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("unsupported statement: %s", trimmed)
+			}
+			if err := restoreMySQLCopy(ctx, conn, header, r); err != nil {
+				return fmt.Errorf("restoring %s: %w", header.Table, err)
+			}
+		default:
+			stmt.WriteString(line)
+			if strings.HasSuffix(trimmed, ";") || readErr == io.EOF {
+				if _, err := conn.ExecContext(ctx, stmt.String()); err != nil {
+					return err
+				}
+				stmt.Reset()
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// restoreMySQLCopy replaces the rows of the table of a COPY block with the
+// rows read from r, up to the end of the block, in a single transaction.
+func restoreMySQLCopy(ctx context.Context, conn *sql.Conn, header *copytext.Header, r *bufio.Reader) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	table := quoteMySQL(header.Table)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+		return err
+	}
+
+	insert := "INSERT INTO " + table
+	if len(header.Columns) > 0 {
+		columns := make([]string, len(header.Columns))
+		for i, c := range header.Columns {
+			columns[i] = quoteMySQL(c)
+		}
+		insert += " (" + strings.Join(columns, ", ") + ")"
+	}
+
+	var batch [][]*string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var b strings.Builder
+		var args []interface{}
+		b.WriteString(insert + " VALUES ")
+		for i, row := range batch {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("(" + strings.TrimSuffix(strings.Repeat("?, ", len(row)), ", ") + ")")
+			for _, f := range row {
+				if f == nil {
+					args = append(args, nil)
+				} else {
+					args = append(args, *f)
+				}
+			}
+		}
+		batch = batch[:0]
+		_, err := tx.ExecContext(ctx, b.String(), args...)
+		return err
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF {
+				return fmt.Errorf("unexpected end of input inside COPY block")
+			}
+			return err
+		}
+		row := strings.TrimSuffix(line, "\n")
+		if row == copytext.Terminator {
+			break
+		}
+		fields := copytext.SplitRow(row)
+		if len(header.Columns) > 0 && len(fields) != len(header.Columns) {
+			return fmt.Errorf("row has %d fields, expected %d", len(fields), len(header.Columns))
+		}
+		batch = append(batch, fields)
+		if len(batch) >= mysqlMaxBatchRows || (len(batch)+1)*len(fields) > mysqlMaxPlaceholders {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// quoteMySQL quotes an identifier for MySQL.
+func quoteMySQL(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// quoteMySQLName returns the name of a table qualified with its database and
+// quoted for MySQL.
+func quoteMySQLName(database, table string) string {
+	if database == "" {
+		return quoteMySQL(table)
+	}
+	return quoteMySQL(database) + "." + quoteMySQL(table)
 }
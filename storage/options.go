@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Default connection settings, used for the zero fields of Options.
+const (
+	defaultConnectTimeout  = 10 * time.Second
+	defaultRetryInterval   = 2 * time.Second
+	defaultMaxConns        = 10
+	defaultMaxConnIdleTime = 5 * time.Minute
+)
+
+// Options configures the connections to a database. Zero fields take their
+// default values.
+type Options struct {
+	// ConnectTimeout bounds the time to open a connection, 10 seconds by
+	// default.
+	ConnectTimeout time.Duration
+	// ConnectRetries is the number of times Connect retries after failing to
+	// reach the database. Connect does not retry by default.
+	ConnectRetries int
+	// RetryInterval is the time Connect waits between attempts, 2 seconds by
+	// default.
+	RetryInterval time.Duration
+	// MaxConns bounds the connections of the pool shared by introspection,
+	// dumping and restoring, 10 by default. Every table being copied holds a
+	// connection to dump it and, when masking in place, one to restore it.
+	MaxConns int
+	// MaxConnIdleTime is the time after which idle connections are closed, 5
+	// minutes by default.
+	MaxConnIdleTime time.Duration
+	// TLS configures encrypted connections. Connections are not encrypted
+	// when nil.
+	TLS *TLS
+}
+
+// withDefaults returns the options with their zero fields set to the
+// defaults.
+func (o Options) withDefaults() Options {
+	if o.ConnectTimeout <= 0 {
+		o.ConnectTimeout = defaultConnectTimeout
+	}
+	if o.ConnectRetries < 0 {
+		o.ConnectRetries = 0
+	}
+	if o.RetryInterval <= 0 {
+		o.RetryInterval = defaultRetryInterval
+	}
+	if o.MaxConns <= 0 {
+		o.MaxConns = defaultMaxConns
+	}
+	if o.MaxConnIdleTime <= 0 {
+		o.MaxConnIdleTime = defaultMaxConnIdleTime
+	}
+	return o
+}
+
+// connect calls ping until it succeeds, at most ConnectRetries+1 times, each
+// attempt bounded by ConnectTimeout. It returns the error of the last attempt.
+func connect(ctx context.Context, opts Options, ping func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, opts.ConnectTimeout)
+		err := ping(pingCtx)
+		cancel()
+		if err == nil || attempt >= opts.ConnectRetries {
+			return err
+		}
+
+		timer := time.NewTimer(opts.RetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
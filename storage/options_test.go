@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOptionsWithDefaults(t *testing.T) {
+	got := Options{ConnectRetries: -1}.withDefaults()
+	want := Options{
+		ConnectTimeout:  defaultConnectTimeout,
+		RetryInterval:   defaultRetryInterval,
+		MaxConns:        defaultMaxConns,
+		MaxConnIdleTime: defaultMaxConnIdleTime,
+	}
+	if got != want {
+		t.Errorf("withDefaults() = %+v, want %+v", got, want)
+	}
+
+	set := Options{
+		ConnectTimeout:  time.Second,
+		ConnectRetries:  3,
+		RetryInterval:   time.Millisecond,
+		MaxConns:        2,
+		MaxConnIdleTime: time.Minute,
+	}
+	if got := set.withDefaults(); got != set {
+		t.Errorf("withDefaults() = %+v, want the options unchanged", got)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	unreachable := errors.New("unreachable")
+	for _, tt := range []struct {
+		name         string
+		retries      int
+		failures     int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "reachable", retries: 0, failures: 0, wantAttempts: 1},
+		{name: "no retries", retries: 0, failures: 1, wantAttempts: 1, wantErr: true},
+		{name: "reachable after retries", retries: 3, failures: 2, wantAttempts: 3},
+		{name: "retries exhausted", retries: 2, failures: 5, wantAttempts: 3, wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{ConnectRetries: tt.retries, RetryInterval: 10 * time.Millisecond}.withDefaults()
+			attempts := 0
+			var last time.Time
+			err := connect(context.Background(), opts, func(ctx context.Context) error {
+				// Attempts are bounded by ConnectTimeout and spaced by
+				// RetryInterval.
+				if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > opts.ConnectTimeout {
+					t.Errorf("attempt deadline = %v, %v, want within %v", deadline, ok, opts.ConnectTimeout)
+				}
+				if attempts > 0 && time.Since(last) < opts.RetryInterval {
+					t.Errorf("attempt %d came %v after the previous one, want at least %v", attempts+1, time.Since(last), opts.RetryInterval)
+				}
+				attempts++
+				last = time.Now()
+				if attempts <= tt.failures {
+					return unreachable
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr || (err != nil && err != unreachable) {
+				t.Errorf("connect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("connect() made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestConnectStopsAtDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	opts := Options{ConnectRetries: 1000, RetryInterval: 20 * time.Millisecond}.withDefaults()
+
+	unreachable := errors.New("unreachable")
+	attempts := 0
+	start := time.Now()
+	err := connect(ctx, opts, func(ctx context.Context) error {
+		attempts++
+		return unreachable
+	})
+	if err != unreachable {
+		t.Errorf("connect() error = %v, want the error of the last attempt", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connect() returned after %v, want it to stop at the deadline of the context", elapsed)
+	}
+	if attempts < 2 || attempts > 6 {
+		t.Errorf("connect() made %d attempts before the deadline, want about 5", attempts)
+	}
+}
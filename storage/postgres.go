@@ -2,68 +2,156 @@ package storage
 
 import (
 	"context"
-	"io"
-	"os/exec"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 
 	"github.com/Oridak771/Vandal/schema"
 )
 
 // NewPostgresDatabase creates a new PostgreSQL database.
-func NewPostgresDatabase(host, port, user, password, dbname string) Database {
+func NewPostgresDatabase(host, port, user, password, dbname string, opts Options) Database {
 	return &postgresDatabase{
 		host:     host,
 		port:     port,
 		user:     user,
 		password: password,
 		dbname:   dbname,
+		opts:     opts.withDefaults(),
 	}
 }
 
-// postgresDatabase is a basic implementation of the Database interface for PostgreSQL.
+// postgresDatabase is an implementation of the Database interface for
+// PostgreSQL. Dumps are written in the plain format of pg_dump: SQL statements
+// creating a table followed by a "COPY ... FROM stdin;" block of its rows.
+// They are read and written with the COPY protocol, so no client binaries are
+// needed. Queries and COPY share a single connection pool.
 type postgresDatabase struct {
 	host     string
 	port     string
 	user     string
 	password string
 	dbname   string
+	opts     Options
+
+	mu   sync.Mutex
+	pool *pgxpool.Pool
+	db   *sql.DB
+
+	// foreignKeys are foreign key constraints restored before the table they
+	// reference, which are added once it is restored.
+	fkMu        sync.Mutex
+	foreignKeys []string
 }
 
-// Connect implements the Database interface.
+// Connect implements the Database interface. It opens the connection pool and
+// checks that the database can be reached, retrying as configured.
 func (d *postgresDatabase) Connect(ctx context.Context) error {
-	// The connection is implicitly tested by other methods.
-	return nil
+	pool, err := d.connPool()
+	if err != nil {
+		return err
+	}
+	return connect(ctx, d.opts, pool.Ping)
 }
 
-// GetSchema implements the Database interface.
-func (d *postgresDatabase) GetSchema(ctx context.Context) (*schema.Schema, error) {
-	return schema.GetSchema(d.host, d.port, d.user, d.password, d.dbname)
+// connPool returns the connection pool to the database, opened on first use.
+// Opening the pool does not connect to the database.
+func (d *postgresDatabase) connPool() (*pgxpool.Pool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pool == nil {
+		cfg, err := pgxpool.ParseConfig(d.connString())
+		if err != nil {
+			return nil, err
+		}
+		// TLS is configured here rather than in the connection string, which
+		// can only name certificate files.
+		if cfg.ConnConfig.TLSConfig, err = d.opts.TLS.config(d.host); err != nil {
+			return nil, err
+		}
+		cfg.ConnConfig.ConnectTimeout = d.opts.ConnectTimeout
+		cfg.MaxConns = int32(d.opts.MaxConns)
+		cfg.MaxConnIdleTime = d.opts.MaxConnIdleTime
+		// The pool is only opened lazily, as Connect reports failures.
+		pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+		if err != nil {
+			return nil, err
+		}
+		d.pool = pool
+		d.db = stdlib.OpenDBFromPool(pool)
+	}
+	return d.pool, nil
+}
+
+// acquire returns a connection of the pool, which must be released.
+func (d *postgresDatabase) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	pool, err := d.connPool()
+	if err != nil {
+		return nil, err
+	}
+	return pool.Acquire(ctx)
+}
+
+// DB implements the SQLDatabase interface. It draws its connections from the
+// pool of the database.
+func (d *postgresDatabase) DB(ctx context.Context) (*sql.DB, error) {
+	if _, err := d.connPool(); err != nil {
+		return nil, err
+	}
+	return d.db, nil
 }
 
-// DumpTable implements the Database interface.
-func (d *postgresDatabase) DumpTable(ctx context.Context, tableName string) (io.Reader, error) {
-	cmd := exec.CommandContext(ctx, "pg_dump",
-		"-h", d.host,
-		"-p", d.port,
-		"-U", d.user,
-		"-d", d.dbname,
-		"-t", tableName,
-		"-F", "c", // Custom format
-	)
-	cmd.Env = append(cmd.Env, "PGPASSWORD="+d.password)
+// Close implements the Database interface. It closes the connection pool of
+// the database, if it was opened.
+func (d *postgresDatabase) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pool == nil {
+		return nil
+	}
+	err := d.db.Close()
+	d.pool.Close()
+	d.pool, d.db = nil, nil
+	return err
+}
 
-	return cmd.StdoutPipe()
+// connString returns the connection string of the database, in the keyword
+// and value format of libpq.
+func (d *postgresDatabase) connString() string {
+	settings := []struct{ key, value string }{
+		{"host", d.host},
+		{"port", d.port},
+		{"user", d.user},
+		{"password", d.password},
+		{"dbname", d.dbname},
+		{"sslmode", "disable"},
+	}
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	parts := make([]string, len(settings))
+	for i, s := range settings {
+		parts[i] = s.key + "='" + quote.Replace(s.value) + "'"
+	}
+	return strings.Join(parts, " ")
 }
 
-// Restore implements the Database interface.
-func (d *postgresDatabase) Restore(ctx context.Context, in io.Reader) error {
-	cmd := exec.CommandContext(ctx, "pg_restore",
-		"-h", d.host,
-		"-p", d.port,
-		"-U", d.user,
-		"-d", d.dbname,
-	)
-	cmd.Env = append(cmd.Env, "PGPASSWORD="+d.password)
-	cmd.Stdin = in
+// GetSchema implements the Database interface.
+func (d *postgresDatabase) GetSchema(ctx context.Context) (*schema.Schema, error) {
+	db, err := d.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return schema.Load(ctx, db)
+}
 
-	return cmd.Run()
+// SampleValues implements the Sampler interface.
+func (d *postgresDatabase) SampleValues(ctx context.Context, table *schema.Table, limit int) (map[string][]string, error) {
+	db, err := d.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return schema.Sample(ctx, db, fmt.Sprintf("SELECT * FROM %s LIMIT %d", table.QuotedName(), limit))
 }
@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+
+	"github.com/Oridak771/Vandal/pkg/copytext"
+	"github.com/Oridak771/Vandal/schema"
+)
+
+// PostgreSQL error codes handled when restoring tables and foreign keys.
+const (
+	pgUndefinedTable  = "42P01"
+	pgDuplicateObject = "42710"
+)
+
+// DumpTable implements the Database interface.
+func (d *postgresDatabase) DumpTable(ctx context.Context, table *schema.Table) (io.Reader, error) {
+	return d.dump(ctx, table, true)
+}
+
+// DumpTableSchema implements the Database interface.
+func (d *postgresDatabase) DumpTableSchema(ctx context.Context, table *schema.Table) (io.Reader, error) {
+	return d.dump(ctx, table, false)
+}
+
+// dump returns the definition of a table followed, if rows is set, by a COPY
+// block of its rows. An error while dumping is returned by the reader once the
+// output is consumed.
+func (d *postgresDatabase) dump(ctx context.Context, table *schema.Table, rows bool) (io.Reader, error) {
+	db, err := d.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(d.writeTable(ctx, db, pw, table, rows))
+	}()
+	return pr, nil
+}
+
+func (d *postgresDatabase) writeTable(ctx context.Context, db *sql.DB, out io.Writer, table *schema.Table, withRows bool) error {
+	def, err := readTableDefinition(ctx, db, table)
+	if err != nil {
+		return fmt.Errorf("reading definition of %s: %w", table.QualifiedName(), err)
+	}
+
+	w := bufio.NewWriterSize(out, 64*1024)
+	if _, err := w.WriteString(def.sql()); err != nil {
+		return err
+	}
+	if withRows {
+		conn, err := d.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+
+		columns := strings.Join(def.copyColumns, ", ")
+		fmt.Fprintf(w, "COPY %s (%s) FROM stdin;\n", table.QuotedName(), columns)
+		if _, err := conn.Conn().PgConn().CopyTo(ctx, w, fmt.Sprintf("COPY %s (%s) TO STDOUT", table.QuotedName(), columns)); err != nil {
+			return fmt.Errorf("reading rows of %s: %w", table.QualifiedName(), err)
+		}
+		if _, err := w.WriteString(copytext.Terminator + "\n"); err != nil {
+			return err
+		}
+	}
+	for _, fk := range def.foreignKeys {
+		if _, err := w.WriteString(fk + "\n"); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// tableDefinition holds the statements recreating a table.
+type tableDefinition struct {
+	// create are the statements creating the table and the objects it needs,
+	// in order. Every statement tolerates objects that already exist.
+	create []string
+	// foreignKeys are the statements adding the foreign keys of the table.
+	foreignKeys []string
+	// copyColumns are the quoted names of the columns COPY reads and writes,
+	// leaving out generated columns.
+	copyColumns []string
+}
+
+func (def *tableDefinition) sql() string {
+	var b strings.Builder
+	for _, stmt := range def.create {
+		b.WriteString(stmt + "\n")
+	}
+	return b.String()
+}
+
+// readTableDefinition reads the definition of a table from the catalog: the
+// enum types and serial sequences its columns use, its columns, constraints
+// and indexes. Foreign keys are added NOT VALID, since the rows they reference
+// may be restored after the rows referencing them. Partitioning, domains and
+// column types other than enums are not recreated.
+func readTableDefinition(ctx context.Context, db *sql.DB, table *schema.Table) (*tableDefinition, error) {
+	name := table.QuotedName()
+	def := &tableDefinition{}
+	if table.Schema != "" && table.Schema != "public" {
+		def.create = append(def.create, "CREATE SCHEMA IF NOT EXISTS "+pq.QuoteIdentifier(table.Schema)+";")
+	}
+
+	enums, err := queryStrings(ctx, db, `
+		SELECT format('DO $$ BEGIN CREATE TYPE %s AS ENUM (%s); EXCEPTION WHEN duplicate_object THEN NULL; END $$;',
+			format_type(t.oid, NULL),
+			(SELECT string_agg(quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder) FROM pg_enum e WHERE e.enumtypid = t.oid))
+		FROM pg_type t
+		WHERE t.typtype = 'e' AND t.oid IN (
+			SELECT atttypid FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped)
+		ORDER BY 1`, name)
+	if err != nil {
+		return nil, err
+	}
+	def.create = append(def.create, enums...)
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT quote_ident(n.nspname) || '.' || quote_ident(s.relname), quote_ident(a.attname)
+		FROM pg_depend d
+		JOIN pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+		JOIN pg_namespace n ON n.oid = s.relnamespace
+		JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE d.classid = 'pg_class'::regclass AND d.refobjid = $1::regclass AND d.deptype = 'a'
+		ORDER BY 1`, name)
+	if err != nil {
+		return nil, err
+	}
+	var owned []string
+	for rows.Next() {
+		var sequence, column string
+		if err := rows.Scan(&sequence, &column); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		def.create = append(def.create, "CREATE SEQUENCE IF NOT EXISTS "+sequence+";")
+		owned = append(owned, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s;", sequence, name, column))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var elements []string
+	rows, err = db.QueryContext(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull, pg_get_expr(ad.adbin, ad.adrelid),
+			a.attidentity::text, a.attgenerated::text
+		FROM pg_attribute a
+		LEFT JOIN pg_attrdef ad ON ad.adrelid = a.attrelid AND ad.adnum = a.attnum
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var column, sqlType, identity, generated string
+		var notNull bool
+		var defaultExpr sql.NullString
+		if err := rows.Scan(&column, &sqlType, &notNull, &defaultExpr, &identity, &generated); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		element := pq.QuoteIdentifier(column) + " " + sqlType
+		switch {
+		case generated == "s":
+			element += " GENERATED ALWAYS AS (" + defaultExpr.String + ") STORED"
+		case identity == "a":
+			element += " GENERATED ALWAYS AS IDENTITY"
+		case identity == "d":
+			element += " GENERATED BY DEFAULT AS IDENTITY"
+		case defaultExpr.Valid:
+			element += " DEFAULT " + defaultExpr.String
+		}
+		if notNull {
+			element += " NOT NULL"
+		}
+		elements = append(elements, element)
+		if generated != "s" {
+			def.copyColumns = append(def.copyColumns, pq.QuoteIdentifier(column))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT conname, contype::text, pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE conrelid = $1::regclass AND contype IN ('p', 'u', 'c', 'x', 'f') AND conislocal
+		ORDER BY conname`, name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var constraint, contype, definition string
+		if err := rows.Scan(&constraint, &contype, &definition); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if contype == "f" {
+			def.foreignKeys = append(def.foreignKeys, fmt.Sprintf("ALTER TABLE ONLY %s ADD CONSTRAINT %s %s NOT VALID;",
+				name, pq.QuoteIdentifier(constraint), strings.TrimSuffix(definition, " NOT VALID")))
+			continue
+		}
+		elements = append(elements, "CONSTRAINT "+pq.QuoteIdentifier(constraint)+" "+definition)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	def.create = append(def.create, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n    %s\n);", name, strings.Join(elements, ",\n    ")))
+
+	indexes, err := queryStrings(ctx, db, `
+		SELECT pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		WHERE i.indrelid = $1::regclass AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.indexrelid)
+		ORDER BY 1`, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		def.create = append(def.create, strings.Replace(index, " INDEX ", " INDEX IF NOT EXISTS ", 1)+";")
+	}
+	def.create = append(def.create, owned...)
+	return def, nil
+}
+
+// queryStrings runs a query returning a single text column.
+func queryStrings(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// Restore implements the Database interface. It runs the SQL statements of a
+// plain-format dump and loads its COPY blocks with the COPY protocol. The rows
+// of a COPY block replace the rows of its table, so that a database masked in
+// place keeps only masked rows. Triggers, including the ones checking foreign
+// keys, are disabled while restoring, so the user must be a superuser. Foreign keys
+// referencing a table that does not exist yet are added once a later Restore
+// creates it; foreign keys that already exist are left as they are.
+func (d *postgresDatabase) Restore(ctx context.Context, in io.Reader) error {
+	pooled, err := d.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	conn := pooled.Conn().PgConn()
+	// The session is reset before the connection returns to the pool, and
+	// the connection closed if that fails.
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "RESET session_replication_role").ReadAll(); err != nil {
+			pooled.Hijack().Close(context.Background())
+			return
+		}
+		pooled.Release()
+	}()
+
+	// Tables are restored in any order and, in place, while their rows are
+	// referenced, so restoring with triggers and foreign key actions enabled
+	// would reject rows or cascade deletes into tables already restored.
+	if _, err := conn.Exec(ctx, "SET session_replication_role = replica").ReadAll(); err != nil {
+		return fmt.Errorf("disabling triggers, which requires a superuser: %w", err)
+	}
+
+	r := bufio.NewReaderSize(in, 64*1024)
+	var stmts strings.Builder
+	var foreignKeys []string
+	flush := func() error {
+		if strings.TrimSpace(stmts.String()) == "" {
+			stmts.Reset()
+			return nil
+		}
+		_, err := conn.Exec(ctx, stmts.String()).ReadAll()
+		stmts.Reset()
+		return err
+	}
+	for {
+		line, readErr := r.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		header, ok, err := copytext.ParseHeader(line)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ok:
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := restoreCopy(ctx, conn, header, r); err != nil {
+				return fmt.Errorf("restoring %s: %w", schema.QualifiedName(header.Schema, header.Table), err)
+			}
+		case strings.HasPrefix(line, "ALTER TABLE ONLY ") && strings.Contains(line, " FOREIGN KEY "):
+			foreignKeys = append(foreignKeys, strings.TrimSpace(line))
+		default:
+			stmts.WriteString(line)
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return d.addForeignKeys(ctx, conn, foreignKeys)
+}
+
+// restoreCopy replaces the rows of the table of a COPY block with the rows
+// read from r, up to the end of the block, in a single transaction.
+func restoreCopy(ctx context.Context, conn *pgconn.PgConn, header *copytext.Header, r *bufio.Reader) error {
+	table := schema.QuoteName(header.Schema, header.Table)
+	var columns string
+	if len(header.Columns) > 0 {
+		quoted := make([]string, len(header.Columns))
+		for i, c := range header.Columns {
+			quoted[i] = pq.QuoteIdentifier(c)
+		}
+		columns = " (" + strings.Join(quoted, ", ") + ")"
+	}
+
+	// The rows are deleted rather than truncated: masking in place, the
+	// table is still being dumped, and TRUNCATE would wait for the dump,
+	// which waits for the rows to be restored. The rows of the tables
+	// inheriting from it are left, and with triggers disabled the delete
+	// does not cascade to the rows referencing it.
+	if _, err := conn.Exec(ctx, "BEGIN; DELETE FROM ONLY "+table).ReadAll(); err != nil {
+		conn.Exec(context.Background(), "ROLLBACK").ReadAll()
+		return err
+	}
+	block := &copyBlockReader{r: r}
+	if _, err := conn.CopyFrom(ctx, block, "COPY "+table+columns+" FROM STDIN"); err != nil {
+		conn.Exec(context.Background(), "ROLLBACK").ReadAll()
+		return err
+	}
+	if block.err != nil {
+		conn.Exec(context.Background(), "ROLLBACK").ReadAll()
+		return block.err
+	}
+	_, err := conn.Exec(ctx, "COMMIT").ReadAll()
+	return err
+}
+
+// copyBlockReader reads the rows of a COPY block up to its terminator, which
+// it consumes but does not return.
+type copyBlockReader struct {
+	r    *bufio.Reader
+	line []byte
+	done bool
+	// err is set if the input ends before the terminator.
+	err error
+}
+
+func (b *copyBlockReader) Read(p []byte) (int, error) {
+	for len(b.line) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		line, err := b.r.ReadString('\n')
+		if strings.TrimSuffix(line, "\n") == copytext.Terminator {
+			b.done = true
+			return 0, io.EOF
+		}
+		if err == io.EOF {
+			b.done = true
+			b.err = fmt.Errorf("unexpected end of input inside COPY block")
+			return 0, b.err
+		}
+		if err != nil {
+			return 0, err
+		}
+		b.line = []byte(line)
+	}
+	n := copy(p, b.line)
+	b.line = b.line[n:]
+	return n, nil
+}
+
+// addForeignKeys adds foreign keys, with the ones that could not be added
+// before. Foreign keys whose referenced table does not exist yet are kept for
+// a later call.
+func (d *postgresDatabase) addForeignKeys(ctx context.Context, conn *pgconn.PgConn, foreignKeys []string) error {
+	d.fkMu.Lock()
+	defer d.fkMu.Unlock()
+
+	var pending []string
+	for _, stmt := range append(d.foreignKeys, foreignKeys...) {
+		_, err := conn.Exec(ctx, stmt).ReadAll()
+		var pgErr *pgconn.PgError
+		switch {
+		case err == nil:
+		case errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable:
+			pending = append(pending, stmt)
+		case errors.As(err, &pgErr) && pgErr.Code == pgDuplicateObject:
+		default:
+			return err
+		}
+	}
+	d.foreignKeys = pending
+	return nil
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestCopyBlockReader(t *testing.T) {
+	for _, tt := range []struct {
+		name, in, rows, rest string
+		wantErr              bool
+	}{
+		{name: "terminated block", in: "1\ta\n2\tb\n\\.\nSELECT 1;\n", rows: "1\ta\n2\tb\n", rest: "SELECT 1;\n"},
+		{name: "empty block", in: "\\.\n", rows: ""},
+		{name: "terminator at end of input", in: "1\ta\n\\.", rows: "1\ta\n"},
+		{name: "escaped backslash", in: "\\\\.\n\\.\n", rows: "\\\\.\n"},
+		{name: "unterminated block", in: "1\ta\n2\tb", rows: "1\ta\n", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.in))
+			block := &copyBlockReader{r: r}
+			// A one-byte reader splits every row across reads.
+			rows, err := io.ReadAll(iotest.OneByteReader(block))
+			if (err != nil) != tt.wantErr || (block.err != nil) != tt.wantErr {
+				t.Fatalf("ReadAll() error = %v, block.err = %v, wantErr %v", err, block.err, tt.wantErr)
+			}
+			if string(rows) != tt.rows {
+				t.Errorf("rows = %q, want %q", rows, tt.rows)
+			}
+			if tt.wantErr {
+				return
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("input left after the block = %q, want %q", rest, tt.rest)
+			}
+			if n, err := block.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("Read() after the block = %d, %v, want 0, EOF", n, err)
+			}
+		})
+	}
+}
+
+// testPostgres returns the PostgreSQL database named by the libpq connection
+// string in VANDAL_TEST_POSTGRES, which tests may freely modify, or skips the
+// test if it is unset.
+func testPostgres(t *testing.T) (*postgresDatabase, *sql.DB) {
+	t.Helper()
+	dsn := os.Getenv("VANDAL_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("VANDAL_TEST_POSTGRES is not set")
+	}
+	cfg, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		t.Fatalf("parsing VANDAL_TEST_POSTGRES: %v", err)
+	}
+	database := NewPostgresDatabase(cfg.Host, strconv.Itoa(int(cfg.Port)), cfg.User, cfg.Password, cfg.Database, Options{}).(*postgresDatabase)
+	t.Cleanup(func() { database.Close() })
+	db, err := database.DB(context.Background())
+	if err != nil {
+		t.Fatalf("DB() error = %v", err)
+	}
+	return database, db
+}
+
+// exec runs statements, failing the test on the first error.
+func exec(t *testing.T, db *sql.DB, stmts ...string) {
+	t.Helper()
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+func TestRestoreReplacesRows(t *testing.T) {
+	database, db := testPostgres(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	exec(t, db,
+		"DROP TABLE IF EXISTS vandal_restore_orders, vandal_restore_users",
+		"CREATE TABLE vandal_restore_users (id integer PRIMARY KEY, email text)",
+		"CREATE TABLE vandal_restore_orders (id integer PRIMARY KEY, user_id integer REFERENCES vandal_restore_users ON DELETE CASCADE)",
+		"INSERT INTO vandal_restore_users VALUES (1, 'a@example.com'), (2, 'b@example.com')",
+		"INSERT INTO vandal_restore_orders VALUES (10, 1), (20, 2)",
+	)
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS vandal_restore_orders, vandal_restore_users") })
+
+	dump := "SET client_encoding = 'UTF8';\n" +
+		"COPY public.vandal_restore_users (id, email) FROM stdin;\n" +
+		"1\tREDACTED\n" +
+		"2\t\\N\n" +
+		"\\.\n" +
+		"CREATE TABLE vandal_restore_new (id integer);\n"
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS vandal_restore_new") })
+	if err := database.Restore(ctx, strings.NewReader(dump)); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	var emails []string
+	rows, err := db.QueryContext(ctx, "SELECT coalesce(email, 'NULL') FROM vandal_restore_users ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			t.Fatal(err)
+		}
+		emails = append(emails, email)
+	}
+	if strings.Join(emails, ",") != "REDACTED,NULL" {
+		t.Errorf("emails = %q, want the restored rows only", emails)
+	}
+
+	// Deleting the rows of a table must not cascade to the rows referencing
+	// them, which are restored separately.
+	var orders int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM vandal_restore_orders").Scan(&orders); err != nil {
+		t.Fatal(err)
+	}
+	if orders != 2 {
+		t.Errorf("vandal_restore_orders has %d rows, want 2", orders)
+	}
+
+	// The statements after the block are run.
+	if _, err := db.ExecContext(ctx, "SELECT * FROM vandal_restore_new"); err != nil {
+		t.Errorf("statement after the COPY block was not run: %v", err)
+	}
+}
+
+func TestRestoreKeepsRowsOfUnterminatedBlock(t *testing.T) {
+	database, db := testPostgres(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	exec(t, db,
+		"DROP TABLE IF EXISTS vandal_restore_partial",
+		"CREATE TABLE vandal_restore_partial (id integer)",
+		"INSERT INTO vandal_restore_partial VALUES (1), (2)",
+	)
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS vandal_restore_partial") })
+
+	dump := "COPY public.vandal_restore_partial (id) FROM stdin;\n3\n"
+	if err := database.Restore(ctx, strings.NewReader(dump)); err == nil {
+		t.Fatal("Restore() error = nil, want an error for the unterminated COPY block")
+	}
+	var rows int
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM vandal_restore_partial").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 2 {
+		t.Errorf("vandal_restore_partial has %d rows, want its 2 rows kept", rows)
+	}
+}
+
+func TestRestoreRequiresSuperuser(t *testing.T) {
+	database, db := testPostgres(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	exec(t, db,
+		"DROP ROLE IF EXISTS vandal_restore_user",
+		"CREATE ROLE vandal_restore_user LOGIN PASSWORD 'vandal'",
+	)
+	t.Cleanup(func() { db.Exec("DROP ROLE IF EXISTS vandal_restore_user") })
+
+	user := NewPostgresDatabase(database.host, database.port, "vandal_restore_user", "vandal", database.dbname, Options{})
+	defer user.Close()
+	err := user.Restore(ctx, strings.NewReader("SELECT 1;\n"))
+	if err == nil || !strings.Contains(err.Error(), "requires a superuser") {
+		t.Errorf("Restore() error = %v, want an error saying a superuser is required", err)
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// TLS modes, named after the sslmode settings of libpq.
+const (
+	// TLSModeDisable connects without TLS.
+	TLSModeDisable = "disable"
+	// TLSModeRequire encrypts connections without verifying the server.
+	TLSModeRequire = "require"
+	// TLSModeVerifyCA also verifies that the server certificate is signed by
+	// a trusted authority.
+	TLSModeVerifyCA = "verify-ca"
+	// TLSModeVerifyFull also verifies that the server certificate matches the
+	// host connected to.
+	TLSModeVerifyFull = "verify-full"
+)
+
+// TLS configures encrypted connections to a database.
+type TLS struct {
+	// Mode is one of the TLSMode constants, TLSModeDisable if empty.
+	Mode string
+	// CA holds the PEM certificates the server certificate is verified with.
+	// The system roots are used when empty.
+	CA []byte
+	// Cert and Key hold the PEM client certificate and key presented to the
+	// server, if any.
+	Cert []byte
+	Key  []byte
+}
+
+// config returns the tls.Config connecting to host with the settings, or nil
+// if TLS is disabled.
+func (t *TLS) config(host string) (*tls.Config, error) {
+	if t == nil || t.Mode == "" || t.Mode == TLSModeDisable {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{ServerName: host}
+	if len(t.Cert) > 0 || len(t.Key) > 0 {
+		cert, err := tls.X509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(t.CA) > 0 {
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(t.CA) {
+			return nil, errors.New("no valid certificate in CA")
+		}
+	}
+
+	switch t.Mode {
+	case TLSModeRequire:
+		cfg.InsecureSkipVerify = true
+	case TLSModeVerifyCA:
+		// The chain is verified without the host name, which the standard
+		// verification cannot skip.
+		roots := cfg.RootCAs
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		}
+	case TLSModeVerifyFull:
+	default:
+		return nil, fmt.Errorf("unsupported TLS mode %q", t.Mode)
+	}
+	return cfg, nil
+}
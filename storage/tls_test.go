@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority signing server certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vandal test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// serverCertificate returns a certificate for host signed by the authority.
+func (ca *testCA) serverCertificate(t *testing.T, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake connects a client configured with cfg to a server presenting cert
+// and returns the error of the client.
+func handshake(t *testing.T, cfg *tls.Config, cert tls.Certificate) error {
+	t.Helper()
+	// net.Pipe does not buffer, so a client rejecting the certificate would
+	// block writing its alert while the server still writes its handshake.
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), cfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestTLSConfig(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	cert := ca.serverCertificate(t, "db.example.com")
+
+	for _, tt := range []struct {
+		name    string
+		tls     *TLS
+		host    string
+		wantErr bool
+	}{
+		{name: "require with an untrusted certificate", tls: &TLS{Mode: TLSModeRequire, CA: other.pem}, host: "db.example.com"},
+		{name: "verify-ca", tls: &TLS{Mode: TLSModeVerifyCA, CA: ca.pem}, host: "db.example.com"},
+		{name: "verify-ca with another host name", tls: &TLS{Mode: TLSModeVerifyCA, CA: ca.pem}, host: "10.0.0.1"},
+		{name: "verify-ca with an untrusted CA", tls: &TLS{Mode: TLSModeVerifyCA, CA: other.pem}, host: "db.example.com", wantErr: true},
+		{name: "verify-full", tls: &TLS{Mode: TLSModeVerifyFull, CA: ca.pem}, host: "db.example.com"},
+		{name: "verify-full with a wrong host name", tls: &TLS{Mode: TLSModeVerifyFull, CA: ca.pem}, host: "other.example.com", wantErr: true},
+		{name: "verify-full with an untrusted CA", tls: &TLS{Mode: TLSModeVerifyFull, CA: other.pem}, host: "db.example.com", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.tls.config(tt.host)
+			if err != nil {
+				t.Fatalf("config() error = %v", err)
+			}
+			if err := handshake(t, cfg, cert); (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSConfigDisabled(t *testing.T) {
+	for _, settings := range []*TLS{nil, {}, {Mode: TLSModeDisable}} {
+		cfg, err := settings.config("db.example.com")
+		if cfg != nil || err != nil {
+			t.Errorf("%+v.config() = %v, %v, want nil, nil", settings, cfg, err)
+		}
+	}
+}
+
+func TestTLSConfigRejectsInvalidSettings(t *testing.T) {
+	for name, settings := range map[string]*TLS{
+		"unsupported mode":    {Mode: "prefer"},
+		"CA without PEM":      {Mode: TLSModeVerifyCA, CA: []byte("not a certificate")},
+		"client key missing":  {Mode: TLSModeRequire, Cert: newTestCA(t).pem},
+		"invalid client cert": {Mode: TLSModeRequire, Cert: []byte("x"), Key: []byte("y")},
+	} {
+		if _, err := settings.config("db.example.com"); err == nil {
+			t.Errorf("config() with %s: error = nil, want an error", name)
+		}
+	}
+}